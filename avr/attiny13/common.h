@@ -4,6 +4,7 @@
 
 #define byte unsigned char
 
+#include <avr/eeprom.h>
 #include <avr/interrupt.h>
 #include <util/atomic.h>
 #include <util/delay.h>
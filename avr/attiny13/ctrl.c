@@ -4,6 +4,12 @@
 // whether to turn on the boiler.  The uCs are connected to a third
 // uC, the MUX, via a single wire.  See XXX
 //
+// Over the wire the rPi sends us commands, to which we reply.  A command
+// and its reply are a header byte followed by up to three bytes of payload,
+// least significant bit first.  The header is a start bit 1, four bits of
+// opcode and two bits with the length of the payload.  See cmdi.go in
+// bart2d.
+//
 // XXX check whether temperature increase is within reasonable bounds when
 //      the heater is turned on --- this is to prevent the boiler from heating
 //      an (half-)empty boiler.
@@ -17,11 +23,32 @@
 #define PIN_GO         DDB3
 #define PIN_THERM      DDB4
 
-// Limits on tempearture
+// Default limits on tempearture.  The rPi can change them at runtime with
+// CMD_SET_THRESHOLD; we keep the changed limits in the EEPROM.
 #define TEMP_TARGET         790     // Heat if temp is below this
 #define TEMP_LOWER_BOUND    26      // go into error mode if temp is below this
 #define TEMP_UPPER_BOUND    980     // go into error mode if temp is above this
 
+// Version of the protocol, passed by the Makefile.
+#ifndef PROTOCOL
+#error "PROTOCOL should be defined"
+#endif
+
+// Opcodes
+#define CMD_STATUS          0       // reply with our status
+#define CMD_VERSION         1       // reply with PROTOCOL
+#define CMD_GET_THRESHOLD   2       // reply with a threshold
+#define CMD_SET_THRESHOLD   3       // set a threshold; reply as GET
+#define CMD_NAK             15      // reply to an unknown opcode
+
+#define HEADER(op, len)     (1 | ((op) << 1) | ((len) << 5))
+
+// Indices in thresholds, the first byte of the payload of the
+// CMD_*_THRESHOLD commands.  The threshold itself is the next two bytes.
+#define THRESHOLD_LOWER_BOUND   0
+#define THRESHOLD_TARGET        1
+#define THRESHOLD_UPPER_BOUND   2
+
 // We add 32 measurements and to get a neat average.  adc_accum cotains
 // the partial sums of the current measurements and adc_cnt the amount we
 // have performed.
@@ -29,6 +56,8 @@ register unsigned int adc_accum asm("r2");  // r2, r3
 register byte adc_cnt asm("r4");
 register byte watch_in_changed asm("r5");
 
+// Our reply to CMD_STATUS.  If you change it, bump PROTOCOL and register
+// the new layout in reportschema.go of bart2d.
 struct status {
     unsigned int temperature : 10;
     byte heating : 1;
@@ -40,6 +69,19 @@ struct status {
 
 struct status status;
 
+// The limits on temperature in effect, indexed by THRESHOLD_*, and their
+// copy in the EEPROM.
+volatile unsigned int thresholds[3];
+unsigned int ee_thresholds[3] EEMEM;
+
+// Returns whether t are sane limits on temperature.
+byte thresholds_ok(unsigned int* t)
+{
+    return t[THRESHOLD_LOWER_BOUND] < t[THRESHOLD_TARGET]
+        && t[THRESHOLD_TARGET] < t[THRESHOLD_UPPER_BOUND]
+        && t[THRESHOLD_UPPER_BOUND] < 1024;
+}
+
 void main(void) __attribute__ ((noreturn));
 
 void main(void)
@@ -49,6 +91,8 @@ void main(void)
     // Initialize variables
     unsigned long draad_tx_buffer = 0;
     byte draad_tx_buffer_size = 0;
+    unsigned long draad_rx_buffer = 0;
+    byte draad_rx_buffer_size = 0;
 
     adc_accum = 0;
     adc_cnt = 0;
@@ -61,6 +105,18 @@ void main(void)
     status.temp_way_too_high = 0;
     status.other_uC_not_responding = 0;
 
+    // Load the limits from the EEPROM.  It is blank (or garbage) after we
+    // have been flashed, as the Makefile does not write the EEPROM.
+    unsigned int t[3];
+    eeprom_read_block(t, ee_thresholds, sizeof(t));
+    if (!thresholds_ok(t)) {
+        t[THRESHOLD_LOWER_BOUND] = TEMP_LOWER_BOUND;
+        t[THRESHOLD_TARGET] = TEMP_TARGET;
+        t[THRESHOLD_UPPER_BOUND] = TEMP_UPPER_BOUND;
+    }
+    for (byte i = 0; i < 3; i++)
+        thresholds[i] = t[i];
+
     // Set up watch timer (~18Hz)
     TCCR0B |= _BV(CS00) | _BV(CS02);  // enable clock --- prescale by 1024
     TIMSK0 |= _BV(TOIE0);        // enable clock overflow interrupt
@@ -82,7 +138,6 @@ void main(void)
 
     PINB |= _BV(PIN_WATCH_OUT);  // let other uC know the ADC is running
 
-    // XXX make protocol on draad more flexible.  I.e. to set THERM_* runtime.
     for (;;) {
         // Wait until the mux pulls the draad high
         while (!(PINB & _BV(PIN_DRAAD)));
@@ -99,17 +154,74 @@ void main(void)
             if (PINB & _BV(PIN_DRAAD))
                 received = 1;
 
-            // XXX here we could handle more complex incoming messages ---
-            // for now we'll just send our status message everytime we
-            // get any incoming bit 1.
-            if (draad_tx_buffer_size == 0 && received) {
-                draad_tx_buffer = *((unsigned long*)(&status));
-                draad_tx_buffer_size = 16;
-            }
-
             while (PINB & _BV(PIN_DRAAD));
 
             _delay_us(DRAAD_DELAY * 0.25);
+
+            // Wait for the start bit of a command.
+            if (draad_rx_buffer_size == 0 && !received)
+                continue;
+
+            draad_rx_buffer |= (unsigned long)received << draad_rx_buffer_size;
+            draad_rx_buffer_size++;
+            if (draad_rx_buffer_size < 8)
+                continue;
+
+            byte header = draad_rx_buffer & 255;
+            if (!(header & 128) && draad_rx_buffer_size
+                                    < 8 + 8 * ((header >> 5) & 3))
+                continue;
+
+            // We received a whole command, or garbage.  Reply, unless we
+            // are still sending the previous reply.
+            unsigned long payload = draad_rx_buffer >> 8;
+            byte which = payload & 255;
+            draad_rx_buffer = 0;
+            draad_rx_buffer_size = 0;
+            if ((header & 128) || draad_tx_buffer_size > 0)
+                continue;
+
+            switch ((header >> 1) & 15) {
+            case CMD_STATUS:
+                draad_tx_buffer = HEADER(CMD_STATUS, 2)
+                    | ((unsigned long)*((unsigned int*)(&status)) << 8);
+                draad_tx_buffer_size = 24;
+                break;
+            case CMD_VERSION:
+                draad_tx_buffer = HEADER(CMD_VERSION, 1) | (PROTOCOL << 8);
+                draad_tx_buffer_size = 16;
+                break;
+            case CMD_SET_THRESHOLD:
+                if (((header >> 5) & 3) != 3 || which > 2)
+                    goto nak;
+                t[0] = thresholds[0];
+                t[1] = thresholds[1];
+                t[2] = thresholds[2];
+                t[which] = payload >> 8;
+                // Refuse insane limits: the reply tells the old value.
+                if (thresholds_ok(t)) {
+                    ATOMIC_BLOCK(ATOMIC_FORCEON) {
+                        thresholds[which] = t[which];
+                    }
+                    eeprom_update_block(t, ee_thresholds, sizeof(t));
+                }
+                // fall through
+            case CMD_GET_THRESHOLD:
+                if (which > 2)
+                    goto nak;
+                ATOMIC_BLOCK(ATOMIC_FORCEON) {
+                    draad_tx_buffer = HEADER((header >> 1) & 15, 3)
+                        | ((unsigned long)which << 8)
+                        | ((unsigned long)thresholds[which] << 16);
+                }
+                draad_tx_buffer_size = 32;
+                break;
+            default:
+            nak:
+                draad_tx_buffer = HEADER(CMD_NAK, 1)
+                    | (((header >> 1) & 15) << 8);
+                draad_tx_buffer_size = 16;
+            }
             continue;
         }
 
@@ -151,18 +263,18 @@ ISR(ADC_vect)
         adc_accum = 0;
         adc_cnt = 0;
 
-        if (temp <= TEMP_LOWER_BOUND) {
+        if (temp <= thresholds[THRESHOLD_LOWER_BOUND]) {
             status.ok = 0;
             status.temp_way_too_low = 1;
             status.heating = 0;
             PORTB &= ~_BV(PIN_GO);
-        } else if (temp >= TEMP_UPPER_BOUND) {
+        } else if (temp >= thresholds[THRESHOLD_UPPER_BOUND]) {
             status.ok = 0;
             status.heating = 0;
             status.temp_way_too_high = 1;
             PORTB &= ~_BV(PIN_GO);
         } else if (!status.ok) {
-        } else if (temp < TEMP_TARGET) {
+        } else if (temp < thresholds[THRESHOLD_TARGET]) {
             PORTB |= _BV(PIN_GO);
             status.heating = 1;
         } else  {
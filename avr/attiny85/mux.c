@@ -10,11 +10,16 @@
 // The MUX is connected to the rPi using a 3-wire SPI connection in mode 01
 // with a baudrate of ~10kHz.
 //
-// There is a single wire from the MUX to each of the other uCs.  With this
-// single wire the uC and the MUX can communicate in half-duplex using a
-// variation on the "one-wire protocol", we call "draad".  See XXX
+// There is a single wire from the MUX to each of the other uCs (N_DRAAD in
+// total).  With this single wire the uC and the MUX can communicate in
+// half-duplex using a variation on the "one-wire protocol", we call
+// "draad".  See XXX
 //
-// XXX send status
+// A frame without body from the rPi asks for the status of the MUX.  The
+// MUX replies with a frame with the otherwise unused header STATUS_HEADER,
+// followed by a byte with the overflow flags and a byte with the version
+// of the protocol.  The flags are cleared once they are sent.  See
+// muxstatus.go in bart2d.
 
 #include "common.h"
 
@@ -25,19 +30,41 @@
 #define PIN_DRAAD1     DDB3
 #define PIN_DRAAD2     DDB4
 
+// Number of uCs behind the MUX.  The header of an SPI frame has room for
+// four, but the ATTINY85 only has pins for two draads: more need a MUX
+// with more pins.
+#ifndef N_DRAAD
+#define N_DRAAD 2
+#endif
+#if N_DRAAD < 1 || N_DRAAD > 2
+#error "N_DRAAD should be 1 or 2 on the ATTINY85"
+#endif
+
+const byte draad_pins[2] = {PIN_DRAAD1, PIN_DRAAD2};
+
+// Version of the protocol, passed by the Makefile.
+#ifndef PROTOCOL
+#error "PROTOCOL should be defined"
+#endif
+
+#define STATUS_HEADER (128 | (31 << 2))
+#define STATUS_DRAAD_TX_OVERFLOW 1
+#define STATUS_SPI_RX_OVERFLOW 2
+
 register unsigned long spi_tx_buffer asm("r10"); // r10, r11, r12, r13
 register byte spi_tx_buffer_size asm("r14");    // XXX only need 5 bits
 
-volatile unsigned long draad_tx_buffer[2] = {0,0};
-volatile byte draad_tx_buffer_size[2] = {0,0};
+volatile unsigned long draad_tx_buffer[N_DRAAD] = {0};
+volatile byte draad_tx_buffer_size[N_DRAAD] = {0};
 
-unsigned long draad_rx_buffer[2] = {0,0};
-byte draad_rx_buffer_size[2] = {0,0};
+unsigned long draad_rx_buffer[N_DRAAD] = {0};
+byte draad_rx_buffer_size[N_DRAAD] = {0};
 
 
 struct status {
     byte draad_tx_overflow : 1;
     byte spi_rx_overflow : 1;
+    byte requested : 1;         // the rPi asked for the status
 };
 
 register struct status status asm("r15");
@@ -66,6 +93,7 @@ void main(void)
 
     status.draad_tx_overflow = 0;
     status.spi_rx_overflow = 0;
+    status.requested = 0;
 
     // Set up pins and interrupts for SPI.
     DDRB |= _BV(PIN_SPI_MISO);  // MISO (for SPI) is output
@@ -77,10 +105,9 @@ void main(void)
     sei();  // enable interrupts
 
     // We will loop and either
-    //  (1) poll the first uC,
-    //  (2) poll the second uC,
-    //  (3) prepare the data to be send over SPI or
-    //  (4) parse the data we received over SPI.
+    //  (1) poll the next uC, in turn,
+    //  (2) prepare the data to be send over SPI or
+    //  (3) parse the data we received over SPI.
     // We process the SPI data in the main loop such that we don't spend
     // too much time in interrupt handlers, which would mess with the timing
     // on the draad.
@@ -88,7 +115,7 @@ void main(void)
     byte who = 0; // which uC is being polled?
 
     for(;;) {
-        who = 1 - who;
+        who = who + 1 == N_DRAAD ? 0 : who + 1;
         
         // Interpret SPI rx buffer if it's not empty
         while (spi_rx_buffer_size > 0) {
@@ -115,7 +142,7 @@ void main(void)
                     continue;
 
                 // We received the whole frame.  Send it over draad.
-                if (spi_frame_who > 1)
+                if (spi_frame_who >= N_DRAAD)
                     continue;
 
                 // Check for overflow
@@ -142,10 +169,29 @@ void main(void)
             spi_frame_body_bits_to_read = spi_frame_body_size;
             spi_frame_who = (spi_byte_received) & 3;
             spi_frame_body = 0;
+
+            // A frame without body is a request for our status.
+            if (spi_frame_body_size == 0)
+                status.requested = 1;
         }
 
-        // Fill SPI tx buffer if it's empty
-        if (spi_tx_buffer_size == 0 && draad_rx_buffer_size[who] > 0) {
+        // Fill SPI tx buffer if it's empty.  The status goes first.
+        if (spi_tx_buffer_size == 0 && status.requested) {
+            ATOMIC_BLOCK(ATOMIC_FORCEON)
+            {
+                byte flags = 0;
+                if (status.draad_tx_overflow)
+                    flags |= STATUS_DRAAD_TX_OVERFLOW;
+                if (status.spi_rx_overflow)
+                    flags |= STATUS_SPI_RX_OVERFLOW;
+                spi_tx_buffer = STATUS_HEADER | (flags << 8)
+                                  | ((unsigned long)PROTOCOL << 16);
+                spi_tx_buffer_size = 24;
+                status.draad_tx_overflow = 0;
+                status.spi_rx_overflow = 0;
+                status.requested = 0;
+            }
+        } else if (spi_tx_buffer_size == 0 && draad_rx_buffer_size[who] > 0) {
                 byte n_bits_to_send = draad_rx_buffer_size[who];
                 if (n_bits_to_send > 24)
                     n_bits_to_send = 24;
@@ -159,7 +205,7 @@ void main(void)
             draad_rx_buffer[who] >>= n_bits_to_send;
         }
 
-        byte pin = who == 0 ? PIN_DRAAD1 : PIN_DRAAD2;
+        byte pin = draad_pins[who];
 
         if (draad_tx_buffer_size[who] > 0) {
             byte to_send;
@@ -208,7 +254,10 @@ void main(void)
         if (PINB & _BV(pin))
             received = 1;
 
-        draad_rx_buffer[who] |= (received << draad_rx_buffer_size[who]);
+        // Widen received before shifting: as an int it would lose the
+        // bits from the 16th on.
+        draad_rx_buffer[who] |= ((unsigned long)received
+                                    << draad_rx_buffer_size[who]);
         draad_rx_buffer_size[who]++;
         _delay_us(DRAAD_DELAY);
     }
@@ -0,0 +1,276 @@
+package main
+
+// Calibration of the thermistors of the chips.
+//
+// While the chips measure, the user puts their thermistors and a reference
+// probe in, for instance, ice water, boiling water and the brew water, and
+// enters the temperature the probe shows.  For every reference
+// temperature we record the average VoltageNo reported by each chip.  The
+// Steinhart--Hart coefficients are then fit to these points per chip.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CALIBRATE_MIN_POINTS is the number of reference temperatures needed to
+// fit the three Steinhart--Hart coefficients.
+const CALIBRATE_MIN_POINTS = 3
+
+// FitSteinhartHart returns the Thermistor which fits the given points
+// best, in the least-squares sense of 1/T = A + B ln R + C (ln R)^3.
+func FitSteinhartHart(points []TablePoint) (t Thermistor, err error) {
+	if len(points) < CALIBRATE_MIN_POINTS {
+		return t, fmt.Errorf("need at least %d points to fit, got %d",
+			CALIBRATE_MIN_POINTS, len(points))
+	}
+
+	// The normal equations M x = v of the linear least-squares problem.
+	var M [3][4]float64 // with v as its last column
+	for _, p := range points {
+		if p.R <= 0 {
+			return t, fmt.Errorf("resistances should be positive")
+		}
+		logR := math.Log(p.R)
+		row := [3]float64{1, logR, logR * logR * logR}
+		y := 1 / (p.TempC + KELVIN)
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				M[i][j] += row[i] * row[j]
+			}
+			M[i][3] += row[i] * y
+		}
+	}
+
+	// Gaussian elimination with partial pivoting.
+	for col := 0; col < 3; col++ {
+		pivot := col
+		for i := col + 1; i < 3; i++ {
+			if math.Abs(M[i][col]) > math.Abs(M[pivot][col]) {
+				pivot = i
+			}
+		}
+		if math.Abs(M[pivot][col]) < 1e-12*math.Abs(M[0][0]) {
+			return t, fmt.Errorf("points do not determine a fit: " +
+				"measure at more distinct temperatures")
+		}
+		M[col], M[pivot] = M[pivot], M[col]
+		for i := col + 1; i < 3; i++ {
+			f := M[i][col] / M[col][col]
+			for j := col; j < 4; j++ {
+				M[i][j] -= f * M[col][j]
+			}
+		}
+	}
+	var x [3]float64
+	for i := 2; i >= 0; i-- {
+		x[i] = M[i][3]
+		for j := i + 1; j < 3; j++ {
+			x[i] -= M[i][j] * x[j]
+		}
+		x[i] /= M[i][i]
+	}
+	return Thermistor{A: x[0], B: x[1], C: x[2]}, nil
+}
+
+// Calibration collects the calibration points of the chips.
+type Calibration struct {
+	// Samples is the number of reports of a chip that are averaged into a
+	// single point.
+	Samples int
+
+	// Points holds the recorded points of every chip.
+	Points [][]TablePoint
+
+	// resistance converts an average VoltageNo into the resistance of the
+	// thermistor, see Chipi.Resistance.
+	resistance func(voltageNo float64) float64
+	recent     [][]uint // the last VoltageNos reported, per chip
+}
+
+func NewCalibration(chips, samples int,
+	resistance func(voltageNo float64) float64) *Calibration {
+	return &Calibration{
+		Samples:    samples,
+		Points:     make([][]TablePoint, chips),
+		resistance: resistance,
+		recent:     make([][]uint, chips),
+	}
+}
+
+// Add accounts for a report of a chip.
+func (c *Calibration) Add(report ChipiReport) {
+	recent := append(c.recent[report.Chip], report.VoltageNo)
+	if len(recent) > c.Samples {
+		recent = recent[len(recent)-c.Samples:]
+	}
+	c.recent[report.Chip] = recent
+}
+
+// Average returns the average of the last Samples VoltageNos reported by
+// chip.  ok is false if the chip did not report that often yet.
+func (c *Calibration) Average(chip int) (voltageNo float64, ok bool) {
+	recent := c.recent[chip]
+	if len(recent) < c.Samples {
+		return 0, false
+	}
+	var sum uint
+	for _, no := range recent {
+		sum += no
+	}
+	return float64(sum) / float64(len(recent)), true
+}
+
+// Record adds a point at the given reference temperature for every chip.
+// It fails if not every chip has reported Samples times since the
+// previous point.
+func (c *Calibration) Record(tempC float64) error {
+	var averages []float64
+	for chip := range c.recent {
+		voltageNo, ok := c.Average(chip)
+		if !ok {
+			return fmt.Errorf("chip %d has only reported %d of %d times",
+				chip, len(c.recent[chip]), c.Samples)
+		}
+		averages = append(averages, voltageNo)
+	}
+	for chip, voltageNo := range averages {
+		c.Points[chip] = append(c.Points[chip], TablePoint{
+			R:     c.resistance(voltageNo),
+			TempC: tempC,
+		})
+		// The next point should be measured afresh.
+		c.recent[chip] = nil
+	}
+	return nil
+}
+
+const CALIBRATE_HELP = `Enter the temperature of the reference probe, once the
+thermistors are at that temperature.  An empty line shows the current
+readings; q or end of file fits the coefficients.
+`
+
+// cmdCalibrate implements `bart2d calibrate'.
+func cmdCalibrate(args []string) error {
+	flags := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	dirPath := flags.String("dir", "", "data directory; ~/.bart2d if empty")
+	samples := flags.Int("samples", 10,
+		"number of reports averaged for every reference temperature")
+	dryRun := flags.Bool("n", false, "do not write the configuration")
+	flags.Usage = func() {
+		fmt.Print("usage: bart2d calibrate [flags]\n\n" +
+			"Fits the thermistors of the chips to reference temperatures.\n" +
+			CALIBRATE_HELP + "\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *samples < 1 {
+		return fmt.Errorf("-samples should be positive")
+	}
+
+	b := &Bart2d{DirPath: *dirPath}
+	dir, err := openDir(b.DirPath)
+	if err != nil {
+		return err
+	}
+	b.dir = dir
+	if b.config, err = ConfigOpen(b.dir); err != nil {
+		return err
+	}
+	chipi, err := b.openChipi()
+	if err != nil {
+		return WrapErr(err, "Could not open Chipi")
+	}
+	defer chipi.Close()
+
+	calibration := NewCalibration(b.config.Chips, *samples,
+		chipi.Resistance)
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	fmt.Print(CALIBRATE_HELP)
+	fmt.Print("reference temperature> ")
+loop:
+	for {
+		select {
+		case err := <-chipi.Err:
+			fmt.Printf("!! chipi error: %v\n", err)
+		case report := <-chipi.Reports:
+			calibration.Add(report)
+		case line, ok := <-lines:
+			line = strings.TrimSpace(line)
+			if !ok || line == "q" {
+				break loop
+			}
+			if line == "" {
+				printCalibrationReadings(calibration)
+			} else if tempC, err := strconv.ParseFloat(line, 64); err != nil {
+				fmt.Printf("%s is not a temperature\n", line)
+			} else if err := calibration.Record(tempC); err != nil {
+				fmt.Printf("Not recorded: %v; try again\n", err)
+			} else {
+				fmt.Printf("Recorded %.1fC\n", tempC)
+			}
+			fmt.Print("reference temperature> ")
+		}
+	}
+	fmt.Println()
+
+	for len(b.config.Thermistors) < b.config.Chips {
+		b.config.Thermistors = append(b.config.Thermistors,
+			ThermistorConfig{})
+	}
+	fitted := false
+	for chip, points := range calibration.Points {
+		t, err := FitSteinhartHart(points)
+		if err != nil {
+			fmt.Printf("chip %d: %v\n", chip, err)
+			continue
+		}
+		fmt.Printf("chip %d: A=%.4e B=%.4e C=%.4e\n", chip, t.A, t.B, t.C)
+		printCalibrationResiduals(os.Stdout, t, points)
+		b.config.Thermistors[chip] = ThermistorConfig{SteinhartHart: &t}
+		fitted = true
+	}
+	if !fitted || *dryRun {
+		return nil
+	}
+	if err := ConfigWrite(b.dir, b.config); err != nil {
+		return WrapErr(err, "Could not write configuration")
+	}
+	fmt.Printf("Wrote %s\n", b.dir.Config())
+	return nil
+}
+
+func printCalibrationReadings(c *Calibration) {
+	for chip := range c.Points {
+		if voltageNo, ok := c.Average(chip); ok {
+			fmt.Printf("chip %d: VoltageNo %.1f, %.0f Ohm\n", chip,
+				voltageNo, c.resistance(voltageNo))
+		} else {
+			fmt.Printf("chip %d: waiting for reports\n", chip)
+		}
+	}
+}
+
+func printCalibrationResiduals(w io.Writer, t Thermistor,
+	points []TablePoint) {
+	fmt.Fprintf(w, "  %8s %8s %8s %8s\n", "R", "ref", "fit", "residual")
+	for _, p := range points {
+		tempC := t.TempC(p.R)
+		fmt.Fprintf(w, "  %8.0f %8.2f %8.2f %+8.2f\n", p.R, p.TempC,
+			tempC, tempC-p.TempC)
+	}
+}
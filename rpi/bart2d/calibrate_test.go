@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFitSteinhartHart(t *testing.T) {
+	for _, th := range []Thermistor{
+		ourThermistor(),
+		{A: 1.1e-3, B: 2.4e-4, C: 7e-8},
+	} {
+		var points []TablePoint
+		for _, tempC := range []float64{0, 25, 100, 120} {
+			points = append(points, TablePoint{
+				R:     th.R(tempC),
+				TempC: tempC,
+			})
+		}
+		fit, err := FitSteinhartHart(points)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range points {
+			if got := fit.TempC(p.R); math.Abs(got-p.TempC) > 1e-3 {
+				t.Errorf("%+v: fit %+v gives %.3fC instead of %.0fC",
+					th, fit, got, p.TempC)
+			}
+		}
+	}
+
+	// Three coefficients need three distinct points.
+	if _, err := FitSteinhartHart([]TablePoint{
+		{R: 30000, TempC: 0}, {R: 1000, TempC: 100}}); err == nil {
+		t.Error("fit through two points")
+	}
+	if _, err := FitSteinhartHart([]TablePoint{{R: 1000, TempC: 100},
+		{R: 1000, TempC: 100}, {R: 1000, TempC: 100}}); err == nil {
+		t.Error("fit through a single point")
+	}
+}
+
+func TestCalibration(t *testing.T) {
+	c := NewCalibration(2, 3, func(no float64) float64 { return 10 * no })
+	for _, no := range []uint{1, 100, 101, 102} {
+		c.Add(ChipiReport{Chip: 0, VoltageNo: no})
+	}
+	c.Add(ChipiReport{Chip: 1, VoltageNo: 200})
+	if err := c.Record(50); err == nil {
+		t.Fatal("recorded a point without enough reports of chip 1")
+	}
+	c.Add(ChipiReport{Chip: 1, VoltageNo: 200})
+	c.Add(ChipiReport{Chip: 1, VoltageNo: 200})
+	if err := c.Record(50); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]TablePoint{{{R: 1010, TempC: 50}}, {{R: 2000, TempC: 50}}}
+	if !reflect.DeepEqual(c.Points, expected) {
+		t.Fatalf("points are %v instead of %v", c.Points, expected)
+	}
+	if err := c.Record(60); err == nil {
+		t.Fatal("recorded a second point from the same reports")
+	}
+}
+
+func TestConfigWrite(t *testing.T) {
+	pth, err := ioutil.TempDir("", "bart2d-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pth)
+	dir, err := DirOpenAt(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := ourConfig()
+	config.Thermistors = []ThermistorConfig{{}, {
+		SteinhartHart: &Thermistor{A: 1.1e-3, B: 2.4e-4, C: 7e-8}}}
+	if err := ConfigWrite(dir, config); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ConfigOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, config) {
+		t.Fatalf("read %+v instead of %+v", read, config)
+	}
+}
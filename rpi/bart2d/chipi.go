@@ -5,14 +5,10 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// ourThermistor returns the type of thermistor we use in our Bar T2.
-func ourThermistor() Thermistor {
-	return Thermistor{A: 1.270e-3, B: 2.229e-4, C: 3.948e-8}
-}
-
 func ourRMeter() RMeter {
 	return RMeter{Resistor: 997}
 }
@@ -21,20 +17,6 @@ func ourVRatioMeter() VRatioMeter {
 	return VRatioMeter{MaxNo: 1023}
 }
 
-// Thermistor models a thermistor by its Steinhart--Hart coefficients (A,B,C).
-type Thermistor struct {
-	A float64
-	B float64
-	C float64
-}
-
-// TempC returns the temperature (in Celsius) at the given resistance.
-func (t Thermistor) TempC(R float64) float64 {
-	logR := math.Log(R)
-	tempKrec := 1.270e-3 + 2.229e-4*logR + 3.948e-8*math.Pow(logR, 3)
-	return (1 / tempKrec) - 273.15
-}
-
 // RMeter models the way we measure the resistance of the
 // thermistor: by measuring the ratio of the voltage  over the thermistor
 // to the voltage over the thermistor and a resistor put in series.
@@ -48,6 +30,12 @@ func (r RMeter) R(ratio float64) float64 {
 	return (1/ratio - 1) * r.Resistor
 }
 
+// Ratio is the inverse of R: it returns the voltage ratio at which the
+// given resistance is measured.
+func (r RMeter) Ratio(R float64) float64 {
+	return r.Resistor / (R + r.Resistor)
+}
+
 // VRatioMeter models the way the ICs measure the ratio of the
 // voltage on a pin to the voltage provided: it returns a number
 // from 0 to MaxNo; 0 indicates the ratio 0, and MaxNo indicates 1.
@@ -60,6 +48,13 @@ func (v VRatioMeter) Ratio(no uint) float64 {
 	return float64(no) / float64(v.MaxNo)
 }
 
+// No is the inverse of Ratio: it returns the number closest to the given
+// ratio.
+func (v VRatioMeter) No(ratio float64) uint {
+	no := math.Floor(ratio*float64(v.MaxNo) + 0.5)
+	return uint(math.Max(0, math.Min(float64(v.MaxNo), no)))
+}
+
 // ChipiReport models a report on temperature of the boiler (among other
 // things) send by the chips.
 type ChipiReport struct {
@@ -73,6 +68,9 @@ type ChipiReport struct {
 	TempHigh  bool
 	BuddyDied bool
 
+	// Protocol of the ReportSchema by which the report was decoded.
+	Protocol int
+
 	// for debug purposes:
 	Msg MuxiMsg
 }
@@ -107,135 +105,417 @@ func (rep ChipiReport) toRecord() (rec []string) {
 	return
 }
 
-func (c *Chipi) reportFrom(msg MuxiMsg) (r ChipiReport) {
+// reportFrom decodes a report of chip laid out as schema.
+func (c *Chipi) reportFrom(chip byte, schema ReportSchema,
+	bits MuxiBits) (r ChipiReport, err error) {
 	r.Time = time.Now()
-	r.Chip = msg.Chip
-	r.VoltageNo = msg.UintX(0, 10, true) // true = least significant bit first
-	r.Heating = msg.Bool(10)
-	r.OK = msg.Bool(11)
-	r.TempLow = msg.Bool(12)
-	r.TempHigh = msg.Bool(13)
-	r.BuddyDied = msg.Bool(14)
+	r.Chip = chip
+	if err = schema.Decode(bits, &r); err != nil {
+		return
+	}
 	r.computeTempC(c)
-	r.Msg = msg
+	r.Msg = MuxiMsg{Chip: chip, Bits: bits}
 	return
 }
 
 func (r *ChipiReport) computeTempC(c *Chipi) {
-	ratio := c.voltageRatioMeter.Ratio(r.VoltageNo)
-	R := c.resistanceMeter.R(ratio)
-	r.TempC = c.thermistor.TempC(R)
+	R := c.Resistance(float64(r.VoltageNo))
+	r.TempC = c.models[r.Chip].TempC(R)
 }
 
-// Chipi is the interface to the two chips which measure the temperature
-// of the boiler.
+// Resistance returns the resistance of a thermistor at the given
+// VoltageNo, which may be an average.
+func (c *Chipi) Resistance(voltageNo float64) float64 {
+	ratio := voltageNo / float64(c.voltageRatioMeter.MaxNo)
+	return c.resistanceMeter.R(ratio)
+}
+
+// TempC returns the temperature measured by chip at the given VoltageNo,
+// which may be an average.
+func (c *Chipi) TempC(chip byte, voltageNo float64) float64 {
+	return c.models[chip].TempC(c.Resistance(voltageNo))
+}
+
+// VoltageNo returns the VoltageNo chip measures closest to the given
+// temperature, and the resolution there: the range of temperatures (in
+// Celsius) measured as that VoltageNo.  This is how to express a
+// temperature in the units of the firmware, such as CTRL_TEMP_TARGET.  It
+// fails if the TemperatureModel of chip has no resistance for tempC.
+func (c *Chipi) VoltageNo(chip byte, tempC float64) (voltageNo uint,
+	resolution float64, err error) {
+	R := c.models[chip].R(tempC)
+	if math.IsNaN(R) || R < 0 {
+		return 0, 0, fmt.Errorf("chipi: the thermistor of chip %d has no "+
+			"resistance at %.1fC", chip, tempC)
+	}
+	voltageNo = c.voltageRatioMeter.No(c.resistanceMeter.Ratio(R))
+	return voltageNo, c.Resolution(chip, voltageNo), nil
+}
+
+// Resolution returns the range of temperatures (in Celsius) chip measures
+// as the given VoltageNo.  It is infinite at 0 and MaxNo, which cover all
+// temperatures beyond.
+func (c *Chipi) Resolution(chip byte, voltageNo uint) float64 {
+	if voltageNo == 0 || voltageNo >= c.voltageRatioMeter.MaxNo {
+		return math.Inf(1)
+	}
+	no := float64(voltageNo)
+	return math.Abs(c.TempC(chip, no+0.5) - c.TempC(chip, no-0.5))
+}
+
+// Chipi is the interface to the chips behind the MUX, such as the two
+// which measure the temperature of the boiler.
 type Chipi struct {
 	Reports <-chan ChipiReport
 	Err     <-chan error
+	Events  <-chan ChipiEvent // see chipievents.go; need not be read
 
-	thermistor        Thermistor
+	models            []TemperatureModel // per chip
 	resistanceMeter   RMeter
 	voltageRatioMeter VRatioMeter
 	reports           chan ChipiReport
 	err               chan error
+	events            chan ChipiEvent
 	closer            chan bool
 	muxi              *Muxi
-	out0, out1        chan MuxiMsg
+	cmdi              *Cmdi // nil if the chips do not take commands
+	schemas           *ReportSchemas
+
+	mutex         sync.Mutex  // protects stats and droppedEvents
+	stats         []ChipStats // per chip
+	droppedEvents uint64
 }
 
 // ChipiOpen opens an interface to the chips.
 func ChipiOpen() (chipi *Chipi, err error) {
+	muxi, err := MuxiOpen(ourMuxiConfig())
+	if err != nil {
+		return
+	}
+	return ChipiOpenMuxi(muxi, nil)
+}
+
+// ChipiOpenMuxi opens an interface to the chips behind the given Muxi.
+// It talks to every chip with commands, see Cmdi, unless the chip does not
+// take them: then it asks for its reports as the firmware of protocol 1
+// expects, see ReportSchemas.LatestRaw.  models holds the TemperatureModel
+// of the thermistor of each chip; chips without one have ourThermistor.
+// The Chipi closes muxi when it is closed, or when it could not be opened.
+func ChipiOpenMuxi(muxi *Muxi, models []TemperatureModel) (chipi *Chipi,
+	err error) {
+	chipi, err = chipiOpen(muxi, models)
+	if err != nil {
+		return
+	}
+	chipi.cmdi, err = CmdiOpen(muxi, ourCmdiConfig())
+	if err != nil {
+		muxi.Close()
+		return nil, err
+	}
+	for chip := range chipi.stats {
+		go chipi.doGetReports(byte(chip))
+	}
+	go chipi.doGetErrors()
+	return
+}
+
+// ChipiOpenRaw is as ChipiOpenMuxi, for chips whose firmware sends its
+// reports without a header, such as in recordings made before protocol 2.
+// schema is the layout of their reports.  These chips do not take
+// commands.
+func ChipiOpenRaw(muxi *Muxi, models []TemperatureModel,
+	schema ReportSchema) (chipi *Chipi, err error) {
+	if !schema.Raw {
+		muxi.Close()
+		return nil, fmt.Errorf("chipi: reports of protocol %d are not raw",
+			schema.Protocol)
+	}
+	chipi, err = chipiOpen(muxi, models)
+	if err != nil {
+		return
+	}
+	go chipi.doGetRawReports(schema)
+	go chipi.doGetErrors()
+	return
+}
+
+func chipiOpen(muxi *Muxi, models []TemperatureModel) (chipi *Chipi,
+	err error) {
+	if len(models) > muxi.Chips() {
+		muxi.Close()
+		return nil, fmt.Errorf("chipi: got models for %d chips, but there "+
+			"are only %d", len(models), muxi.Chips())
+	}
 	chipi = &Chipi{
+		muxi:              muxi,
+		schemas:           ourReportSchemas(),
 		reports:           make(chan ChipiReport),
 		err:               make(chan error),
+		events:            make(chan ChipiEvent, CHIPI_EVENTS_BUFFER),
 		closer:            make(chan bool),
-		out0:              make(chan MuxiMsg),
-		out1:              make(chan MuxiMsg),
-		thermistor:        ourThermistor(),
+		stats:             make([]ChipStats, muxi.Chips()),
+		models:            make([]TemperatureModel, muxi.Chips()),
 		resistanceMeter:   ourRMeter(),
 		voltageRatioMeter: ourVRatioMeter(),
 	}
 	chipi.Reports = chipi.reports
 	chipi.Err = chipi.err
-	if chipi.muxi, err = MuxiOpen(); err != nil {
-		return
+	chipi.Events = chipi.events
+	for chip := range chipi.models {
+		if chip < len(models) && models[chip] != nil {
+			chipi.models[chip] = models[chip]
+		} else {
+			chipi.models[chip] = ourThermistor()
+		}
 	}
-	go chipi.doGetReports(0)
-	go chipi.doGetReports(1)
-	go chipi.doGetErrors()
-	go chipi.doSortMessages()
 	return
 }
 
+// Stats returns a snapshot of the statistics of the chips and the link to
+// the MUX.
+func (chipi *Chipi) Stats() ChipiStats {
+	chipi.mutex.Lock()
+	chips := make([]ChipStats, len(chipi.stats))
+	copy(chips, chipi.stats)
+	droppedEvents := chipi.droppedEvents
+	chipi.mutex.Unlock()
+	for chip := range chips {
+		if chipi.cmdi != nil {
+			chips[chip].CmdiStats = chipi.cmdi.Stats(byte(chip))
+		}
+	}
+	return ChipiStats{Muxi: chipi.muxi.Stats(), Chips: chips,
+		DroppedEvents: droppedEvents}
+}
+
+// account updates the statistics of chip.
+func (chipi *Chipi) account(chip byte, f func(s *ChipStats)) {
+	chipi.mutex.Lock()
+	defer chipi.mutex.Unlock()
+	f(&chipi.stats[chip])
+}
+
 func (chipi *Chipi) Close() error {
 	close(chipi.closer)
+	if chipi.cmdi != nil {
+		chipi.cmdi.Close()
+	}
 	chipi.muxi.Close()
 	return nil
 }
 
-func (chipi *Chipi) doGetReports(chip byte) {
-	var out <-chan MuxiMsg
-	switch chip {
-	case 0:
-		out = chipi.out0
-	case 1:
-		out = chipi.out1
-	default:
-		chipi.err <- fmt.Errorf("chipi: chip neither 0 nor 1")
+// do sends cmd to chip and waits for the reply, see Cmdi.Do.
+func (chipi *Chipi) do(chip byte, cmd ChipCommand) (ChipCommand, error) {
+	if chipi.cmdi == nil {
+		return ChipCommand{}, fmt.Errorf("chipi: the chips do not take " +
+			"commands")
+	}
+	return chipi.cmdi.Do(chip, cmd)
+}
+
+// ResetCommands abandons the command in flight to chip and forgets what
+// it sent so far, see Cmdi.Reset.
+func (chipi *Chipi) ResetCommands(chip byte) error {
+	if chipi.cmdi == nil {
+		return fmt.Errorf("chipi: the chips do not take commands")
+	}
+	return chipi.cmdi.Reset(chip)
+}
+
+// askProtocol returns the protocol of the firmware of chip, or 0 if the
+// chip does not tell.
+func (chipi *Chipi) askProtocol(chip byte) int {
+	reply, err := chipi.do(chip, ChipCommand{Op: CMD_VERSION})
+	if err != nil || len(reply.Payload) != 1 {
+		return 0
+	}
+	return int(reply.Payload[0])
+}
+
+// getReport asks chip for its status.  protocol is that of the firmware of
+// chip, or 0 if it did not tell.  raw is whether chip has the firmware of
+// a Raw schema, which does not take commands; getReport updates it as the
+// chip turns out to have it, or not anymore.
+func (chipi *Chipi) getReport(chip byte, protocol int,
+	raw *bool) (report ChipiReport, schema ReportSchema, err error) {
+	rawSchema, hasRaw := chipi.schemas.LatestRaw()
+	if !*raw {
+		var reply ChipCommand
+		reply, err = chipi.do(chip, ChipCommand{Op: CMD_STATUS})
+		if err == nil {
+			var ok bool
+			schema, ok = chipi.schemas.Find(protocol, 8*len(reply.Payload))
+			if !ok {
+				err = fmt.Errorf("chipi: chip %v sent a status of %d "+
+					"bytes", chip, len(reply.Payload))
+				return
+			}
+			report, err = chipi.reportFrom(chip, schema,
+				MuxiBitsBytes(reply.Payload))
+			return
+		}
+		// A chip which never told its protocol might still run firmware
+		// from before the command protocol.
+		if _, ok := err.(ChipTimeoutError); !ok || protocol != 0 ||
+			!hasRaw {
+			return
+		}
+	}
+	bits, rawErr := chipi.cmdi.DoRaw(chip, rawSchema.Bits())
+	if rawErr != nil {
+		if *raw {
+			err = rawErr
+		}
+		// Perhaps the chip was upgraded meanwhile.
+		switch rawErr.(type) {
+		case ChipTimeoutError, ChipHasCommandsError:
+			*raw = false
+		}
 		return
 	}
+	*raw = true
+	report, err = chipi.reportFrom(chip, rawSchema, bits)
+	return report, rawSchema, err
+}
 
-outerLoop:
+func (chipi *Chipi) doGetReports(chip byte) {
+	protocol := 0 // of the firmware of chip, once it told us
+	raw := false  // whether chip runs firmware without commands
+	var edges chipiEdges
 	for {
-		chipi.muxi.In <- MuxiMsg{
-			Chip: chip,
-			Bits: "1",
+		chipi.account(chip, func(s *ChipStats) { s.Requests++ })
+		report, schema, err := chipi.getReport(chip, protocol, &raw)
+		switch err.(type) {
+		case CmdiClosedError:
+			return
+		case CmdiResetError:
+			// Someone wants to start afresh; so do we.
+			continue
 		}
-		response := MuxiMsg{Chip: chip}
-		for response.Length() < 16 {
+		if err != nil {
+			chipi.account(chip, func(s *ChipStats) {
+				switch err.(type) {
+				case ChipTimeoutError:
+					s.Timeouts++
+				case ChipNakError:
+					s.Rejected++
+				default:
+					s.WrongLength++
+				}
+				s.record(true)
+			})
+			if _, ok := err.(ChipTimeoutError); ok {
+				chipi.emit(edges.timeout(chip, err))
+			}
 			select {
-			case msg := <-out:
-				response = MuxiMsgJoin(response, msg)
-			case _ = <-time.After(5 * time.Second):
-				chipi.err <- fmt.Errorf("chipi: chip %v did not respond\n",
-					chip)
-				continue outerLoop
+			case chipi.err <- err:
 			case _ = <-chipi.closer:
 				return
 			}
+			continue
 		}
-		if response.Length() != 16 {
-			chipi.err <- fmt.Errorf("chipi: chip %v send a message of size %v",
-				chip, response.Length)
-			continue outerLoop
+
+		chipi.account(chip, func(s *ChipStats) {
+			s.Reports++
+			s.record(false)
+		})
+		chipi.emit(edges.report(report))
+		select {
+		case chipi.reports <- report:
+		case _ = <-chipi.closer:
+			return
 		}
 
-		chipi.reports <- chipi.reportFrom(response)
+		// Until the chip tells its protocol, we decode its reports by
+		// their length.  If they do not fit the protocol it told, it has
+		// probably been upgraded since.  Chips without commands cannot
+		// tell.
+		if !raw && schema.Protocol != protocol {
+			protocol = chipi.askProtocol(chip)
+		}
 	}
 }
 
-func (chipi *Chipi) doGetErrors() {
+// doGetRawReports asks the chips for their reports laid out as schema by
+// writing a 1, as the firmware of protocol 1 expects.
+func (chipi *Chipi) doGetRawReports(schema ReportSchema) {
+	var (
+		partial  = make([]MuxiBits, len(chipi.stats)) // per chip
+		progress = make([]bool, len(chipi.stats))     // since the last tick
+		edges    = make([]chipiEdges, len(chipi.stats))
+		outbox   []MuxiMsg
+	)
+	request := func(chip byte) {
+		chipi.account(chip, func(s *ChipStats) { s.Requests++ })
+		outbox = append(outbox, MuxiMsg{Chip: chip, Bits: MuxiBitsUint(1, 1)})
+	}
+	for chip := range partial {
+		request(byte(chip))
+	}
+	length := schema.Bits()
+	ticker := time.NewTicker(ourCmdiConfig().Timeout)
+	defer ticker.Stop()
+
 	for {
+		var in chan<- MuxiMsg
+		var next MuxiMsg
+		if len(outbox) > 0 {
+			in, next = chipi.muxi.In, outbox[0]
+		}
+
 		select {
-		case err := <-chipi.muxi.Err:
-			chipi.err <- err
+		case in <- next:
+			outbox = outbox[1:]
+		case msg := <-chipi.muxi.Out:
+			chip := msg.Chip
+			progress[chip] = true
+			bits := partial[chip].Append(msg.Bits)
+			for bits.Len >= length {
+				chipi.account(chip, func(s *ChipStats) {
+					s.Reports++
+					s.record(false)
+				})
+				// The length is right, so decoding cannot fail.
+				report, _ := chipi.reportFrom(chip, schema,
+					bits.Slice(0, length))
+				chipi.emit(edges[chip].report(report))
+				select {
+				case chipi.reports <- report:
+				case _ = <-chipi.closer:
+					return
+				}
+				bits = bits.Slice(length, bits.Len)
+				request(chip)
+			}
+			partial[chip] = bits
+		case _ = <-ticker.C:
+			for chip := range progress {
+				if !progress[chip] {
+					chipi.account(byte(chip), func(s *ChipStats) {
+						s.Timeouts++
+						s.record(true)
+					})
+					chipi.emit(edges[chip].timeout(byte(chip),
+						fmt.Errorf("chipi: chip %v did not report", chip)))
+					partial[chip] = MuxiBits{}
+					request(byte(chip))
+				}
+				progress[chip] = false
+			}
 		case _ = <-chipi.closer:
 			return
 		}
 	}
 }
 
-func (chipi *Chipi) doSortMessages() {
+func (chipi *Chipi) doGetErrors() {
 	for {
 		select {
-		case msg := <-chipi.muxi.Out:
-			switch msg.Chip {
-			case 0:
-				chipi.out0 <- msg
-			case 1:
-				chipi.out1 <- msg
-			default:
-				chipi.err <- fmt.Errorf("chipi: chip neither 0 nor 1")
+		case err := <-chipi.muxi.Err:
+			select {
+			case chipi.err <- err:
+			case _ = <-chipi.closer:
+				return
 			}
 		case _ = <-chipi.closer:
 			return
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestChipiFourChips(t *testing.T) {
+	var ctrls [4]DraadDevice
+	for i := range ctrls {
+		adc := uint(100 * (i + 1))
+		ctrl := NewCtrlEmulator(func() uint { return adc })
+		for j := 0; j < CTRL_ADC_SAMPLES; j++ {
+			ctrl.AdcConversion()
+		}
+		ctrls[i] = ctrl
+	}
+	chipi := testChipi(t, nil, ctrls[:]...)
+	defer chipi.Close()
+
+	var seen [4]bool
+	for n := 0; n < 4; {
+		select {
+		case report := <-chipi.Reports:
+			if report.VoltageNo != 100*(uint(report.Chip)+1) {
+				t.Fatalf("chip %d reported %d", report.Chip,
+					report.VoltageNo)
+			}
+			if !seen[report.Chip] {
+				seen[report.Chip] = true
+				n++
+			}
+		case err := <-chipi.Err:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only received reports from %v", seen)
+		}
+	}
+}
+
+func TestChipiVoltageNo(t *testing.T) {
+	c := &Chipi{
+		models:            []TemperatureModel{ourThermistor()},
+		resistanceMeter:   ourRMeter(),
+		voltageRatioMeter: ourVRatioMeter(),
+	}
+	for _, no := range []uint{CTRL_TEMP_LOWER_BOUND, CTRL_TEMP_TARGET,
+		CTRL_TEMP_UPPER_BOUND} {
+		tempC := c.TempC(0, float64(no))
+		got, resolution, err := c.VoltageNo(0, tempC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != no {
+			t.Errorf("%.2fC is %d instead of %d", tempC, got, no)
+		}
+		if resolution <= 0 || resolution > 2 {
+			t.Errorf("resolution at %d is %.3fC", no, resolution)
+		}
+		// A third of a count away, we are still closest to no.
+		if got, _, _ := c.VoltageNo(0, tempC-resolution/3); got != no {
+			t.Errorf("%.2fC is %d instead of %d", tempC, got, no)
+		}
+	}
+	if no, resolution, _ := c.VoltageNo(0, 1000); no != 1023 ||
+		!math.IsInf(resolution, 1) {
+		t.Errorf("1000C is %d, resolution %v", no, resolution)
+	}
+	if _, _, err := c.VoltageNo(0, math.NaN()); err == nil {
+		t.Error("NaN has a VoltageNo")
+	}
+}
+
+func TestChipiOpenFailureClosesMuxi(t *testing.T) {
+	spi := NewFakeSpi()
+	muxi, err := MuxiOpenTransport(spi, testMuxiConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ChipiOpenMuxi(muxi, make([]TemperatureModel, 3)); err == nil {
+		t.Fatal("opened with models for 3 chips")
+	}
+	for start := time.Now(); !spi.Closed(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the transport was not closed")
+		}
+	}
+}
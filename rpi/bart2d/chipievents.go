@@ -0,0 +1,174 @@
+package main
+
+// Transitions in the state of the chips.
+//
+// Next to every report on Chipi.Reports, the Chipi compares the report
+// with the previous one of the same chip and puts an event on
+// Chipi.Events for every flag that changed.  It also tells when a chip
+// stops responding and when it recovers.
+
+import (
+	"fmt"
+	"time"
+)
+
+// CHIPI_EVENTS_BUFFER is the number of events the Chipi keeps for a slow
+// reader.  Events that do not fit are dropped, rather than holding up the
+// reports: not everyone reads Events.
+const CHIPI_EVENTS_BUFFER = 64
+
+// ChipiEventKind is the kind of transition of a ChipiEvent.
+type ChipiEventKind int
+
+const (
+	CHIPI_EVENT_HEATING_STARTED ChipiEventKind = iota
+	CHIPI_EVENT_HEATING_STOPPED
+	CHIPI_EVENT_OK_LOST
+	CHIPI_EVENT_OK_REGAINED
+	CHIPI_EVENT_TEMP_LOW
+	CHIPI_EVENT_TEMP_LOW_CLEARED
+	CHIPI_EVENT_TEMP_HIGH
+	CHIPI_EVENT_TEMP_HIGH_CLEARED
+	CHIPI_EVENT_BUDDY_DIED
+	CHIPI_EVENT_BUDDY_REVIVED
+	CHIPI_EVENT_STOPPED_RESPONDING
+	CHIPI_EVENT_RECOVERED
+)
+
+func (k ChipiEventKind) String() string {
+	switch k {
+	case CHIPI_EVENT_HEATING_STARTED:
+		return "heating started"
+	case CHIPI_EVENT_HEATING_STOPPED:
+		return "heating stopped"
+	case CHIPI_EVENT_OK_LOST:
+		return "OK lost"
+	case CHIPI_EVENT_OK_REGAINED:
+		return "OK regained"
+	case CHIPI_EVENT_TEMP_LOW:
+		return "TempLow asserted"
+	case CHIPI_EVENT_TEMP_LOW_CLEARED:
+		return "TempLow cleared"
+	case CHIPI_EVENT_TEMP_HIGH:
+		return "TempHigh asserted"
+	case CHIPI_EVENT_TEMP_HIGH_CLEARED:
+		return "TempHigh cleared"
+	case CHIPI_EVENT_BUDDY_DIED:
+		return "BuddyDied asserted"
+	case CHIPI_EVENT_BUDDY_REVIVED:
+		return "BuddyDied cleared"
+	case CHIPI_EVENT_STOPPED_RESPONDING:
+		return "stopped responding"
+	case CHIPI_EVENT_RECOVERED:
+		return "recovered"
+	}
+	return fmt.Sprintf("event %d", int(k))
+}
+
+// ChipiEvent is a transition in the state of a chip.
+type ChipiEvent struct {
+	Kind ChipiEventKind
+	Chip byte
+	Time time.Time // when the transition was noticed
+
+	// Before is the last report before the transition; nil if there is
+	// none.  After is the report which shows the transition; nil if the
+	// chip stopped responding.
+	Before *ChipiReport
+	After  *ChipiReport
+
+	// Err is why we think the chip stopped responding.
+	Err error
+}
+
+func (e ChipiEvent) String() string {
+	ret := fmt.Sprintf("%s chip %d %v", e.Time.Format(TIME_LAYOUT), e.Chip,
+		e.Kind)
+	if e.Err != nil {
+		ret += fmt.Sprintf(": %v", e.Err)
+	}
+	return ret
+}
+
+// chipiFlagEvents are the events on the flags of the reports.
+var chipiFlagEvents = []struct {
+	flag    func(r *ChipiReport) bool
+	set     ChipiEventKind
+	cleared ChipiEventKind
+}{
+	{func(r *ChipiReport) bool { return r.Heating },
+		CHIPI_EVENT_HEATING_STARTED, CHIPI_EVENT_HEATING_STOPPED},
+	{func(r *ChipiReport) bool { return r.OK },
+		CHIPI_EVENT_OK_REGAINED, CHIPI_EVENT_OK_LOST},
+	{func(r *ChipiReport) bool { return r.TempLow },
+		CHIPI_EVENT_TEMP_LOW, CHIPI_EVENT_TEMP_LOW_CLEARED},
+	{func(r *ChipiReport) bool { return r.TempHigh },
+		CHIPI_EVENT_TEMP_HIGH, CHIPI_EVENT_TEMP_HIGH_CLEARED},
+	{func(r *ChipiReport) bool { return r.BuddyDied },
+		CHIPI_EVENT_BUDDY_DIED, CHIPI_EVENT_BUDDY_REVIVED},
+}
+
+// chipiEdges detects the transitions of a single chip.
+type chipiEdges struct {
+	last   *ChipiReport
+	silent bool // whether the chip stopped responding
+}
+
+// report returns the transitions shown by the report r.
+func (e *chipiEdges) report(r ChipiReport) (events []ChipiEvent) {
+	before, after := e.last, &r
+	e.last = after
+	event := func(kind ChipiEventKind) {
+		events = append(events, ChipiEvent{
+			Kind:   kind,
+			Chip:   r.Chip,
+			Time:   r.Time,
+			Before: before,
+			After:  after,
+		})
+	}
+	if e.silent {
+		e.silent = false
+		event(CHIPI_EVENT_RECOVERED)
+	}
+	if before == nil {
+		return
+	}
+	for _, f := range chipiFlagEvents {
+		was, is := f.flag(before), f.flag(after)
+		if !was && is {
+			event(f.set)
+		} else if was && !is {
+			event(f.cleared)
+		}
+	}
+	return
+}
+
+// timeout returns the transitions when chip did not respond in time.
+func (e *chipiEdges) timeout(chip byte, err error) (events []ChipiEvent) {
+	if e.silent {
+		return
+	}
+	e.silent = true
+	return []ChipiEvent{{
+		Kind:   CHIPI_EVENT_STOPPED_RESPONDING,
+		Chip:   chip,
+		Time:   time.Now(),
+		Before: e.last,
+		Err:    err,
+	}}
+}
+
+// emit puts the events on Events, unless the reader is too slow.
+func (chipi *Chipi) emit(events []ChipiEvent) {
+	for _, event := range events {
+		select {
+		case chipi.events <- event:
+		default:
+			chipi.mutex.Lock()
+			chipi.droppedEvents++
+			chipi.mutex.Unlock()
+		}
+	}
+}
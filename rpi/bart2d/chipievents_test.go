@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChipiEdges(t *testing.T) {
+	var e chipiEdges
+	start := time.Now()
+	kinds := func(events []ChipiEvent) (ret []ChipiEventKind) {
+		for _, event := range events {
+			ret = append(ret, event.Kind)
+		}
+		return
+	}
+	report := func(seconds int, r ChipiReport) []ChipiEvent {
+		r.Chip = 1
+		r.Time = start.Add(time.Duration(seconds) * time.Second)
+		return e.report(r)
+	}
+
+	if events := report(0, ChipiReport{OK: true, Heating: true}); len(
+		events) != 0 {
+		t.Fatalf("first report: %v", events)
+	}
+	if events := report(1, ChipiReport{OK: true, Heating: true}); len(
+		events) != 0 {
+		t.Fatalf("nothing changed: %v", events)
+	}
+	events := report(2, ChipiReport{TempHigh: true})
+	if fmt.Sprint(kinds(events)) != fmt.Sprint([]ChipiEventKind{
+		CHIPI_EVENT_HEATING_STOPPED, CHIPI_EVENT_OK_LOST,
+		CHIPI_EVENT_TEMP_HIGH}) {
+		t.Fatalf("events %v", events)
+	}
+	for _, event := range events {
+		if event.Chip != 1 || event.Time != start.Add(2*time.Second) ||
+			!event.Before.Heating || !event.After.TempHigh {
+			t.Fatalf("event %+v", event)
+		}
+	}
+
+	events = e.timeout(1, fmt.Errorf("timeout"))
+	if len(events) != 1 || events[0].Kind != CHIPI_EVENT_STOPPED_RESPONDING ||
+		!events[0].Before.TempHigh || events[0].After != nil ||
+		events[0].Err == nil {
+		t.Fatalf("events %v", events)
+	}
+	if events := e.timeout(1, fmt.Errorf("timeout")); len(events) != 0 {
+		t.Fatalf("stopped responding twice: %v", events)
+	}
+
+	// The chip was reset while it did not respond.
+	events = report(10, ChipiReport{OK: true})
+	if fmt.Sprint(kinds(events)) != fmt.Sprint([]ChipiEventKind{
+		CHIPI_EVENT_RECOVERED, CHIPI_EVENT_OK_REGAINED,
+		CHIPI_EVENT_TEMP_HIGH_CLEARED}) {
+		t.Fatalf("events %v", events)
+	}
+	if !events[0].Before.TempHigh || !events[0].After.OK {
+		t.Fatalf("event %+v", events[0])
+	}
+}
+
+func TestChipiEvents(t *testing.T) {
+	adc := uint32(500)
+	ctrl := NewCtrlEmulator(func() uint {
+		return uint(atomic.LoadUint32(&adc))
+	})
+	convert := func() {
+		for j := 0; j < CTRL_ADC_SAMPLES; j++ {
+			ctrl.AdcConversion()
+		}
+	}
+	convert()
+	chipi := testChipi(t, nil, ctrl)
+	defer chipi.Close()
+
+	// Above the target, the controller stops heating.
+	select {
+	case report := <-chipi.Reports:
+		if !report.Heating {
+			t.Fatalf("report %v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report")
+	}
+	atomic.StoreUint32(&adc, CTRL_TEMP_TARGET+10)
+	convert()
+	for {
+		select {
+		case _ = <-chipi.Reports:
+			continue
+		case err := <-chipi.Err:
+			t.Fatal(err)
+		case event := <-chipi.Events:
+			if event.Kind != CHIPI_EVENT_HEATING_STOPPED ||
+				event.Before.VoltageNo != 500 ||
+				event.After.VoltageNo != CTRL_TEMP_TARGET+10 {
+				t.Fatalf("event %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		break
+	}
+}
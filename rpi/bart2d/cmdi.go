@@ -0,0 +1,501 @@
+package main
+
+// Commands to the chips behind the MUX.
+//
+// The rPi sends a command to a chip and the chip replies.  Both are sent
+// over draad as a header byte followed by up to CMD_MAX_PAYLOAD bytes of
+// payload, every byte least significant bit first.  The header is
+//
+//	bit 0     1, the start bit: a chip ignores 0s until it receives a 1
+//	bit 1-4   opcode; the reply has the opcode of the command
+//	bit 5-6   number of bytes of payload
+//	bit 7     0
+//
+// A chip replies to an opcode it does not know with CMD_NAK, whose payload
+// is the unknown opcode.  See ctrl.c.
+//
+// The MUX sends the body of a frame over draad in reverse, see
+// MuxiMsg.writeTo, so every byte of a command is put in its own frame with
+// its bits reversed.
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// Opcodes
+const (
+	CMD_STATUS  = 0  // reply: 16-bit status word, see ChipiReport
+	CMD_VERSION = 1  // reply: version of the protocol of the chip
+	CMD_NAK     = 15 // reply to an unknown opcode
+
+	CMD_GET_THRESHOLD = 2 // reply: a threshold, see setpoint.go
+	CMD_SET_THRESHOLD = 3 // sets a threshold; reply as CMD_GET_THRESHOLD
+)
+
+// CMD_MAX_PAYLOAD is the maximum number of bytes of payload of a command or
+// reply: together with the header it should fit the 32-bit draad buffers
+// of the MUX and the chips.
+const CMD_MAX_PAYLOAD = 3
+
+// ChipCommand is a command to, or a reply from, a chip.
+type ChipCommand struct {
+	Op      byte
+	Payload []byte
+}
+
+// NewChipCommand returns the command op whose payload is the struct
+// payload laid out with muxi tags, see MarshalMuxiBits.  The layout should
+// be whole bytes.
+func NewChipCommand(op byte, payload interface{}) (c ChipCommand,
+	err error) {
+	bits, err := MarshalMuxiBits(payload)
+	if err != nil {
+		return
+	}
+	if bits.Len%8 != 0 {
+		return c, fmt.Errorf("cmdi: payload of %d bits is not whole bytes",
+			bits.Len)
+	}
+	c = ChipCommand{Op: op, Payload: bits.Bytes()}
+	return c, c.Vet()
+}
+
+// DecodePayload decodes the payload into the struct v points to, see
+// UnmarshalMuxiBits.
+func (c ChipCommand) DecodePayload(v interface{}) error {
+	if len(c.Payload) > CMD_MAX_PAYLOAD {
+		return fmt.Errorf("cmdi: payload of %d bytes is too long",
+			len(c.Payload))
+	}
+	return UnmarshalMuxiBits(MuxiBitsBytes(c.Payload), v)
+}
+
+func (c ChipCommand) String() string {
+	return fmt.Sprintf("op %d %v", c.Op, c.Payload)
+}
+
+func (c *ChipCommand) Vet() error {
+	if c.Op > 15 {
+		return fmt.Errorf("cmdi: opcode should be below 16")
+	}
+	if len(c.Payload) > CMD_MAX_PAYLOAD {
+		return fmt.Errorf("cmdi: payload should be at most %d bytes",
+			CMD_MAX_PAYLOAD)
+	}
+	return nil
+}
+
+// header returns the header byte of the command.
+func (c *ChipCommand) header() byte {
+	return 1 | c.Op<<1 | byte(len(c.Payload))<<5
+}
+
+// frames returns the frames which send the command to chip.
+func (c *ChipCommand) frames(chip byte) []MuxiMsg {
+	ret := make([]MuxiMsg, 0, 1+len(c.Payload))
+	for _, b := range append([]byte{c.header()}, c.Payload...) {
+		ret = append(ret, MuxiMsg{
+			Chip: chip,
+			Bits: MuxiBitsUint(uint64(bits.Reverse8(b)), 8),
+		})
+	}
+	return ret
+}
+
+// ChipTimeoutError is returned if a chip did not reply to a command, even
+// after retrying.
+type ChipTimeoutError struct {
+	Chip     byte
+	Op       byte
+	Attempts int
+}
+
+func (e ChipTimeoutError) Error() string {
+	return fmt.Sprintf("chipi: chip %v did not respond to op %d "+
+		"(%d attempts)", e.Chip, e.Op, e.Attempts)
+}
+
+// ChipNakError is returned if a chip does not know a command.
+type ChipNakError struct {
+	Chip byte
+	Op   byte
+}
+
+func (e ChipNakError) Error() string {
+	return fmt.Sprintf("chipi: chip %v does not know op %d", e.Chip, e.Op)
+}
+
+// ChipHasCommandsError is returned by DoRaw if the chip replied to the
+// probe as to CMD_STATUS: its firmware knows commands.
+type ChipHasCommandsError struct {
+	Chip byte
+}
+
+func (e ChipHasCommandsError) Error() string {
+	return fmt.Sprintf("cmdi: chip %v knows commands", e.Chip)
+}
+
+// CmdiResetError is returned by Do if the command was abandoned by Reset.
+type CmdiResetError struct {
+	Chip byte
+	Op   byte
+}
+
+func (e CmdiResetError) Error() string {
+	return fmt.Sprintf("cmdi: op %d to chip %v was abandoned", e.Op, e.Chip)
+}
+
+// CmdiClosedError is returned by Do if the Cmdi is closed.
+type CmdiClosedError struct{}
+
+func (e CmdiClosedError) Error() string {
+	return "cmdi: closed"
+}
+
+// ourCmdiConfig returns how we send commands to the chips of our Bar T2.
+func ourCmdiConfig() CmdiConfig {
+	return CmdiConfig{
+		Timeout: 2 * time.Second,
+		Retries: 2,
+	}
+}
+
+type CmdiConfig struct {
+	// Timeout is how long we wait for a reply to a single attempt.
+	Timeout time.Duration
+
+	// Retries is the number of times a command is resent if the chip does
+	// not reply in time.  Hence commands should be idempotent.
+	Retries int
+}
+
+// CmdiStats counts the irregularities in the replies of a chip.
+type CmdiStats struct {
+	Retries     uint64 // commands resent
+	Mismatched  uint64 // replies with the wrong opcode
+	Malformed   uint64 // bits discarded looking for a header
+	Unsolicited uint64 // replies without a command in flight
+	Resets      uint64 // see Reset
+}
+
+// Cmdi sends commands to the chips behind a Muxi and matches their
+// replies.  A chip has at most one command in flight; further commands to
+// the same chip wait their turn.
+type Cmdi struct {
+	muxi     *Muxi
+	config   CmdiConfig
+	requests []chan cmdiRequest // per chip
+	frames   []chan MuxiMsg     // from the MUX, per chip
+	resets   []chan bool        // per chip
+	closer   chan bool
+
+	mutex sync.Mutex  // protects stats
+	stats []CmdiStats // per chip
+}
+
+type cmdiRequest struct {
+	cmd    ChipCommand
+	raw    int             // bits of the raw reply, see DoRaw; 0 if cmd
+	result chan cmdiResult // buffered
+}
+
+type cmdiResult struct {
+	reply ChipCommand
+	bits  MuxiBits // the raw reply
+	err   error
+}
+
+// CmdiOpen starts sending commands over muxi.  The Cmdi reads all frames
+// from muxi.Out, but leaves muxi.Err and closing muxi to the caller.
+func CmdiOpen(muxi *Muxi, config CmdiConfig) (cmdi *Cmdi, err error) {
+	if config.Timeout <= 0 {
+		return nil, fmt.Errorf("cmdi: Timeout should be positive")
+	}
+	if config.Retries < 0 {
+		return nil, fmt.Errorf("cmdi: Retries should not be negative")
+	}
+	cmdi = &Cmdi{
+		muxi:     muxi,
+		config:   config,
+		requests: make([]chan cmdiRequest, muxi.Chips()),
+		frames:   make([]chan MuxiMsg, muxi.Chips()),
+		resets:   make([]chan bool, muxi.Chips()),
+		closer:   make(chan bool),
+		stats:    make([]CmdiStats, muxi.Chips()),
+	}
+	for chip := range cmdi.requests {
+		cmdi.requests[chip] = make(chan cmdiRequest)
+		cmdi.frames[chip] = make(chan MuxiMsg)
+		cmdi.resets[chip] = make(chan bool)
+		go cmdi.doChip(byte(chip))
+	}
+	go cmdi.doSortMessages()
+	return
+}
+
+func (c *Cmdi) Close() error {
+	close(c.closer)
+	return nil
+}
+
+// Stats returns a snapshot of the statistics of chip.
+func (c *Cmdi) Stats(chip byte) CmdiStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats[chip]
+}
+
+func (c *Cmdi) account(chip byte, f func(s *CmdiStats)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	f(&c.stats[chip])
+}
+
+// Do sends cmd to chip and waits for the reply.  It is safe to call Do
+// from several goroutines.
+func (c *Cmdi) Do(chip byte, cmd ChipCommand) (reply ChipCommand, err error) {
+	if int(chip) >= len(c.requests) {
+		return reply, fmt.Errorf("cmdi: there is no chip %d", chip)
+	}
+	if err = cmd.Vet(); err != nil {
+		return
+	}
+	res := c.do(chip, cmdiRequest{cmd: cmd})
+	return res.reply, res.err
+}
+
+// DoRaw asks chip for a report of the given number of bits as the
+// firmware of protocol 1 expects: by writing a 1, to which the chip
+// replies with the bare report.  The probe is padded with 0s, which that
+// firmware ignores, to the header of CMD_STATUS, so that firmware with
+// commands does not take the 1 for the start of the next command.  If
+// the chip replies with a status as to CMD_STATUS, DoRaw returns a
+// ChipHasCommandsError.  It is retried as CMD_STATUS.
+func (c *Cmdi) DoRaw(chip byte, bits int) (report MuxiBits, err error) {
+	if int(chip) >= len(c.requests) {
+		return report, fmt.Errorf("cmdi: there is no chip %d", chip)
+	}
+	if bits < 1 || bits > MUXI_BITS_MAX {
+		return report, fmt.Errorf("cmdi: a raw report should have between "+
+			"1 and %d bits", MUXI_BITS_MAX)
+	}
+	res := c.do(chip, cmdiRequest{cmd: ChipCommand{Op: CMD_STATUS},
+		raw: bits})
+	return res.bits, res.err
+}
+
+func (c *Cmdi) do(chip byte, req cmdiRequest) cmdiResult {
+	req.result = make(chan cmdiResult, 1)
+	select {
+	case c.requests[chip] <- req:
+	case _ = <-c.closer:
+		return cmdiResult{err: CmdiClosedError{}}
+	}
+	select {
+	case res := <-req.result:
+		return res
+	case _ = <-c.closer:
+		return cmdiResult{err: CmdiClosedError{}}
+	}
+}
+
+// Reset abandons the command in flight to chip, if any, and forgets the
+// bits received from chip so far.  Do returns a CmdiResetError for the
+// abandoned command.  Use it to start afresh with a chip that stopped
+// responding, for instance as it was reset halfway a reply.
+func (c *Cmdi) Reset(chip byte) error {
+	if int(chip) >= len(c.resets) {
+		return fmt.Errorf("cmdi: there is no chip %d", chip)
+	}
+	select {
+	case c.resets[chip] <- true:
+		return nil
+	case _ = <-c.closer:
+		return CmdiClosedError{}
+	}
+}
+
+func (c *Cmdi) doSortMessages() {
+	for {
+		select {
+		case msg := <-c.muxi.Out:
+			// The Muxi only passes frames of chips that exist.
+			select {
+			case c.frames[msg.Chip] <- msg:
+			case _ = <-c.closer:
+				return
+			}
+		case _ = <-c.closer:
+			return
+		}
+	}
+}
+
+// doChip sends the commands to chip and matches the replies.  It always
+// keeps reading frames, lest a late reply blocks the Muxi.
+func (c *Cmdi) doChip(chip byte) {
+	var (
+		rx       cmdiReceiver
+		pending  *cmdiRequest // the command in flight
+		attempts int
+		outbox   []MuxiMsg        // frames still to send
+		timeout  <-chan time.Time // nil if nothing is in flight
+	)
+	finish := func(res cmdiResult) {
+		pending.result <- res
+		pending, outbox, timeout = nil, nil, nil
+	}
+	send := func() {
+		attempts++
+		if pending.raw > 0 {
+			// Whatever the chip sent before is not part of the report.
+			rx = cmdiReceiver{}
+		}
+		outbox = pending.cmd.frames(chip)
+		timeout = time.After(c.config.Timeout)
+	}
+
+	for {
+		var requests chan cmdiRequest
+		if pending == nil {
+			requests = c.requests[chip]
+		}
+		var in chan<- MuxiMsg
+		var next MuxiMsg
+		if len(outbox) > 0 {
+			in, next = c.muxi.In, outbox[0]
+		}
+
+		select {
+		case req := <-requests:
+			pending, attempts = &req, 0
+			send()
+		case in <- next:
+			outbox = outbox[1:]
+		case msg := <-c.frames[chip]:
+			rx.feed(msg.Bits)
+			if pending != nil && pending.raw > 0 {
+				if rx.bits.Len >= 8 && isStatusHeader(byte(rx.bits.Word)) {
+					// This might be a bare report that happens to look
+					// like a header, but then no more bits follow and
+					// the attempt times out.
+					if _, ok := rx.next(); ok {
+						rx = cmdiReceiver{}
+						finish(cmdiResult{err: ChipHasCommandsError{chip}})
+					}
+					continue
+				}
+				if rx.bits.Len >= pending.raw {
+					bits := rx.bits.Slice(0, pending.raw)
+					rx = cmdiReceiver{}
+					finish(cmdiResult{bits: bits})
+				}
+				continue
+			}
+			for {
+				reply, ok := rx.next()
+				if !ok {
+					break
+				}
+				switch {
+				case pending == nil:
+					c.account(chip, func(s *CmdiStats) { s.Unsolicited++ })
+				case reply.Op == CMD_NAK && len(reply.Payload) == 1 &&
+					reply.Payload[0] == pending.cmd.Op:
+					finish(cmdiResult{err: ChipNakError{chip,
+						pending.cmd.Op}})
+				case reply.Op != pending.cmd.Op:
+					c.account(chip, func(s *CmdiStats) { s.Mismatched++ })
+				default:
+					finish(cmdiResult{reply: reply})
+				}
+			}
+			if n := rx.takeDiscarded(); n > 0 {
+				c.account(chip, func(s *CmdiStats) {
+					s.Malformed += uint64(n)
+				})
+			}
+		case _ = <-c.resets[chip]:
+			if pending != nil {
+				finish(cmdiResult{err: CmdiResetError{chip,
+					pending.cmd.Op}})
+			}
+			rx = cmdiReceiver{}
+			c.account(chip, func(s *CmdiStats) { s.Resets++ })
+		case _ = <-timeout:
+			if attempts > c.config.Retries {
+				finish(cmdiResult{err: ChipTimeoutError{chip,
+					pending.cmd.Op, attempts}})
+				continue
+			}
+			c.account(chip, func(s *CmdiStats) { s.Retries++ })
+			send()
+		case _ = <-c.closer:
+			return
+		}
+	}
+}
+
+// isStatusHeader returns whether header is that of a reply to CMD_STATUS.
+func isStatusHeader(header byte) bool {
+	return header&1 == 1 && header>>1&15 == CMD_STATUS &&
+		header>>5&3 > 0 && header&128 == 0
+}
+
+// cmdiReceiver splits the bits received from a chip into replies.
+type cmdiReceiver struct {
+	bits      MuxiBits
+	discarded int
+}
+
+func (r *cmdiReceiver) feed(b MuxiBits) {
+	if r.bits.Len+b.Len > MUXI_BITS_MAX {
+		// Can only happen if we are fed garbage.
+		r.discarded += r.bits.Len
+		r.bits = MuxiBits{}
+	}
+	r.bits = r.bits.Append(b)
+}
+
+// next returns the next complete reply, if any.
+func (r *cmdiReceiver) next() (reply ChipCommand, ok bool) {
+	for {
+		// Skip to the start bit.
+		for r.bits.Len > 0 && !r.bits.Bool(0) {
+			r.skip(1)
+		}
+		if r.bits.Len < 8 {
+			return
+		}
+		header := byte(r.bits.Word)
+		if header&128 != 0 {
+			r.skip(1)
+			continue
+		}
+		size := 8 * (1 + int(header>>5&3))
+		if r.bits.Len < size {
+			return
+		}
+		reply.Op = header >> 1 & 15
+		reply.Payload = make([]byte, size/8-1)
+		for i := range reply.Payload {
+			reply.Payload[i] = byte(r.bits.UintX(8*(i+1), 8, true))
+		}
+		r.bits = r.bits.Slice(size, r.bits.Len)
+		return reply, true
+	}
+}
+
+func (r *cmdiReceiver) skip(n int) {
+	r.bits = r.bits.Slice(n, r.bits.Len)
+	r.discarded += n
+}
+
+// takeDiscarded returns the number of bits skipped since the last call.
+func (r *cmdiReceiver) takeDiscarded() (n int) {
+	n, r.discarded = r.discarded, 0
+	return
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deafDraadDevice ignores the first Deaf bits written to Device.
+type deafDraadDevice struct {
+	Device DraadDevice
+	Deaf   int
+
+	mutex sync.Mutex
+}
+
+func (d *deafDraadDevice) DraadWrite(bit bool) {
+	d.mutex.Lock()
+	deaf := d.Deaf > 0
+	if deaf {
+		d.Deaf--
+	}
+	d.mutex.Unlock()
+	if !deaf {
+		d.Device.DraadWrite(bit)
+	}
+}
+
+func (d *deafDraadDevice) DraadRead() (bit, ok bool) {
+	return d.Device.DraadRead()
+}
+
+func testCmdi(t *testing.T, devices ...DraadDevice) (*Cmdi, *Muxi) {
+	config := testMuxiConfig()
+	config.Chips = len(devices)
+	config.PollInterval = time.Millisecond
+	muxi, err := MuxiOpenTransport(NewMuxEmulator(devices...), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdi, err := CmdiOpen(muxi, CmdiConfig{
+		Timeout: 200 * time.Millisecond,
+		Retries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmdi, muxi
+}
+
+// testChipiMuxi opens a Muxi to a MuxEmulator with devices on its draads,
+// which polls often enough for a Chipi to get its reports quickly.
+func testChipiMuxi(t *testing.T, devices ...DraadDevice) *Muxi {
+	config := testMuxiConfig()
+	config.Chips = len(devices)
+	config.PollBytes = 12
+	config.PollInterval = time.Millisecond
+	muxi, err := MuxiOpenTransport(NewMuxEmulator(devices...), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return muxi
+}
+
+// testChipi opens a Chipi to devices, see testChipiMuxi, whose thermistors
+// are models.
+func testChipi(t *testing.T, models []TemperatureModel,
+	devices ...DraadDevice) *Chipi {
+	chipi, err := ChipiOpenMuxi(testChipiMuxi(t, devices...), models)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chipi
+}
+
+func TestCmdi(t *testing.T) {
+	ctrl := NewCtrlEmulator(func() uint { return 500 })
+	for i := 0; i < CTRL_ADC_SAMPLES; i++ {
+		ctrl.AdcConversion()
+	}
+	deaf := &deafDraadDevice{Device: NewCtrlEmulator(nil), Deaf: 8}
+	cmdi, muxi := testCmdi(t, ctrl, deaf, nil)
+	defer muxi.Close()
+	defer cmdi.Close()
+
+	reply, err := cmdi.Do(0, ChipCommand{Op: CMD_STATUS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := ctrl.Status()
+	if expected := []byte{byte(status), byte(status >> 8)}; reply.Op !=
+		CMD_STATUS || !reflect.DeepEqual(reply.Payload, expected) {
+		t.Fatalf("status is %v instead of %v", reply, expected)
+	}
+
+	reply, err = cmdi.Do(0, ChipCommand{Op: CMD_VERSION})
+	if err != nil || !reflect.DeepEqual(reply.Payload,
+		[]byte{CTRL_PROTOCOL_VERSION}) {
+		t.Fatalf("version is %v, %v", reply, err)
+	}
+
+	_, err = cmdi.Do(0, ChipCommand{Op: 7, Payload: []byte{1, 2, 3}})
+	if err != (ChipNakError{Chip: 0, Op: 7}) {
+		t.Fatalf("unknown opcode gave %v", err)
+	}
+
+	// The deaf chip misses the first command, but gets the retry.
+	reply, err = cmdi.Do(1, ChipCommand{Op: CMD_VERSION})
+	if err != nil || reply.Op != CMD_VERSION {
+		t.Fatalf("version is %v, %v", reply, err)
+	}
+	if stats := cmdi.Stats(1); stats.Retries != 1 {
+		t.Fatalf("stats of chip 1: %+v", stats)
+	}
+
+	_, err = cmdi.Do(2, ChipCommand{Op: CMD_STATUS})
+	if err != (ChipTimeoutError{Chip: 2, Op: CMD_STATUS, Attempts: 2}) {
+		t.Fatalf("absent chip gave %v", err)
+	}
+
+	if _, err := cmdi.Do(0, ChipCommand{Op: 16}); err == nil {
+		t.Fatal("invalid opcode was sent")
+	}
+}
+
+func TestCmdiConcurrent(t *testing.T) {
+	var ctrls [2]DraadDevice
+	for i := range ctrls {
+		ctrls[i] = NewCtrlEmulator(nil)
+	}
+	cmdi, muxi := testCmdi(t, ctrls[:]...)
+	defer muxi.Close()
+	defer cmdi.Close()
+
+	errs := make(chan error)
+	for i := 0; i < 6; i++ {
+		go func(chip byte) {
+			reply, err := cmdi.Do(chip, ChipCommand{Op: CMD_VERSION})
+			if err == nil && reply.Op != CMD_VERSION {
+				err = fmt.Errorf("reply %v", reply)
+			}
+			errs <- err
+		}(byte(i % 2))
+	}
+	for i := 0; i < 6; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCmdiReset(t *testing.T) {
+	cmdi, muxi := testCmdi(t, NewCtrlEmulator(nil), nil)
+	defer muxi.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cmdi.Do(1, ChipCommand{Op: CMD_STATUS})
+		errs <- err
+	}()
+	// Until the command is in flight, there is nothing to abandon.
+	for done := false; !done; {
+		if err := cmdi.Reset(1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errs:
+			if err != (CmdiResetError{Chip: 1, Op: CMD_STATUS}) {
+				t.Fatalf("abandoned command gave %v", err)
+			}
+			done = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if stats := cmdi.Stats(1); stats.Resets == 0 || stats.Retries != 0 {
+		t.Fatalf("stats of chip 1: %+v", stats)
+	}
+
+	if _, err := cmdi.Do(0, ChipCommand{Op: CMD_VERSION}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdi.Reset(2); err == nil {
+		t.Fatal("reset a chip that does not exist")
+	}
+	cmdi.Close()
+	if err := cmdi.Reset(0); err != (CmdiClosedError{}) {
+		t.Fatalf("reset after close gave %v", err)
+	}
+}
+
+func TestCmdiDoRaw(t *testing.T) {
+	cmdi, muxi := testCmdi(t, &rawCtrl{status: 0xbeef}, NewCtrlEmulator(nil))
+	defer muxi.Close()
+	defer cmdi.Close()
+
+	for i := 0; i < 2; i++ {
+		bits, err := cmdi.DoRaw(0, 16)
+		if err != nil || bits != MuxiBitsUint(0xbeef, 16) {
+			t.Fatalf("raw report %v, %v", bits, err)
+		}
+	}
+	// A chip with commands takes the probe for CMD_STATUS, and
+	// understands the next command.
+	if _, err := cmdi.DoRaw(1, 16); err != (ChipHasCommandsError{1}) {
+		t.Fatalf("chip 1 gave %v", err)
+	}
+	reply, err := cmdi.Do(1, ChipCommand{Op: CMD_VERSION})
+	if err != nil || !reflect.DeepEqual(reply.Payload,
+		[]byte{CTRL_PROTOCOL_VERSION}) {
+		t.Fatalf("version %v, %v", reply, err)
+	}
+	if _, err := cmdi.DoRaw(0, 65); err == nil {
+		t.Fatal("asked for a raw report of 65 bits")
+	}
+}
+
+func TestCmdiReceiver(t *testing.T) {
+	var r cmdiReceiver
+	// Leading zeroes and a version reply split over two frames.
+	r.feed(MustParseMuxiBits("000110001"))
+	if _, ok := r.next(); ok {
+		t.Fatal("reply from half a header")
+	}
+	r.feed(MustParseMuxiBits("00010000000101"))
+	reply, ok := r.next()
+	if !ok || reply.Op != CMD_VERSION ||
+		!reflect.DeepEqual(reply.Payload, []byte{2}) {
+		t.Fatalf("got %v, %v", reply, ok)
+	}
+	if n := r.takeDiscarded(); n != 3 {
+		t.Fatalf("discarded %d bits instead of 3", n)
+	}
+	if _, ok := r.next(); ok || r.bits.Len != 3 {
+		t.Fatalf("left %v", r.bits)
+	}
+}
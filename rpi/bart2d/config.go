@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// ourConfig returns the configuration of our Bar T2.
+func ourConfig() Config {
+	return Config{
+		Chips:       2,
+		Consistency: ourConsistencyConfig(),
+		Supervisor:  ourSupervisorConfig(),
+	}
+}
+
+// Config is the configuration of bart2d.  It is read from config.json in
+// the data directory; fields missing from the file are taken from
+// ourConfig.
+type Config struct {
+	// Chips is the number of chips behind the MUX, which are numbered from
+	// 0.  The MUX supports up to MUXI_MAX_CHIPS.
+	Chips int
+
+	// Thermistors holds the thermistor of each chip, for instance
+	//
+	//	"Thermistors": [{}, {"Beta": {"Beta": 4220, "R0": 10000, "T0C": 25}}]
+	//
+	// Chips without an entry have ourThermistor.
+	Thermistors []ThermistorConfig
+
+	// Consistency is how much the two chips which measure the boiler may
+	// disagree, see ConsistencyMonitor.  It is ignored if there is only
+	// one chip.
+	Consistency ConsistencyConfig
+
+	// Supervisor is how the daemon recovers chips which stopped
+	// responding, see Supervisor.  Set "ResetMux" to allow it to reset
+	// the MUX and the controllers.
+	Supervisor SupervisorConfig
+}
+
+// Models returns the TemperatureModel of the thermistor of each chip.
+func (c *Config) Models() []TemperatureModel {
+	models := make([]TemperatureModel, c.Chips)
+	for chip := range models {
+		if chip < len(c.Thermistors) {
+			models[chip] = c.Thermistors[chip].Model()
+		} else {
+			models[chip] = ourThermistor()
+		}
+	}
+	return models
+}
+
+// Vet checks whether the configuration makes sense.
+func (c *Config) Vet() error {
+	if c.Chips < 1 || c.Chips > MUXI_MAX_CHIPS {
+		return fmt.Errorf("config: Chips should be between 1 and %d",
+			MUXI_MAX_CHIPS)
+	}
+	if len(c.Thermistors) > c.Chips {
+		return fmt.Errorf("config: there are more Thermistors than Chips")
+	}
+	for chip, t := range c.Thermistors {
+		if err := t.Vet(); err != nil {
+			return fmt.Errorf("config: chip %d: %v", chip, err)
+		}
+	}
+	if c.Chips >= 2 {
+		if err := c.Consistency.Vet(c.Chips); err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+	}
+	if err := c.Supervisor.Vet(); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	return nil
+}
+
+// ConfigOpen reads the configuration from the data directory.  If there is
+// no config.json, it returns ourConfig.
+func ConfigOpen(dir Dir) (config Config, err error) {
+	config = ourConfig()
+	data, err := ioutil.ReadFile(dir.Config())
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return config, WrapErr(err, "Could not parse %s",
+			path.Base(dir.Config()))
+	}
+	err = config.Vet()
+	return
+}
+
+// ConfigWrite writes the configuration to the data directory.
+func ConfigWrite(dir Dir, config Config) error {
+	if err := config.Vet(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dir.Config(), append(data, '\n'),
+		DIR_DEFAULT_FILEMODE)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestConfigOpen(t *testing.T) {
+	pth, err := ioutil.TempDir("", "bart2d-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pth)
+	dir, err := DirOpenAt(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ConfigOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, ourConfig()) {
+		t.Fatalf("without config.json got %+v", config)
+	}
+
+	for data, chips := range map[string]int{
+		`{}`:             2,
+		`{"Chips": 3}`:   3,
+		`{"Chips": 5}`:   0,
+		`{"Chips": 0}`:   0,
+		`{"Chips": "x"}`: 0,
+	} {
+		if err := ioutil.WriteFile(dir.Config(), []byte(data),
+			DIR_DEFAULT_FILEMODE); err != nil {
+			t.Fatal(err)
+		}
+		config, err := ConfigOpen(dir)
+		if chips == 0 {
+			if err == nil {
+				t.Errorf("%s: no error", data)
+			}
+			continue
+		}
+		if err != nil || config.Chips != chips {
+			t.Errorf("%s: got %+v, %v", data, config, err)
+		}
+	}
+}
+
+func TestConfigThermistors(t *testing.T) {
+	pth, err := ioutil.TempDir("", "bart2d-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pth)
+	dir, err := DirOpenAt(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for data, ok := range map[string]bool{
+		`{"Thermistors": [{}, {"Beta": {"Beta": 4220, "R0": 10000, ` +
+			`"T0C": 25}}]}`: true,
+		`{"Thermistors": [{"Table": {"Points": [{"R": 100, "TempC": 150}, ` +
+			`{"R": 1000, "TempC": 100}]}}]}`: true,
+		`{"Thermistors": [{}, {}, {}]}`:                false,
+		`{"Thermistors": [{"Beta": {"Beta": 4220}}]}`:  false,
+		`{"Thermistors": [{"Table": {"Points": []}}]}`: false,
+		`{"Thermistors": [{"Beta": {"Beta": 4220, "R0": 10000}, ` +
+			`"SteinhartHart": {"A": 1e-3}}]}`: false,
+	} {
+		if err := ioutil.WriteFile(dir.Config(), []byte(data),
+			DIR_DEFAULT_FILEMODE); err != nil {
+			t.Fatal(err)
+		}
+		config, err := ConfigOpen(dir)
+		if (err == nil) != ok {
+			t.Errorf("%s: unexpected result %v", data, err)
+		}
+		if !ok {
+			continue
+		}
+		models := config.Models()
+		if len(models) != 2 {
+			t.Fatalf("%s: got %d models", data, len(models))
+		}
+	}
+
+	// A Beta thermistor on chip 1 only.
+	config := ourConfig()
+	config.Thermistors = []ThermistorConfig{{}, {
+		Beta: &BetaThermistor{Beta: 4220, R0: 10000, T0C: 25}}}
+	models := config.Models()
+	if models[0] != TemperatureModel(ourThermistor()) {
+		t.Errorf("chip 0 has %v", models[0])
+	}
+	if got := models[1].TempC(10000); math.Abs(got-25) > 1e-9 {
+		t.Errorf("chip 1: 10k is %.3fC", got)
+	}
+}
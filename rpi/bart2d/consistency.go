@@ -0,0 +1,221 @@
+package main
+
+// Checking the two controllers against each other.
+//
+// The controllers measure the temperature of the same boiler, each with its
+// own thermistor, so they should agree.  If they do not for a while, one of
+// them is probably broken, for instance its thermistor came loose.  The
+// firmware does not notice, as each controller only knows its own
+// measurement.
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// ourConsistencyConfig returns how much the controllers of our Bar T2 may
+// disagree.
+func ourConsistencyConfig() ConsistencyConfig {
+	return ConsistencyConfig{
+		Chips:      [2]byte{0, 1},
+		Tolerance:  3,
+		Sustain:    60,
+		PairWindow: 5,
+	}
+}
+
+type ConsistencyConfig struct {
+	// Chips are the two chips which measure the same boiler.
+	Chips [2]byte
+
+	// Tolerance is how much (in Celsius) the temperatures may differ.
+	Tolerance float64
+
+	// Sustain is how long (in seconds) the chips should disagree before
+	// we raise an alert.  Near the target they may disagree on whether to
+	// heat for a little while.
+	Sustain float64
+
+	// PairWindow is how far apart (in seconds) two reports may be to be
+	// compared.
+	PairWindow float64
+}
+
+func (c *ConsistencyConfig) Vet(chips int) error {
+	if int(c.Chips[0]) >= chips || int(c.Chips[1]) >= chips ||
+		c.Chips[0] == c.Chips[1] {
+		return fmt.Errorf("consistency: Chips should be two different " +
+			"chips")
+	}
+	if !(c.Tolerance > 0) {
+		return fmt.Errorf("consistency: Tolerance should be positive")
+	}
+	if c.Sustain < 0 {
+		return fmt.Errorf("consistency: Sustain should not be negative")
+	}
+	if !(c.PairWindow > 0) {
+		return fmt.Errorf("consistency: PairWindow should be positive")
+	}
+	return nil
+}
+
+// ConsistencyCheck is something on which the chips should agree.
+type ConsistencyCheck int
+
+const (
+	CONSISTENCY_TEMPERATURE ConsistencyCheck = iota // within Tolerance
+	CONSISTENCY_HEATING                             // both heat, or neither
+)
+
+func (c ConsistencyCheck) String() string {
+	switch c {
+	case CONSISTENCY_TEMPERATURE:
+		return "temperature"
+	case CONSISTENCY_HEATING:
+		return "heating"
+	}
+	return fmt.Sprintf("check %d", int(c))
+}
+
+// ConsistencyAlert is raised when the chips disagree for longer than
+// Sustain, and raised again, Cleared, when they agree again.
+type ConsistencyAlert struct {
+	Check   ConsistencyCheck
+	Chips   [2]byte
+	Since   time.Time // when the chips started to disagree
+	Time    time.Time // of the report which raised or cleared the alert
+	Cleared bool
+
+	// The last reports of the chips.
+	TempC   [2]float64
+	Heating [2]bool
+
+	// Worst is the largest difference in temperature (in Celsius) since
+	// the chips started to disagree.
+	Worst float64
+}
+
+func (a ConsistencyAlert) String() string {
+	var what string
+	switch a.Check {
+	case CONSISTENCY_TEMPERATURE:
+		what = fmt.Sprintf("%.1fC and %.1fC; worst difference %.1fC",
+			a.TempC[0], a.TempC[1], a.Worst)
+	default:
+		what = fmt.Sprintf("heating %v and %v", a.Heating[0], a.Heating[1])
+	}
+	verb := "disagree on"
+	if a.Cleared {
+		verb = "agree again on"
+	}
+	return fmt.Sprintf("chips %d and %d %s %s after %v: %s", a.Chips[0],
+		a.Chips[1], verb, a.Check, a.Time.Sub(a.Since).Truncate(time.Second),
+		what)
+}
+
+// ConsistencyStats summarizes the comparisons of the chips.
+type ConsistencyStats struct {
+	Pairs    uint64  // of reports compared
+	Diff     float64 // difference in temperature of the last pair
+	MaxDiff  float64
+	Disagree uint64 // pairs disagreeing on heating
+	Alerts   uint64 // raised, not counting clearances
+}
+
+func (s ConsistencyStats) String() string {
+	return fmt.Sprintf("%d pairs; difference %.2fC, at most %.2fC; "+
+		"%d disagree on heating; %d alerts", s.Pairs, s.Diff, s.MaxDiff,
+		s.Disagree, s.Alerts)
+}
+
+// ConsistencyMonitor compares the reports of two chips.
+type ConsistencyMonitor struct {
+	config ConsistencyConfig
+	last   [2]*ChipiReport
+	checks [2]consistencyEpisode // per ConsistencyCheck
+	stats  ConsistencyStats
+}
+
+// consistencyEpisode tracks a period in which the chips disagree.
+type consistencyEpisode struct {
+	since   time.Time // zero if the chips agree
+	worst   float64
+	alerted bool
+}
+
+func NewConsistencyMonitor(config ConsistencyConfig) *ConsistencyMonitor {
+	return &ConsistencyMonitor{config: config}
+}
+
+// Stats returns the statistics of the comparisons so far.
+func (m *ConsistencyMonitor) Stats() ConsistencyStats {
+	return m.stats
+}
+
+// Add compares the report with the last report of the other chip, if that
+// is recent enough.  It returns the alerts raised and cleared.
+func (m *ConsistencyMonitor) Add(r ChipiReport) (alerts []ConsistencyAlert) {
+	var side int
+	switch r.Chip {
+	case m.config.Chips[0]:
+		side = 0
+	case m.config.Chips[1]:
+		side = 1
+	default:
+		return
+	}
+	m.last[side] = &r
+	other := m.last[1-side]
+	if other == nil {
+		return
+	}
+	window := time.Duration(m.config.PairWindow * float64(time.Second))
+	if gap := r.Time.Sub(other.Time); gap > window || -gap > window {
+		return
+	}
+
+	a, b := m.last[0], m.last[1]
+	diff := math.Abs(a.TempC - b.TempC)
+	m.stats.Pairs++
+	m.stats.Diff = diff
+	m.stats.MaxDiff = math.Max(m.stats.MaxDiff, diff)
+	// A controller in error mode does not heat, whatever it measures.
+	disagree := a.OK && b.OK && a.Heating != b.Heating
+	if disagree {
+		m.stats.Disagree++
+	}
+
+	for check, bad := range []bool{diff > m.config.Tolerance, disagree} {
+		e := &m.checks[check]
+		alert := ConsistencyAlert{
+			Check:   ConsistencyCheck(check),
+			Chips:   m.config.Chips,
+			Since:   e.since,
+			Time:    r.Time,
+			TempC:   [2]float64{a.TempC, b.TempC},
+			Heating: [2]bool{a.Heating, b.Heating},
+			Worst:   e.worst,
+		}
+		if !bad {
+			if e.alerted {
+				alert.Cleared = true
+				alerts = append(alerts, alert)
+			}
+			*e = consistencyEpisode{}
+			continue
+		}
+		if e.since.IsZero() {
+			e.since = r.Time
+		}
+		e.worst = math.Max(e.worst, diff)
+		sustain := time.Duration(m.config.Sustain * float64(time.Second))
+		if !e.alerted && r.Time.Sub(e.since) >= sustain {
+			e.alerted = true
+			m.stats.Alerts++
+			alert.Since, alert.Worst = e.since, e.worst
+			alerts = append(alerts, alert)
+		}
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsistencyMonitor(t *testing.T) {
+	m := NewConsistencyMonitor(ourConsistencyConfig())
+	start := time.Date(2020, 1, 1, 8, 0, 0, 0, time.UTC)
+	report := func(chip byte, seconds int, tempC float64,
+		heating bool) []ConsistencyAlert {
+		return m.Add(ChipiReport{
+			Time:    start.Add(time.Duration(seconds) * time.Second),
+			Chip:    chip,
+			TempC:   tempC,
+			Heating: heating,
+			OK:      true,
+		})
+	}
+
+	// The chips agree; an unpaired report is not compared.
+	for s := 0; s < 100; s += 2 {
+		if alerts := report(0, s, 90, true); len(alerts) != 0 {
+			t.Fatalf("%ds: %v", s, alerts)
+		}
+		if alerts := report(1, s+1, 91, true); len(alerts) != 0 {
+			t.Fatalf("%ds: %v", s, alerts)
+		}
+	}
+	if alerts := report(0, 200, 150, false); len(alerts) != 0 {
+		t.Fatalf("compared reports 99s apart: %v", alerts)
+	}
+	if stats := m.Stats(); stats.Pairs != 99 || stats.MaxDiff != 1 {
+		t.Fatalf("stats %v", stats)
+	}
+
+	// The thermistor of chip 1 came loose: it measures too cold and keeps
+	// heating.  Only after Sustain do we raise an alert.
+	var alerts []ConsistencyAlert
+	for s := 202; s < 300; s += 2 {
+		report(0, s, 120, false)
+		alerts = append(alerts, report(1, s+1, 20+float64(s-202)/10, true)...)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("alerts %v", alerts)
+	}
+	for _, alert := range alerts {
+		if alert.Cleared || alert.Chips != [2]byte{0, 1} ||
+			alert.Time.Sub(alert.Since) != 60*time.Second {
+			t.Fatalf("alert %v", alert)
+		}
+	}
+	if alert := alerts[0]; alert.Check != CONSISTENCY_TEMPERATURE ||
+		alert.Worst != 100 || alert.TempC != [2]float64{120, 26} {
+		t.Fatalf("alert %v", alert)
+	}
+	if alert := alerts[1]; alert.Check != CONSISTENCY_HEATING ||
+		alert.Heating != [2]bool{false, true} {
+		t.Fatalf("alert %v", alert)
+	}
+
+	// Chip 0 goes into error mode, so the heating flags agree again.
+	alerts = m.Add(ChipiReport{Time: start.Add(300 * time.Second), Chip: 0,
+		TempC: 120})
+	if len(alerts) != 1 || alerts[0].Check != CONSISTENCY_HEATING ||
+		!alerts[0].Cleared {
+		t.Fatalf("alerts %v", alerts)
+	}
+	alerts = report(1, 301, 120, false)
+	if len(alerts) != 1 || alerts[0].Check != CONSISTENCY_TEMPERATURE ||
+		!alerts[0].Cleared || alerts[0].Worst != 100 {
+		t.Fatalf("alerts %v", alerts)
+	}
+	if stats := m.Stats(); stats.Alerts != 2 {
+		t.Fatalf("stats %v", stats)
+	}
+}
+
+func TestConsistencyConfigVet(t *testing.T) {
+	for _, c := range []ConsistencyConfig{
+		{Chips: [2]byte{0, 0}, Tolerance: 1, PairWindow: 1},
+		{Chips: [2]byte{0, 2}, Tolerance: 1, PairWindow: 1},
+		{Chips: [2]byte{0, 1}, Tolerance: 0, PairWindow: 1},
+		{Chips: [2]byte{0, 1}, Tolerance: 1, PairWindow: 0},
+		{Chips: [2]byte{0, 1}, Tolerance: 1, PairWindow: 1, Sustain: -1},
+	} {
+		if err := c.Vet(2); err == nil {
+			t.Errorf("%+v passed", c)
+		}
+	}
+	c := ourConsistencyConfig()
+	if err := c.Vet(2); err != nil {
+		t.Fatal(err)
+	}
+}
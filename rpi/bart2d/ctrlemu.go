@@ -0,0 +1,295 @@
+package main
+
+// Emulator of the firmware of the two controllers, see avr/attiny13/ctrl.c.
+//
+// Unlike the MuxEmulator, this emulator does not model the timing of
+// draad: the MUX calls DraadWrite and DraadRead once per bit.  The interrupt
+// handlers of ctrl.c are methods which are called by whoever drives the
+// emulator, see Simulation.
+
+import (
+	"sync"
+)
+
+// Constants from ctrl.c
+const (
+	// Default thresholds
+	CTRL_TEMP_TARGET      = 790 // Heat if temp is below this
+	CTRL_TEMP_LOWER_BOUND = 26  // go into error mode if temp is below this
+	CTRL_TEMP_UPPER_BOUND = 980 // go into error mode if temp is above this
+
+	CTRL_ADC_SAMPLES = 32 // number of ADC conversions averaged
+
+	CTRL_PROTOCOL_VERSION = 2 // PROTOCOL in the Makefile
+)
+
+// Rates at which the interrupt handlers of ctrl.c fire.
+const (
+	CTRL_F_CPU    = 9400000
+	CTRL_ADC_HZ   = CTRL_F_CPU / 64 / 13    // prescale 64; 13 cycles/conversion
+	CTRL_TIMER_HZ = CTRL_F_CPU / 1024 / 256 // prescale 1024; 8-bit timer
+)
+
+// CtrlEmulator models a single controller.  It implements DraadDevice.
+// The EEPROM is not modelled: a new CtrlEmulator starts with the default
+// thresholds.
+type CtrlEmulator struct {
+	// Adc returns the result (0 to 1023) of the next ADC conversion.
+	Adc func() uint
+
+	mutex sync.Mutex
+	buddy *CtrlEmulator
+
+	// Whether the controller is running.  A halted controller does not
+	// convert, keep time or reply.
+	halted bool
+
+	// Global variables of ctrl.c
+	adcAccum       uint
+	adcCnt         byte
+	watchInChanged bool
+	temperature    uint
+	heating        bool
+	ok             bool
+	tempWayTooLow  bool
+	tempWayTooHigh bool
+	buddyDied      bool // other_uC_not_responding
+	thresholds     [3]uint
+
+	// Local variables of main() in ctrl.c
+	draadTxBuffer     uint32
+	draadTxBufferSize byte
+	draadRxBuffer     uint32
+	draadRxBufferSize byte
+
+	// Output pins
+	pinGo bool
+}
+
+// NewCtrlEmulator returns a controller that has just been powered on.
+func NewCtrlEmulator(adc func() uint) *CtrlEmulator {
+	return &CtrlEmulator{
+		Adc: adc,
+		ok:  true,
+		thresholds: [3]uint{
+			THRESHOLD_LOWER_BOUND: CTRL_TEMP_LOWER_BOUND,
+			THRESHOLD_TARGET:      CTRL_TEMP_TARGET,
+			THRESHOLD_UPPER_BOUND: CTRL_TEMP_UPPER_BOUND,
+		},
+	}
+}
+
+// CtrlPair connects the watch pins of the two controllers to each other.
+func CtrlPair(a, b *CtrlEmulator) {
+	a.mutex.Lock()
+	a.buddy = b
+	a.mutex.Unlock()
+	b.mutex.Lock()
+	b.buddy = a
+	b.mutex.Unlock()
+
+	// main() toggles WATCH_OUT once before it enters its loop.
+	a.watchInChange()
+	b.watchInChange()
+}
+
+// Halt stops the controller, as if it crashed or lost power.
+func (c *CtrlEmulator) Halt() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.halted = true
+	c.pinGo = false
+}
+
+// Go returns the value of the GO pin, which enables the heater.
+func (c *CtrlEmulator) Go() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pinGo
+}
+
+// Status returns the 16-bit status word as the controller sends it.
+func (c *CtrlEmulator) Status() uint16 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.status()
+}
+
+func (c *CtrlEmulator) status() uint16 {
+	bits, err := MarshalMuxiBits(ctrlStatus{
+		VoltageNo: c.temperature & 1023,
+		Heating:   c.heating,
+		OK:        c.ok,
+		TempLow:   c.tempWayTooLow,
+		TempHigh:  c.tempWayTooHigh,
+		BuddyDied: c.buddyDied,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return uint16(bits.Word)
+}
+
+// AdcConversion is ISR(ADC_vect): called when an ADC conversion is ready.
+func (c *CtrlEmulator) AdcConversion() {
+	c.mutex.Lock()
+	if c.halted {
+		c.mutex.Unlock()
+		return
+	}
+	c.adcAccum += c.Adc() & 1023
+	c.adcCnt++
+
+	if c.adcCnt != CTRL_ADC_SAMPLES {
+		c.mutex.Unlock()
+		return
+	}
+	temp := c.adcAccum >> 5
+	c.temperature = temp
+	c.adcAccum = 0
+	c.adcCnt = 0
+
+	if temp <= c.thresholds[THRESHOLD_LOWER_BOUND] {
+		c.ok = false
+		c.tempWayTooLow = true
+		c.heating = false
+		c.pinGo = false
+	} else if temp >= c.thresholds[THRESHOLD_UPPER_BOUND] {
+		c.ok = false
+		c.heating = false
+		c.tempWayTooHigh = true
+		c.pinGo = false
+	} else if !c.ok {
+	} else if temp < c.thresholds[THRESHOLD_TARGET] {
+		c.pinGo = true
+		c.heating = true
+	} else {
+		c.pinGo = false
+		c.heating = false
+	}
+	buddy := c.buddy
+	c.mutex.Unlock()
+
+	// We toggled WATCH_OUT.  Lock the buddy only after releasing our own
+	// lock, lest two buddies deadlock on each other.
+	if buddy != nil {
+		buddy.watchInChange()
+	}
+}
+
+// watchInChange is ISR(PCINT0_vect): called when WATCH_IN changes value.
+func (c *CtrlEmulator) watchInChange() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.watchInChanged = true
+}
+
+// TimerOverflow is ISR(TIM0_OVF_vect): called when the watch timer
+// overflows.
+func (c *CtrlEmulator) TimerOverflow() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.halted {
+		return
+	}
+	if !c.watchInChanged {
+		// Other uC did not respond in time
+		c.ok = false
+		c.heating = false
+		c.buddyDied = true
+		c.pinGo = false
+		return
+	}
+	c.watchInChanged = false
+}
+
+func (c *CtrlEmulator) DraadWrite(bit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.halted {
+		return
+	}
+
+	// Wait for the start bit of a command.
+	if c.draadRxBufferSize == 0 && !bit {
+		return
+	}
+	if bit {
+		c.draadRxBuffer |= 1 << c.draadRxBufferSize
+	}
+	c.draadRxBufferSize++
+	if c.draadRxBufferSize < 8 {
+		return
+	}
+	header := byte(c.draadRxBuffer)
+	if header&128 == 0 && c.draadRxBufferSize < 8+8*(header>>5&3) {
+		return
+	}
+
+	// We received a whole command, or garbage.  Reply, unless we are still
+	// sending the previous reply.
+	payload := c.draadRxBuffer >> 8
+	which := Threshold(payload & 255)
+	c.draadRxBuffer = 0
+	c.draadRxBufferSize = 0
+	if header&128 != 0 || c.draadTxBufferSize > 0 {
+		return
+	}
+	switch op := header >> 1 & 15; op {
+	case CMD_STATUS:
+		c.draadTxBuffer = ctrlHeader(CMD_STATUS, 2) | uint32(c.status())<<8
+		c.draadTxBufferSize = 24
+	case CMD_VERSION:
+		c.draadTxBuffer = ctrlHeader(CMD_VERSION, 1) |
+			CTRL_PROTOCOL_VERSION<<8
+		c.draadTxBufferSize = 16
+	case CMD_SET_THRESHOLD, CMD_GET_THRESHOLD:
+		if which > THRESHOLD_UPPER_BOUND ||
+			op == CMD_SET_THRESHOLD && header>>5&3 != 3 {
+			c.nak(op)
+			return
+		}
+		if op == CMD_SET_THRESHOLD {
+			t := c.thresholds
+			t[which] = uint(payload >> 8)
+			// Refuse insane limits: the reply tells the old value.
+			if ctrlThresholdsOk(t) {
+				c.thresholds = t
+			}
+		}
+		c.draadTxBuffer = ctrlHeader(op, 3) | uint32(which)<<8 |
+			uint32(c.thresholds[which])<<16
+		c.draadTxBufferSize = 32
+	default:
+		c.nak(op)
+	}
+}
+
+func (c *CtrlEmulator) nak(op byte) {
+	c.draadTxBuffer = ctrlHeader(CMD_NAK, 1) | uint32(op)<<8
+	c.draadTxBufferSize = 16
+}
+
+// ctrlThresholdsOk is thresholds_ok of ctrl.c.
+func ctrlThresholdsOk(t [3]uint) bool {
+	return t[THRESHOLD_LOWER_BOUND] < t[THRESHOLD_TARGET] &&
+		t[THRESHOLD_TARGET] < t[THRESHOLD_UPPER_BOUND] &&
+		t[THRESHOLD_UPPER_BOUND] < 1024
+}
+
+// ctrlHeader is HEADER(op, len) of ctrl.c.
+func ctrlHeader(op, length byte) uint32 {
+	return uint32(1 | op<<1 | length<<5)
+}
+
+func (c *CtrlEmulator) DraadRead() (bit, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.halted || c.draadTxBufferSize == 0 {
+		return false, false
+	}
+	bit = c.draadTxBuffer&1 == 1
+	c.draadTxBufferSize--
+	c.draadTxBuffer >>= 1
+	return bit, true
+}
@@ -14,12 +14,18 @@ type Dir struct {
 const DIR_DEFAULT_FILEMODE os.FileMode = 0640 // rw- r-- ---
 const DIR_DEFAULT_DIRMODE os.FileMode = 0750  // rwx r-x ---
 
+// DirOpen opens ~/.bart2d, creating it if necessary.
 func DirOpen() (d Dir, err error) {
 	usr, err := user.Current()
 	if err != nil {
 		return
 	}
-	pth := path.Join(usr.HomeDir, ".bart2d")
+	return DirOpenAt(path.Join(usr.HomeDir, ".bart2d"))
+}
+
+// DirOpenAt opens the given directory as the data directory of bart2d,
+// creating it if necessary.
+func DirOpenAt(pth string) (d Dir, err error) {
 	d = Dir{pth: pth}
 
 	err = ensureDir(pth)
@@ -32,6 +38,16 @@ func DirOpen() (d Dir, err error) {
 		return
 	}
 
+	err = ensureDir(d.Recordings())
+	if err != nil {
+		return
+	}
+
+	err = ensureDir(d.Firmware())
+	if err != nil {
+		return
+	}
+
 	return // err=nil
 }
 
@@ -39,6 +55,20 @@ func (d Dir) Reports() string {
 	return path.Join(d.pth, "reports")
 }
 
+func (d Dir) Recordings() string {
+	return path.Join(d.pth, "recordings")
+}
+
+// Config is the configuration file, see Config.
+func (d Dir) Config() string {
+	return path.Join(d.pth, "config.json")
+}
+
+// Firmware contains the known builds of the firmware, see FirmwareBuild.
+func (d Dir) Firmware() string {
+	return path.Join(d.pth, "firmware")
+}
+
 func ensureDir(name string) error {
 	fi, err := os.Stat(name)
 	if err == nil {
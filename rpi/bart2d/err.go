@@ -34,5 +34,5 @@ func WrapErrs(errs []error, prefix string, a ...interface{}) error {
 	if len(nonNilErrs) == 0 {
 		return nil
 	}
-	return wrappederr{wrapped: errs, prefix: fmt.Sprintf(prefix, a...)}
+	return wrappederr{wrapped: nonNilErrs, prefix: fmt.Sprintf(prefix, a...)}
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+)
+
+// FakeSpi is a scriptable in-memory SpiTransport.  Every Message records
+// the transmitted bytes and fills rbuf from a queue of bytes to receive.
+// When the queue runs dry, the rest of rbuf is filled with zeroes, which is
+// what an idle MUX sends.
+type FakeSpi struct {
+	mutex    sync.Mutex
+	incoming []byte
+	failures []error
+	sent     [][]byte
+	closed   bool
+}
+
+func NewFakeSpi() *FakeSpi {
+	return &FakeSpi{}
+}
+
+// Receive queues bytes which will be received by subsequent Messages.
+func (f *FakeSpi) Receive(data ...byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.incoming = append(f.incoming, data...)
+}
+
+// Fail makes the next Message return err without transferring anything.
+// Calls to Fail stack: the n-th queued error is returned by the n-th
+// following Message.
+func (f *FakeSpi) Fail(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures = append(f.failures, err)
+}
+
+// Sent returns a copy of the tbufs of all Messages so far.
+func (f *FakeSpi) Sent() [][]byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ret := make([][]byte, len(f.sent))
+	copy(ret, f.sent)
+	return ret
+}
+
+// Closed returns whether Close has been called.
+func (f *FakeSpi) Closed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.closed
+}
+
+func (f *FakeSpi) Message(rbuf, tbuf []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.failures) > 0 {
+		err := f.failures[0]
+		f.failures = f.failures[1:]
+		return err
+	}
+	f.sent = append(f.sent, append([]byte(nil), tbuf...))
+	n := copy(rbuf, f.incoming)
+	f.incoming = f.incoming[n:]
+	for i := n; i < len(rbuf); i++ {
+		rbuf[i] = 0
+	}
+	return nil
+}
+
+func (f *FakeSpi) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+// Identification of the firmware running on the MUX.
+//
+// The builds we know of are kept in the firmware directory as Intel HEX
+// files named <program>-<protocol>[-<anything>].hex, where protocol is the
+// version of the protocol spoken by the build.  `make install-mux' in
+// avr/attiny85 installs them like that.
+//
+// Only the MUX is connected to the SPI bus of the rPi, so the firmware of
+// the controllers cannot be read back in-circuit.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// MUX_PROTOCOL_VERSION is the version of the protocol of mux.c that we
+// speak.  With -check-firmware the daemon refuses to start if the MUX runs
+// another version; otherwise the Muxi reports a MuxProtocolError for every
+// status frame of another version.
+//
+// Version 2 added the status frame, see muxstatus.go.
+const MUX_PROTOCOL_VERSION = 2
+
+// FirmwareBuild is a known build of the firmware of a microcontroller.
+type FirmwareBuild struct {
+	Name     string // file name without .hex
+	Program  string // e.g. mux
+	Protocol int
+	Checksum uint32 // see ImageChecksum
+	Image    []byte
+}
+
+func (b FirmwareBuild) String() string {
+	return fmt.Sprintf("%s (%s, protocol %d, crc %08x)", b.Name, b.Program,
+		b.Protocol, b.Checksum)
+}
+
+// parseFirmwareName parses <program>-<protocol>[-<anything>].hex.
+func parseFirmwareName(name string) (program string, protocol int,
+	ok bool) {
+	if !strings.HasSuffix(name, ".hex") {
+		return
+	}
+	parts := strings.SplitN(strings.TrimSuffix(name, ".hex"), "-", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		return
+	}
+	protocol, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return
+	}
+	return parts[0], protocol, true
+}
+
+// FirmwareBuildsOpen reads the builds in the firmware directory.  Files
+// which are not named like a build are ignored.
+func FirmwareBuildsOpen(dir Dir) (builds []FirmwareBuild, err error) {
+	infos, err := ioutil.ReadDir(dir.Firmware())
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		program, protocol, ok := parseFirmwareName(info.Name())
+		if !ok || info.IsDir() {
+			continue
+		}
+		image, err := ReadImage(path.Join(dir.Firmware(), info.Name()))
+		if err != nil {
+			return nil, WrapErr(err, "Could not read %s", info.Name())
+		}
+		builds = append(builds, FirmwareBuild{
+			Name:     strings.TrimSuffix(info.Name(), ".hex"),
+			Program:  program,
+			Protocol: protocol,
+			Checksum: ImageChecksum(image),
+			Image:    image,
+		})
+	}
+	return
+}
+
+// IdentifyFirmware returns the build whose image is in flash, or nil if
+// flash does not contain a known build.
+func IdentifyFirmware(builds []FirmwareBuild, flash []byte) *FirmwareBuild {
+	checksum := ImageChecksum(flash)
+	for i := range builds {
+		if builds[i].Checksum == checksum &&
+			CompareImage(builds[i].Image, flash) == nil {
+			return &builds[i]
+		}
+	}
+	return nil
+}
+
+// CheckMuxFirmware reads back the flash of the MUX, which resets all
+// microcontrollers, and checks whether it runs a known build of mux.c
+// that speaks MUX_PROTOCOL_VERSION.
+func CheckMuxFirmware(isp *IspProgrammer, builds []FirmwareBuild) (
+	build *FirmwareBuild, err error) {
+	if err = isp.Enter(); err != nil {
+		isp.Leave()
+		return
+	}
+	flash, err := isp.ReadFlash(isp.Part.FlashSize)
+	if err2 := isp.Leave(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+	build = IdentifyFirmware(builds, flash)
+	if build == nil {
+		return nil, fmt.Errorf("MUX runs an unknown build of its firmware "+
+			"(crc %08x)", ImageChecksum(flash))
+	}
+	if build.Program != "mux" || build.Protocol != MUX_PROTOCOL_VERSION {
+		return build, fmt.Errorf("MUX runs %s, but we need mux with "+
+			"protocol %d", build, MUX_PROTOCOL_VERSION)
+	}
+	return build, nil
+}
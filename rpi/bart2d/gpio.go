@@ -0,0 +1,556 @@
+package main
+
+// Partial interface to linux's GPIO character device (/dev/gpiochipN),
+// using the first version of its ABI, which is available on every kernel
+// the rPi runs.
+//
+// See:
+//  - https://www.kernel.org/doc/Documentation/ABI/testing/gpio-cdev
+//  - https://elixir.bootlin.com/linux/latest/source/include/uapi/linux/gpio.h
+//
+// A line is requested from the chip, which returns a new file descriptor,
+// the handle, through which the line is controlled.  The line is released
+// when the handle is closed.  On the rPi, the lines of /dev/gpiochip0 are
+// numbered like the BCM GPIOs.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	s "syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	GPIO_CHIP_INFO_IOCTL             = 0x8044b401 //10 00000001000100 10110100 00000001
+	GPIO_GET_LINEHANDLE_IOCTL        = 0xc16cb403 //11 00000101101100 10110100 00000011
+	GPIO_GET_LINEEVENT_IOCTL         = 0xc030b404 //11 00000000110000 10110100 00000100
+	GPIOHANDLE_GET_LINE_VALUES_IOCTL = 0xc040b408 //11 00000001000000 10110100 00001000
+	GPIOHANDLE_SET_LINE_VALUES_IOCTL = 0xc040b409 //11 00000001000000 10110100 00001001
+	GPIOHANDLE_SET_CONFIG_IOCTL      = 0xc054b40a //11 00000001010100 10110100 00001010
+)
+
+// Flags of a line request, see linux/gpio.h
+const (
+	GPIOHANDLE_REQUEST_INPUT          = 1 << 0
+	GPIOHANDLE_REQUEST_OUTPUT         = 1 << 1
+	GPIOHANDLE_REQUEST_ACTIVE_LOW     = 1 << 2
+	GPIOHANDLE_REQUEST_OPEN_DRAIN     = 1 << 3
+	GPIOHANDLE_REQUEST_OPEN_SOURCE    = 1 << 4
+	GPIOHANDLE_REQUEST_BIAS_PULL_UP   = 1 << 5
+	GPIOHANDLE_REQUEST_BIAS_PULL_DOWN = 1 << 6
+	GPIOHANDLE_REQUEST_BIAS_DISABLE   = 1 << 7
+)
+
+// Flags of an event request and the ids of the events
+const (
+	GPIOEVENT_REQUEST_RISING_EDGE  = 1 << 0
+	GPIOEVENT_REQUEST_FALLING_EDGE = 1 << 1
+	GPIOEVENT_REQUEST_BOTH_EDGES   = GPIOEVENT_REQUEST_RISING_EDGE |
+		GPIOEVENT_REQUEST_FALLING_EDGE
+
+	GPIOEVENT_EVENT_RISING_EDGE  = 1
+	GPIOEVENT_EVENT_FALLING_EDGE = 2
+)
+
+const (
+	GPIOHANDLES_MAX    = 64
+	GPIO_MAX_NAME_SIZE = 32
+	GPIOEVENT_DATA_LEN = 16 // sizeof(struct gpioevent_data)
+)
+
+// The GPIO on the rPi and the consumer label we use when requesting it.
+const (
+	GPIO_DEFAULT_CHIP = "/dev/gpiochip0"
+	GPIO_CONSUMER     = "bart2d"
+)
+
+type gpioChipInfo struct {
+	Name  [GPIO_MAX_NAME_SIZE]byte
+	Label [GPIO_MAX_NAME_SIZE]byte
+	Lines uint32
+	// 68 bytes in total
+}
+
+type gpioHandleRequest struct {
+	LineOffsets   [GPIOHANDLES_MAX]uint32
+	Flags         uint32
+	DefaultValues [GPIOHANDLES_MAX]uint8
+	ConsumerLabel [GPIO_MAX_NAME_SIZE]byte
+	Lines         uint32
+	Fd            int32
+	// 364 bytes in total
+}
+
+type gpioHandleConfig struct {
+	Flags         uint32
+	DefaultValues [GPIOHANDLES_MAX]uint8
+	Padding       [4]uint32
+	// 84 bytes in total
+}
+
+type gpioHandleData struct {
+	Values [GPIOHANDLES_MAX]uint8
+}
+
+type gpioEventRequest struct {
+	LineOffset    uint32
+	HandleFlags   uint32
+	EventFlags    uint32
+	ConsumerLabel [GPIO_MAX_NAME_SIZE]byte
+	Fd            int32
+	// 48 bytes in total
+}
+
+func gpioLabel(consumer string) (label [GPIO_MAX_NAME_SIZE]byte) {
+	copy(label[:GPIO_MAX_NAME_SIZE-1], consumer)
+	return
+}
+
+func gpioIoctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	_, _, ern := s.Syscall(s.SYS_IOCTL, fd, request, uintptr(arg))
+	return fixNil(ern)
+}
+
+// GpioLine is a single GPIO line.  It is implemented by GpioHandle and,
+// for testing, by FakeGpioLine.
+type GpioLine interface {
+	Value() (bool, error)
+
+	// SetValue drives an output line high (true) or low (false).
+	SetValue(value bool) error
+
+	// SetOutput makes the line an output driven to the given value.
+	SetOutput(value bool) error
+
+	// SetInput makes the line an input.
+	SetInput() error
+
+	Close() error
+}
+
+// GpioEvent is an edge on a watched line.
+type GpioEvent struct {
+	// Timestamp of the edge as recorded by the kernel.  Depending on
+	// the version of the kernel, it is either the time since the epoch
+	// or since boot.
+	Timestamp time.Duration
+	Rising    bool
+}
+
+func (e GpioEvent) String() string {
+	edge := "falling"
+	if e.Rising {
+		edge = "rising"
+	}
+	return fmt.Sprintf("%s edge at %v", edge, e.Timestamp)
+}
+
+// GpioEventSource is a line whose edges are watched.  It is implemented by
+// GpioEventHandle and, for testing, by FakeGpioLine.
+type GpioEventSource interface {
+	Value() (bool, error)
+
+	// WaitEvent blocks until the next edge.  It returns io.EOF when the
+	// source is closed.
+	WaitEvent() (GpioEvent, error)
+
+	Close() error
+}
+
+type GpioChip os.File
+
+// GpioChipOpen opens the named GPIO chip, e.g. /dev/gpiochip0.
+func GpioChipOpen(name string) (*GpioChip, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, WrapErr(err, "while opening character device %v: ",
+			name)
+	}
+	return (*GpioChip)(f), nil
+}
+
+func (c *GpioChip) Close() error {
+	return (*os.File)(c).Close()
+}
+
+func (c *GpioChip) fd() uintptr {
+	return (*os.File)(c).Fd()
+}
+
+func (c *GpioChip) name() string {
+	return (*os.File)(c).Name()
+}
+
+// Info returns the name and label of the chip and its number of lines.
+func (c *GpioChip) Info() (name, label string, lines uint32, err error) {
+	var info gpioChipInfo
+	if err = gpioIoctl(c.fd(), GPIO_CHIP_INFO_IOCTL,
+		unsafe.Pointer(&info)); err != nil {
+		return
+	}
+	name = cString(info.Name[:])
+	label = cString(info.Label[:])
+	lines = info.Lines
+	return
+}
+
+func cString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
+
+// RequestLine requests the line at offset with the given
+// GPIOHANDLE_REQUEST_* flags.  If the line is an output, it is driven
+// to value.
+func (c *GpioChip) RequestLine(offset uint32, flags uint32, value bool,
+	consumer string) (*GpioHandle, error) {
+	req := gpioHandleRequest{
+		Flags:         flags,
+		ConsumerLabel: gpioLabel(consumer),
+		Lines:         1,
+	}
+	req.LineOffsets[0] = offset
+	if value {
+		req.DefaultValues[0] = 1
+	}
+	if err := gpioIoctl(c.fd(), GPIO_GET_LINEHANDLE_IOCTL,
+		unsafe.Pointer(&req)); err != nil {
+		return nil, WrapErr(err, "while requesting line %d of %v: ",
+			offset, c.name())
+	}
+	return &GpioHandle{
+		file: os.NewFile(uintptr(req.Fd),
+			fmt.Sprintf("%s:%d", c.name(), offset)),
+		flags: flags &^
+			(GPIOHANDLE_REQUEST_INPUT | GPIOHANDLE_REQUEST_OUTPUT),
+	}, nil
+}
+
+// RequestEvents requests the line at offset as an input whose edges,
+// as selected by the GPIOEVENT_REQUEST_* eventFlags, are reported.
+func (c *GpioChip) RequestEvents(offset uint32, handleFlags,
+	eventFlags uint32, consumer string) (*GpioEventHandle, error) {
+	req := gpioEventRequest{
+		LineOffset:    offset,
+		HandleFlags:   handleFlags | GPIOHANDLE_REQUEST_INPUT,
+		EventFlags:    eventFlags,
+		ConsumerLabel: gpioLabel(consumer),
+	}
+	if err := gpioIoctl(c.fd(), GPIO_GET_LINEEVENT_IOCTL,
+		unsafe.Pointer(&req)); err != nil {
+		return nil, WrapErr(err, "while requesting events of line %d "+
+			"of %v: ", offset, c.name())
+	}
+	// In non-blocking mode, the file is handled by the runtime's poller,
+	// which lets Close interrupt a pending WaitEvent.
+	if err := s.SetNonblock(int(req.Fd), true); err != nil {
+		s.Close(int(req.Fd))
+		return nil, err
+	}
+	return &GpioEventHandle{
+		file: os.NewFile(uintptr(req.Fd),
+			fmt.Sprintf("%s:%d", c.name(), offset)),
+	}, nil
+}
+
+// GpioHandle is a requested line.
+type GpioHandle struct {
+	file *os.File
+
+	// flags of the request other than its direction
+	flags uint32
+}
+
+// GpioOpenOutput requests the line at offset of the named chip as an
+// output driven to value.
+func GpioOpenOutput(chip string, offset uint32, value bool) (*GpioHandle,
+	error) {
+	c, err := GpioChipOpen(chip)
+	if err != nil {
+		return nil, err
+	}
+	// The handle stays valid after the chip is closed.
+	defer c.Close()
+	return c.RequestLine(offset, GPIOHANDLE_REQUEST_OUTPUT, value,
+		GPIO_CONSUMER)
+}
+
+// GpioOpenInput requests the line at offset of the named chip as input.
+func GpioOpenInput(chip string, offset uint32) (*GpioHandle, error) {
+	c, err := GpioChipOpen(chip)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.RequestLine(offset, GPIOHANDLE_REQUEST_INPUT, false,
+		GPIO_CONSUMER)
+}
+
+func (h *GpioHandle) Close() error {
+	return h.file.Close()
+}
+
+func (h *GpioHandle) Value() (bool, error) {
+	return gpioValue(h.file)
+}
+
+func (h *GpioHandle) SetValue(value bool) error {
+	var data gpioHandleData
+	if value {
+		data.Values[0] = 1
+	}
+	return gpioIoctl(h.file.Fd(), GPIOHANDLE_SET_LINE_VALUES_IOCTL,
+		unsafe.Pointer(&data))
+}
+
+func (h *GpioHandle) SetOutput(value bool) error {
+	config := gpioHandleConfig{Flags: h.flags | GPIOHANDLE_REQUEST_OUTPUT}
+	if value {
+		config.DefaultValues[0] = 1
+	}
+	return gpioIoctl(h.file.Fd(), GPIOHANDLE_SET_CONFIG_IOCTL,
+		unsafe.Pointer(&config))
+}
+
+func (h *GpioHandle) SetInput() error {
+	config := gpioHandleConfig{Flags: h.flags | GPIOHANDLE_REQUEST_INPUT}
+	return gpioIoctl(h.file.Fd(), GPIOHANDLE_SET_CONFIG_IOCTL,
+		unsafe.Pointer(&config))
+}
+
+func gpioValue(file *os.File) (bool, error) {
+	var data gpioHandleData
+	if err := gpioIoctl(file.Fd(), GPIOHANDLE_GET_LINE_VALUES_IOCTL,
+		unsafe.Pointer(&data)); err != nil {
+		return false, err
+	}
+	return data.Values[0] != 0, nil
+}
+
+// GpioEventHandle is a line requested for its edges.
+type GpioEventHandle struct {
+	file *os.File
+}
+
+func (h *GpioEventHandle) Close() error {
+	return h.file.Close()
+}
+
+func (h *GpioEventHandle) Value() (bool, error) {
+	return gpioValue(h.file)
+}
+
+func (h *GpioEventHandle) WaitEvent() (ev GpioEvent, err error) {
+	var buf [GPIOEVENT_DATA_LEN]byte
+	if _, err = io.ReadFull(h.file, buf[:]); err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == os.ErrClosed {
+			err = io.EOF
+		}
+		return
+	}
+	// struct gpioevent_data { __u64 timestamp; __u32 id; }
+	ev.Timestamp = time.Duration(binary.LittleEndian.Uint64(buf[0:8]))
+	ev.Rising = binary.LittleEndian.Uint32(buf[8:12]) ==
+		GPIOEVENT_EVENT_RISING_EDGE
+	return
+}
+
+// GpioWatcher reports the edges of a line on its Events channel.
+type GpioWatcher struct {
+	Events <-chan GpioEvent
+	Err    <-chan error
+
+	source GpioEventSource
+	events chan GpioEvent
+	err    chan error
+	closer chan bool // closer is closed if the watcher is closed
+}
+
+// GpioWatch starts watching the edges of source.  The watcher takes
+// ownership of source and closes it on Close.
+func GpioWatch(source GpioEventSource) *GpioWatcher {
+	w := &GpioWatcher{
+		source: source,
+		events: make(chan GpioEvent),
+		err:    make(chan error),
+		closer: make(chan bool),
+	}
+	w.Events = w.events
+	w.Err = w.err
+	go w.doWatch()
+	return w
+}
+
+func (w *GpioWatcher) Close() error {
+	close(w.closer)
+	return w.source.Close()
+}
+
+func (w *GpioWatcher) doWatch() {
+	for {
+		ev, err := w.source.WaitEvent()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			select {
+			case w.err <- err:
+			case _ = <-w.closer:
+			}
+			return
+		}
+		select {
+		case w.events <- ev:
+		case _ = <-w.closer:
+			return
+		}
+	}
+}
+
+// FakeGpioLine is an in-memory GpioLine and GpioEventSource.  Drive
+// simulates what is connected to the line.
+type FakeGpioLine struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	output  bool
+	value   bool
+	history []bool // values set while an output
+	events  []GpioEvent
+	start   time.Time
+	closed  bool
+}
+
+// NewFakeGpioLine returns an input line which is low.
+func NewFakeGpioLine() *FakeGpioLine {
+	l := &FakeGpioLine{start: time.Now()}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// Drive sets the value of an input line from the outside.
+func (l *FakeGpioLine) Drive(value bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.output {
+		l.change(value)
+	}
+}
+
+// History returns the values the line was driven to as an output.
+func (l *FakeGpioLine) History() []bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]bool(nil), l.history...)
+}
+
+// Output returns whether the line is an output.
+func (l *FakeGpioLine) Output() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.output
+}
+
+// Closed returns whether Close has been called.
+func (l *FakeGpioLine) Closed() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.closed
+}
+
+func (l *FakeGpioLine) change(value bool) {
+	if value == l.value {
+		return
+	}
+	l.value = value
+	l.events = append(l.events, GpioEvent{
+		Timestamp: time.Since(l.start),
+		Rising:    value,
+	})
+	l.cond.Broadcast()
+}
+
+func (l *FakeGpioLine) Value() (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.value, nil
+}
+
+func (l *FakeGpioLine) SetValue(value bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.output {
+		return s.EPERM // as the kernel does
+	}
+	l.history = append(l.history, value)
+	l.change(value)
+	return nil
+}
+
+func (l *FakeGpioLine) SetOutput(value bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.output = true
+	l.history = append(l.history, value)
+	l.change(value)
+	return nil
+}
+
+func (l *FakeGpioLine) SetInput() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.output = false
+	return nil
+}
+
+func (l *FakeGpioLine) WaitEvent() (ev GpioEvent, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for len(l.events) == 0 && !l.closed {
+		l.cond.Wait()
+	}
+	if l.closed {
+		return ev, io.EOF
+	}
+	ev = l.events[0]
+	l.events = l.events[1:]
+	return
+}
+
+func (l *FakeGpioLine) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+	return nil
+}
+
+// GpioResetLine drives an active-low RESET pin with a GPIO line.
+type GpioResetLine struct {
+	Line GpioLine
+}
+
+// GpioResetOpen requests the line at offset of the named chip to drive
+// RESET.  The microcontrollers are left running.
+func GpioResetOpen(chip string, offset uint32) (*GpioResetLine, error) {
+	line, err := GpioOpenOutput(chip, offset, true)
+	if err != nil {
+		return nil, err
+	}
+	return &GpioResetLine{Line: line}, nil
+}
+
+func (l *GpioResetLine) SetReset(asserted bool) error {
+	return l.Line.SetValue(!asserted)
+}
+
+func (l *GpioResetLine) Close() error {
+	return l.Line.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestGpioStructSizes(t *testing.T) {
+	// The sizes are encoded in the ioctl request numbers.
+	for _, c := range []struct {
+		name    string
+		size    uintptr
+		request uintptr
+	}{
+		{"gpiochip_info", unsafe.Sizeof(gpioChipInfo{}),
+			GPIO_CHIP_INFO_IOCTL},
+		{"gpiohandle_request", unsafe.Sizeof(gpioHandleRequest{}),
+			GPIO_GET_LINEHANDLE_IOCTL},
+		{"gpioevent_request", unsafe.Sizeof(gpioEventRequest{}),
+			GPIO_GET_LINEEVENT_IOCTL},
+		{"gpiohandle_data", unsafe.Sizeof(gpioHandleData{}),
+			GPIOHANDLE_SET_LINE_VALUES_IOCTL},
+		{"gpiohandle_config", unsafe.Sizeof(gpioHandleConfig{}),
+			GPIOHANDLE_SET_CONFIG_IOCTL},
+	} {
+		if expected := (c.request >> 16) & 0x3fff; c.size != expected {
+			t.Errorf("struct %s is %d bytes instead of %d",
+				c.name, c.size, expected)
+		}
+	}
+}
+
+func TestGpioWatch(t *testing.T) {
+	line := NewFakeGpioLine()
+	watcher := GpioWatch(line)
+	line.Drive(true)
+	line.Drive(true) // no edge
+	line.Drive(false)
+	for _, rising := range []bool{true, false} {
+		select {
+		case ev := <-watcher.Events:
+			if ev.Rising != rising {
+				t.Fatalf("got %v", ev)
+			}
+		case err := <-watcher.Err:
+			t.Fatal(err)
+		case _ = <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+	}
+	watcher.Close()
+	if !line.Closed() {
+		t.Fatal("line not closed")
+	}
+}
+
+func TestResetPulse(t *testing.T) {
+	line := NewFakeGpioLine()
+	reset := &GpioResetLine{Line: line}
+	if err := reset.SetReset(true); err == nil {
+		t.Fatal("could drive an input line")
+	}
+	line.SetOutput(true)
+	if err := ResetPulse(reset); err != nil {
+		t.Fatal(err)
+	}
+	history := line.History()
+	if len(history) != 3 || !history[0] || history[1] || !history[2] {
+		t.Fatalf("line was driven %v", history)
+	}
+}
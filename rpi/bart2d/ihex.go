@@ -0,0 +1,226 @@
+package main
+
+// Reading and writing of firmware images in the Intel HEX format, as
+// produced by avr-objcopy -O ihex.
+//
+// Every line is a record ":LLAAAATTDD..CC" with LL the number of data
+// bytes, AAAA the address, TT the type, DD the data and CC the checksum:
+// the two's complement of the sum of the other bytes.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// Types of records
+const (
+	IHEX_DATA                     = 0
+	IHEX_END_OF_FILE              = 1
+	IHEX_EXTENDED_SEGMENT_ADDRESS = 2
+	IHEX_START_SEGMENT_ADDRESS    = 3
+	IHEX_EXTENDED_LINEAR_ADDRESS  = 4
+	IHEX_START_LINEAR_ADDRESS     = 5
+
+	IHEX_RECORD_SIZE = 16 // number of data bytes per record we write
+	IHEX_MAX_IMAGE   = 1 << 20
+)
+
+// IhexRead reads an image.  Bytes not covered by the file are 0xff, as in
+// erased flash.
+func IhexRead(r io.Reader) (image []byte, err error) {
+	scanner := bufio.NewScanner(r)
+	var base int // set by extended address records
+	var eof bool
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if eof {
+			return nil, fmt.Errorf("ihex: line %d: record after end of file",
+				lineNo)
+		}
+		rtype, addr, data, err := ihexParseRecord(line)
+		if err != nil {
+			return nil, WrapErr(err, "ihex: line %d", lineNo)
+		}
+		switch rtype {
+		case IHEX_DATA:
+			start := base + addr
+			end := start + len(data)
+			if end > IHEX_MAX_IMAGE {
+				return nil, fmt.Errorf("ihex: line %d: address %#x is "+
+					"too large", lineNo, start)
+			}
+			for len(image) < end {
+				image = append(image, 0xff)
+			}
+			copy(image[start:], data)
+		case IHEX_END_OF_FILE:
+			eof = true
+		case IHEX_EXTENDED_SEGMENT_ADDRESS, IHEX_EXTENDED_LINEAR_ADDRESS:
+			if len(data) != 2 {
+				return nil, fmt.Errorf("ihex: line %d: malformed address "+
+					"record", lineNo)
+			}
+			base = int(data[0])<<8 | int(data[1])
+			if rtype == IHEX_EXTENDED_SEGMENT_ADDRESS {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		case IHEX_START_SEGMENT_ADDRESS, IHEX_START_LINEAR_ADDRESS:
+			// irrelevant for an AVR
+		default:
+			return nil, fmt.Errorf("ihex: line %d: unknown record type %d",
+				lineNo, rtype)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !eof {
+		return nil, fmt.Errorf("ihex: missing end of file record")
+	}
+	return image, nil
+}
+
+func ihexParseRecord(line string) (rtype byte, addr int, data []byte,
+	err error) {
+	if !strings.HasPrefix(line, ":") {
+		err = fmt.Errorf("record does not start with a colon")
+		return
+	}
+	raw, err := hex.DecodeString(line[1:])
+	if err != nil {
+		return
+	}
+	if len(raw) < 5 || len(raw) != 5+int(raw[0]) {
+		err = fmt.Errorf("record has the wrong length")
+		return
+	}
+	var sum byte
+	for _, b := range raw {
+		sum += b
+	}
+	if sum != 0 {
+		err = fmt.Errorf("checksum mismatch")
+		return
+	}
+	addr = int(raw[1])<<8 | int(raw[2])
+	rtype = raw[3]
+	data = raw[4 : len(raw)-1]
+	return
+}
+
+// IhexWrite writes an image.  Images larger than 64kB are not supported,
+// as no AVR we use has that much flash.
+func IhexWrite(w io.Writer, image []byte) error {
+	if len(image) > 1<<16 {
+		return fmt.Errorf("ihex: image of %d bytes is too large",
+			len(image))
+	}
+	bw := bufio.NewWriter(w)
+	for start := 0; start < len(image); start += IHEX_RECORD_SIZE {
+		end := start + IHEX_RECORD_SIZE
+		if end > len(image) {
+			end = len(image)
+		}
+		ihexWriteRecord(bw, IHEX_DATA, start, image[start:end])
+	}
+	ihexWriteRecord(bw, IHEX_END_OF_FILE, 0, nil)
+	return bw.Flush()
+}
+
+func ihexWriteRecord(w *bufio.Writer, rtype byte, addr int, data []byte) {
+	raw := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr),
+		rtype}, data...)
+	var sum byte
+	for _, b := range raw {
+		sum += b
+	}
+	raw = append(raw, -sum)
+	fmt.Fprintf(w, ":%s\n", strings.ToUpper(hex.EncodeToString(raw)))
+}
+
+// ReadImage reads a firmware image from an Intel HEX file, or, if the name
+// does not end in .hex, a raw binary.
+func ReadImage(name string) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if strings.HasSuffix(name, ".hex") {
+		return IhexRead(file)
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(file)
+	return buf.Bytes(), err
+}
+
+// WriteImage is the counterpart of ReadImage.
+func WriteImage(name string, image []byte) (err error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		DIR_DEFAULT_FILEMODE)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = WrapErrs([]error{err, file.Close()}, "Could not write image")
+	}()
+	if strings.HasSuffix(name, ".hex") {
+		return IhexWrite(file, image)
+	}
+	_, err = file.Write(image)
+	return
+}
+
+// TrimImage strips the trailing 0xff bytes, which are indistinguishable
+// from erased flash.
+func TrimImage(image []byte) []byte {
+	return bytes.TrimRight(image, "\xff")
+}
+
+// ImageChecksum is the CRC-32 of the trimmed image.  An image and the
+// flash it was written to have the same checksum.
+func ImageChecksum(image []byte) uint32 {
+	return crc32.ChecksumIEEE(TrimImage(image))
+}
+
+// ImageMismatchError is returned by CompareImage.
+type ImageMismatchError struct {
+	Offset           int
+	Expected, Actual byte
+}
+
+func (e ImageMismatchError) Error() string {
+	return fmt.Sprintf("flash differs from image at %#04x: "+
+		"expected %#02x, found %#02x", e.Offset, e.Expected, e.Actual)
+}
+
+// CompareImage checks whether flash contains image.  Past the end of the
+// image, flash should be erased.
+func CompareImage(image, flash []byte) error {
+	for i := range image {
+		var actual byte = 0xff
+		if i < len(flash) {
+			actual = flash[i]
+		}
+		if actual != image[i] {
+			return ImageMismatchError{i, image[i], actual}
+		}
+	}
+	for i := len(image); i < len(flash); i++ {
+		if flash[i] != 0xff {
+			return ImageMismatchError{i, 0xff, flash[i]}
+		}
+	}
+	return nil
+}
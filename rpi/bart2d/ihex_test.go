@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestIhexRead(t *testing.T) {
+	// Records like avr-objcopy writes them, with a gap and an extended
+	// address.
+	image, err := IhexRead(strings.NewReader(
+		":100000000EC015C014C013C012C011C010C00FC064\n" +
+			":02001400FFCF1C\n" +
+			":020000040000FA\n" +
+			":0400200001020304D2\n" +
+			":00000001FF\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(image) != 0x24 {
+		t.Fatalf("image has %d bytes instead of 36", len(image))
+	}
+	if image[0] != 0x0e || image[0x15] != 0xcf || image[0x16] != 0xff ||
+		image[0x23] != 0x04 {
+		t.Fatalf("wrong image % x", image)
+	}
+
+	for _, bad := range []string{
+		":0400200001020304D3\n:00000001FF\n", // checksum
+		":04002000010203D2\n:00000001FF\n",   // length
+		":0400200001020304D2\n",              // no end of file
+		"0400200001020304D2\n:00000001FF\n",  // no colon
+	} {
+		if _, err := IhexRead(strings.NewReader(bad)); err == nil {
+			t.Errorf("no error for %q", bad)
+		}
+	}
+}
+
+func TestIhexRoundTrip(t *testing.T) {
+	image := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(image)
+	var buf bytes.Buffer
+	if err := IhexWrite(&buf, image); err != nil {
+		t.Fatal(err)
+	}
+	image2, err := IhexRead(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image, image2) {
+		t.Fatal("image changed")
+	}
+}
+
+func TestCheckMuxFirmware(t *testing.T) {
+	pth, err := ioutil.TempDir("", "bart2d-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pth)
+	dir, err := DirOpenAt(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	images := make(map[string][]byte)
+	for _, name := range []string{"mux-1.hex", "mux-2-abc123.hex",
+		"ctrl-2.hex"} {
+		image := make([]byte, 300)
+		rnd.Read(image)
+		images[name] = image
+		if err := WriteImage(path.Join(dir.Firmware(), name),
+			image); err != nil {
+			t.Fatal(err)
+		}
+	}
+	builds, err := FirmwareBuildsOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 3 {
+		t.Fatalf("found %d builds instead of 3", len(builds))
+	}
+
+	for name, ok := range map[string]bool{
+		"mux-1.hex":        false,
+		"mux-2-abc123.hex": true,
+		"ctrl-2.hex":       false,
+	} {
+		emu := NewIspEmulator(AVR_PARTS[0])
+		copy(emu.Flash, images[name])
+		build, err := CheckMuxFirmware(IspOpen(emu, emu), builds)
+		if (err == nil) != ok {
+			t.Errorf("%s: unexpected result %v", name, err)
+		}
+		if build == nil || build.Name+".hex" != name {
+			t.Errorf("%s: identified as %v", name, build)
+		}
+	}
+
+	emu := NewIspEmulator(AVR_PARTS[0])
+	if _, err := CheckMuxFirmware(IspOpen(emu, emu), builds); err == nil {
+		t.Error("erased flash passed the check")
+	}
+}
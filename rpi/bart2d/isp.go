@@ -0,0 +1,394 @@
+package main
+
+// Programmer for the AVR microcontrollers using their serial programming
+// interface (ISP) over SPI.
+//
+// See the section "Serial Programming" in the datasheets of the ATtiny13
+// and ATtiny25/45/85.  Every instruction is four bytes; the target echoes
+// the second byte while it receives the third, and sends its output, if
+// any, while it receives the fourth byte.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// AvrPart describes a microcontroller we can program.
+type AvrPart struct {
+	Name      string
+	Signature [3]byte
+	FlashSize int // in bytes
+	PageSize  int // in bytes
+}
+
+// AVR_PARTS are the microcontrollers in our Bar T2.
+var AVR_PARTS = []AvrPart{
+	{Name: "attiny85", Signature: [3]byte{0x1e, 0x93, 0x0b},
+		FlashSize: 8192, PageSize: 64},
+	{Name: "attiny13", Signature: [3]byte{0x1e, 0x90, 0x07},
+		FlashSize: 1024, PageSize: 32},
+}
+
+// Instructions of the serial programming interface
+const (
+	ISP_PROGRAMMING_ENABLE = 0xac // followed by 0x53
+	ISP_CHIP_ERASE         = 0xac // followed by 0x80
+	ISP_POLL_READY         = 0xf0
+	ISP_LOAD_PAGE_LOW      = 0x40
+	ISP_LOAD_PAGE_HIGH     = 0x48
+	ISP_WRITE_PAGE         = 0x4c
+	ISP_READ_PROGRAM_LOW   = 0x20
+	ISP_READ_PROGRAM_HIGH  = 0x28
+	ISP_READ_SIGNATURE     = 0x30
+)
+
+// Timing of the serial programming interface
+const (
+	ISP_RESET_DELAY  = 20 * time.Millisecond // after pulling RESET low
+	ISP_BUSY_TIMEOUT = 100 * time.Millisecond
+	ISP_ENTER_TRIES  = 4
+)
+
+// ResetLine drives the RESET pin of a microcontroller.
+type ResetLine interface {
+	// SetReset pulls RESET low (asserted) or lets the chip run.
+	SetReset(asserted bool) error
+}
+
+// The RESET pins of the MUX and both controllers are connected to each
+// other and to a single GPIO of the rPi.
+const (
+	RESET_GPIO          = 22
+	RESET_PULSE_LENGTH  = 10 * time.Millisecond
+	RESET_STARTUP_DELAY = 70 * time.Millisecond // 64ms start-up + margin
+)
+
+// ResetPulse resets the microcontrollers and waits for them to start again.
+func ResetPulse(reset ResetLine) error {
+	if err := reset.SetReset(true); err != nil {
+		return err
+	}
+	time.Sleep(RESET_PULSE_LENGTH)
+	if err := reset.SetReset(false); err != nil {
+		return err
+	}
+	time.Sleep(RESET_STARTUP_DELAY)
+	return nil
+}
+
+// IspProgrammer programs a microcontroller over SPI.
+type IspProgrammer struct {
+	// Part is the microcontroller found by Enter.
+	Part AvrPart
+
+	spi   SpiTransport
+	reset ResetLine
+}
+
+// IspSpiOpen opens an SPI device for programming.  The serial programming
+// interface uses SPI mode 0, whereas the MUX uses mode 1.
+func IspSpiOpen(name string) (*SpiConfiguredDevice, error) {
+	return SpiOpen(name, 0, false, 8, 10000)
+}
+
+func IspOpen(spi SpiTransport, reset ResetLine) *IspProgrammer {
+	return &IspProgrammer{spi: spi, reset: reset}
+}
+
+// instruction sends a single instruction and returns the output byte.
+func (p *IspProgrammer) instruction(a, b, c, d byte) (byte, error) {
+	var rbuf [4]byte
+	if err := p.spi.Message(rbuf[:], []byte{a, b, c, d}); err != nil {
+		return 0, err
+	}
+	return rbuf[3], nil
+}
+
+// Enter resets the microcontroller, puts it into programming mode and
+// identifies it by its signature.
+func (p *IspProgrammer) Enter() error {
+	var synced bool
+	for try := 0; try < ISP_ENTER_TRIES && !synced; try++ {
+		if try > 0 {
+			// Pulse RESET to get the target back in sync.
+			if err := p.reset.SetReset(false); err != nil {
+				return err
+			}
+			time.Sleep(ISP_RESET_DELAY)
+		}
+		if err := p.reset.SetReset(true); err != nil {
+			return err
+		}
+		time.Sleep(ISP_RESET_DELAY)
+
+		var rbuf [4]byte
+		if err := p.spi.Message(rbuf[:], []byte{
+			ISP_PROGRAMMING_ENABLE, 0x53, 0, 0}); err != nil {
+			return err
+		}
+		synced = rbuf[2] == 0x53
+	}
+	if !synced {
+		return fmt.Errorf("isp: target does not enter programming mode")
+	}
+
+	var signature [3]byte
+	for i := range signature {
+		b, err := p.instruction(ISP_READ_SIGNATURE, 0, byte(i), 0)
+		if err != nil {
+			return err
+		}
+		signature[i] = b
+	}
+	for _, part := range AVR_PARTS {
+		if part.Signature == signature {
+			p.Part = part
+			return nil
+		}
+	}
+	return fmt.Errorf("isp: unknown signature %x", signature)
+}
+
+// Leave lets the microcontroller run.
+func (p *IspProgrammer) Leave() error {
+	return p.reset.SetReset(false)
+}
+
+// waitReady polls until the microcontroller finished the last write.
+func (p *IspProgrammer) waitReady() error {
+	deadline := time.Now().Add(ISP_BUSY_TIMEOUT)
+	for {
+		busy, err := p.instruction(ISP_POLL_READY, 0, 0, 0)
+		if err != nil {
+			return err
+		}
+		if busy&1 == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("isp: target stays busy")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Erase erases the flash (and EEPROM) memory.
+func (p *IspProgrammer) Erase() error {
+	if _, err := p.instruction(ISP_CHIP_ERASE, 0x80, 0, 0); err != nil {
+		return err
+	}
+	return p.waitReady()
+}
+
+// WriteFlash writes image to the start of the flash memory, which should
+// have been erased.  Pages which are entirely 0xff are skipped.
+func (p *IspProgrammer) WriteFlash(image []byte) error {
+	if len(image) > p.Part.FlashSize {
+		return fmt.Errorf("isp: image of %d bytes does not fit in the "+
+			"%d bytes of flash of the %s", len(image), p.Part.FlashSize,
+			p.Part.Name)
+	}
+	for start := 0; start < len(image); start += p.Part.PageSize {
+		page := image[start:]
+		if len(page) > p.Part.PageSize {
+			page = page[:p.Part.PageSize]
+		}
+		if bytes.Count(page, []byte{0xff}) == len(page) {
+			continue
+		}
+
+		// Load the page buffer with a single message.
+		tbuf := make([]byte, 0, 4*len(page))
+		for i, b := range page {
+			op := byte(ISP_LOAD_PAGE_LOW)
+			if i%2 == 1 {
+				op = ISP_LOAD_PAGE_HIGH
+			}
+			tbuf = append(tbuf, op, 0, byte(i/2), b)
+		}
+		if err := p.spi.Message(make([]byte, len(tbuf)), tbuf); err != nil {
+			return err
+		}
+
+		word := start / 2
+		if _, err := p.instruction(ISP_WRITE_PAGE, byte(word>>8),
+			byte(word), 0); err != nil {
+			return err
+		}
+		if err := p.waitReady(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFlash reads the first n bytes of the flash memory.
+func (p *IspProgrammer) ReadFlash(n int) ([]byte, error) {
+	if n > p.Part.FlashSize {
+		n = p.Part.FlashSize
+	}
+	ret := make([]byte, 0, n)
+	for start := 0; start < n; start += p.Part.PageSize {
+		end := start + p.Part.PageSize
+		if end > n {
+			end = n
+		}
+		tbuf := make([]byte, 0, 4*(end-start))
+		for addr := start; addr < end; addr++ {
+			op := byte(ISP_READ_PROGRAM_LOW)
+			if addr%2 == 1 {
+				op = ISP_READ_PROGRAM_HIGH
+			}
+			word := addr / 2
+			tbuf = append(tbuf, op, byte(word>>8), byte(word), 0)
+		}
+		rbuf := make([]byte, len(tbuf))
+		if err := p.spi.Message(rbuf, tbuf); err != nil {
+			return nil, err
+		}
+		for i := 3; i < len(rbuf); i += 4 {
+			ret = append(ret, rbuf[i])
+		}
+	}
+	return ret, nil
+}
+
+// VerifyFlash checks whether the flash memory starts with image.
+func (p *IspProgrammer) VerifyFlash(image []byte) error {
+	flash, err := p.ReadFlash(len(image))
+	if err != nil {
+		return err
+	}
+	if len(flash) < len(image) {
+		return fmt.Errorf("isp: image of %d bytes is larger than flash",
+			len(image))
+	}
+	return CompareImage(image, flash)
+}
+
+// Flash erases, writes and verifies the flash memory.
+func (p *IspProgrammer) Flash(image []byte) error {
+	if err := p.Erase(); err != nil {
+		return WrapErr(err, "Could not erase")
+	}
+	if err := p.WriteFlash(image); err != nil {
+		return WrapErr(err, "Could not write")
+	}
+	if err := p.VerifyFlash(image); err != nil {
+		return WrapErr(err, "Could not verify")
+	}
+	return nil
+}
+
+// cmdFlash implements `bart2d flash'.
+func cmdFlash(args []string) (err error) {
+	flags := flag.NewFlagSet("flash", flag.ExitOnError)
+	device := flags.String("device", MUXI_SPI_DEVICE, "SPI device")
+	chip := flags.String("gpiochip", GPIO_DEFAULT_CHIP, "GPIO chip")
+	resetPin := flags.Uint("reset-gpio", RESET_GPIO,
+		"GPIO connected to RESET")
+	read := flags.Bool("read", false,
+		"read the flash into the file instead of writing it")
+	identify := flags.Bool("identify", false,
+		"report which known build of the firmware is in flash")
+	dirPath := flags.String("dir", "", "data directory (~/.bart2d)")
+	flags.Usage = func() {
+		fmt.Print("usage: bart2d flash [flags] <image.hex|image.bin>\n" +
+			"       bart2d flash -identify [flags]\n\n" +
+			"Programs the microcontroller.  Stop the daemon first: " +
+			"it uses the same SPI device.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 && !*identify {
+		flags.Usage()
+		return fmt.Errorf("no image given")
+	}
+	name := flags.Arg(0)
+
+	var builds []FirmwareBuild
+	if *identify {
+		dir, err := openDir(*dirPath)
+		if err != nil {
+			return err
+		}
+		if builds, err = FirmwareBuildsOpen(dir); err != nil {
+			return err
+		}
+	}
+
+	spi, err := IspSpiOpen(*device)
+	if err != nil {
+		return err
+	}
+	defer spi.Close()
+
+	reset, err := GpioResetOpen(*chip, uint32(*resetPin))
+	if err != nil {
+		return err
+	}
+	defer reset.Close()
+
+	isp := IspOpen(spi, reset)
+	if err = isp.Enter(); err != nil {
+		isp.Leave()
+		return err
+	}
+	defer func() {
+		err = WrapErrs([]error{err, isp.Leave()}, "Flashing failed")
+	}()
+	fmt.Printf("Found %s\n", isp.Part.Name)
+
+	if *read || *identify {
+		flash, err := isp.ReadFlash(isp.Part.FlashSize)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Flash has checksum %08x\n", ImageChecksum(flash))
+		if *identify {
+			if build := IdentifyFirmware(builds, flash); build != nil {
+				fmt.Printf("Flash contains %s\n", build)
+			} else {
+				fmt.Println("Flash does not contain a known build")
+			}
+		}
+		if *read {
+			return WriteImage(name, flash)
+		}
+		return nil
+	}
+
+	image, err := ReadImage(name)
+	if err != nil {
+		return err
+	}
+	if err = isp.Flash(image); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote and verified %d bytes with checksum %08x\n",
+		len(image), ImageChecksum(image))
+	return nil
+}
+
+// cmdReset implements `bart2d reset'.
+func cmdReset(args []string) error {
+	flags := flag.NewFlagSet("reset", flag.ExitOnError)
+	chip := flags.String("gpiochip", GPIO_DEFAULT_CHIP, "GPIO chip")
+	resetPin := flags.Uint("reset-gpio", RESET_GPIO,
+		"GPIO connected to RESET")
+	flags.Usage = func() {
+		fmt.Print("usage: bart2d reset [flags]\n\n" +
+			"Resets the MUX and both controllers.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	reset, err := GpioResetOpen(*chip, uint32(*resetPin))
+	if err != nil {
+		return err
+	}
+	defer reset.Close()
+	return ResetPulse(reset)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestIspFlash(t *testing.T) {
+	for _, part := range AVR_PARTS {
+		emu := NewIspEmulator(part)
+		isp := IspOpen(emu, emu)
+		if err := isp.Enter(); err != nil {
+			t.Fatal(err)
+		}
+		if isp.Part.Name != part.Name {
+			t.Fatalf("found %s instead of %s", isp.Part.Name, part.Name)
+		}
+
+		image := make([]byte, part.FlashSize/2+3)
+		rand.New(rand.NewSource(1)).Read(image)
+		image[len(image)-1] = 0x0f
+		if err := isp.Flash(image); err != nil {
+			t.Fatalf("%s: %v", part.Name, err)
+		}
+		if !bytes.Equal(emu.Flash[:len(image)], image) {
+			t.Fatalf("%s: flash does not contain the image", part.Name)
+		}
+		flash, err := isp.ReadFlash(part.FlashSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(flash, emu.Flash) {
+			t.Fatalf("%s: read flash differs", part.Name)
+		}
+
+		// Writing without erasing cannot set bits, which verify notices.
+		image[len(image)-1] = 0xf0
+		if err := isp.WriteFlash(image); err != nil {
+			t.Fatal(err)
+		}
+		if err := isp.VerifyFlash(image); err == nil {
+			t.Fatalf("%s: verify did not notice the difference", part.Name)
+		}
+		if err := isp.Leave(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIspUnknownPart(t *testing.T) {
+	emu := NewIspEmulator(AvrPart{Name: "attiny2313",
+		Signature: [3]byte{0x1e, 0x91, 0x0a}, FlashSize: 2048, PageSize: 32})
+	if err := IspOpen(emu, emu).Enter(); err == nil {
+		t.Fatal("unknown part was accepted")
+	}
+}
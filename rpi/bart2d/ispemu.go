@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+)
+
+// IspEmulator emulates the serial programming interface of an AVR.  It
+// implements SpiTransport and, for its RESET pin, ResetLine.
+type IspEmulator struct {
+	Part  AvrPart
+	Flash []byte
+
+	// BusyPolls is the number of times the target reports it is busy
+	// after an erase or a page write.
+	BusyPolls int
+
+	mutex       sync.Mutex
+	inReset     bool
+	programming bool
+	pageBuffer  []byte
+	busy        int
+}
+
+// NewIspEmulator returns an emulated part with erased flash.
+func NewIspEmulator(part AvrPart) *IspEmulator {
+	e := &IspEmulator{
+		Part:       part,
+		Flash:      make([]byte, part.FlashSize),
+		BusyPolls:  2,
+		pageBuffer: make([]byte, part.PageSize),
+	}
+	e.erase()
+	return e
+}
+
+func (e *IspEmulator) erase() {
+	for i := range e.Flash {
+		e.Flash[i] = 0xff
+	}
+	e.clearPageBuffer()
+	e.busy = e.BusyPolls
+}
+
+func (e *IspEmulator) clearPageBuffer() {
+	for i := range e.pageBuffer {
+		e.pageBuffer[i] = 0xff
+	}
+}
+
+func (e *IspEmulator) SetReset(asserted bool) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.inReset = asserted
+	if !asserted {
+		e.programming = false
+	}
+	return nil
+}
+
+// Message processes the instructions in tbuf.  A running target (one that
+// is not in reset) ignores SPI altogether.
+func (e *IspEmulator) Message(rbuf, tbuf []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for i := range rbuf {
+		rbuf[i] = 0
+	}
+	if !e.inReset {
+		return nil
+	}
+	for i := 0; i+4 <= len(tbuf); i += 4 {
+		in := tbuf[i : i+4]
+		out := rbuf[i : i+4]
+		out[1] = in[0]
+		out[2] = in[1]
+		out[3] = e.instruction(in)
+	}
+	return nil
+}
+
+// instruction executes a single instruction and returns the output byte.
+func (e *IspEmulator) instruction(in []byte) byte {
+	if !e.programming {
+		if in[0] == ISP_PROGRAMMING_ENABLE && in[1] == 0x53 {
+			e.programming = true
+		}
+		return in[2]
+	}
+
+	wordAddr := int(in[1])<<8 | int(in[2])
+	switch in[0] {
+	case ISP_PROGRAMMING_ENABLE: // also ISP_CHIP_ERASE
+		if in[1] == 0x80 {
+			e.erase()
+		}
+	case ISP_POLL_READY:
+		if e.busy > 0 {
+			e.busy--
+			return 1
+		}
+		return 0
+	case ISP_READ_SIGNATURE:
+		if in[2] < 3 {
+			return e.Part.Signature[in[2]]
+		}
+		return 0
+	case ISP_LOAD_PAGE_LOW, ISP_LOAD_PAGE_HIGH:
+		offset := 2 * int(in[2]) % e.Part.PageSize
+		if in[0] == ISP_LOAD_PAGE_HIGH {
+			offset++
+		}
+		e.pageBuffer[offset] = in[3]
+	case ISP_WRITE_PAGE:
+		start := (2 * wordAddr) % e.Part.FlashSize
+		start -= start % e.Part.PageSize
+		// Programming flash can only clear bits.
+		for i, b := range e.pageBuffer {
+			e.Flash[start+i] &= b
+		}
+		e.clearPageBuffer()
+		e.busy = e.BusyPolls
+	case ISP_READ_PROGRAM_LOW, ISP_READ_PROGRAM_HIGH:
+		addr := (2 * wordAddr) % e.Part.FlashSize
+		if in[0] == ISP_READ_PROGRAM_HIGH {
+			addr++
+		}
+		return e.Flash[addr]
+	}
+	return 0
+}
+
+func (e *IspEmulator) Close() error {
+	return nil
+}
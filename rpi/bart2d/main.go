@@ -1,21 +1,47 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 )
 
 type Bart2d struct {
-	dir    Dir
-	chipi  *Chipi
-	dumper *Dumper
+	// DirPath is the data directory; ~/.bart2d if empty.
+	DirPath string
+
+	// Transport connects to the MUX; /dev/spidev0.0 if nil.
+	Transport SpiTransport
+
+	// Record makes the daemon record all SPI messages, see Recorder.
+	Record bool
+
+	// CheckFirmware makes the daemon refuse to start unless the MUX runs
+	// a known build of its firmware, see CheckMuxFirmware.
+	CheckFirmware bool
+
+	// Reset drives the RESET line of the MUX, for when the supervisor
+	// resets it; GPIO RESET_GPIO if nil.
+	Reset ResetLine
+
+	dir        Dir
+	config     Config
+	chipi      *Chipi
+	dumper     *Dumper
+	monitor    *ConsistencyMonitor // nil if there is only one chip
+	supervisor *Supervisor
+
+	mutex       sync.Mutex // protects the following, and swapping chipi
+	chipiClosed bool       // whether chipi is closed, but not yet reopened
+	closed      bool
 }
 
 func (b *Bart2d) Run() error {
 	{
-		dir, err := DirOpen()
+		dir, err := openDir(b.DirPath)
 		if err != nil {
 			return err
 		}
@@ -23,13 +49,32 @@ func (b *Bart2d) Run() error {
 	}
 
 	{
-		chipi, err := ChipiOpen()
+		config, err := ConfigOpen(b.dir)
+		if err != nil {
+			return err
+		}
+		b.config = config
+	}
+
+	if b.CheckFirmware {
+		if err := b.checkFirmware(); err != nil {
+			return WrapErr(err, "Firmware check failed")
+		}
+	}
+
+	{
+		chipi, err := b.openChipi()
 		if err != nil {
 			return WrapErr(err, "Could not open Chipi")
 		}
 		b.chipi = chipi
 	}
 
+	b.supervisor = NewSupervisor(b.config.Supervisor, b.config.Chips)
+	if b.config.Chips >= 2 {
+		b.monitor = NewConsistencyMonitor(b.config.Consistency)
+	}
+
 	{
 		dumper, err := DumperOpen(b.dir)
 		if err != nil {
@@ -38,7 +83,16 @@ func (b *Bart2d) Run() error {
 		b.dumper = dumper
 	}
 	go b.pump()
-	ch := make(chan os.Signal)
+
+	// Only now that the pump reads the reports, the commands get replies.
+	for chip := 0; chip < b.config.Chips; chip++ {
+		thresholds, err := b.chipi.Thresholds(byte(chip))
+		if err != nil {
+			thresholds = fmt.Sprintf("could not read thresholds: %v", err)
+		}
+		fmt.Printf("chip %d: %s\n", chip, thresholds)
+	}
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	_ = <-ch
 	if err := b.Close(); err != nil {
@@ -48,26 +102,264 @@ func (b *Bart2d) Run() error {
 	return nil
 }
 
+// openDir opens the data directory at pth, or ~/.bart2d if pth is empty.
+func openDir(pth string) (Dir, error) {
+	if pth == "" {
+		return DirOpen()
+	}
+	return DirOpenAt(pth)
+}
+
+func (b *Bart2d) checkFirmware() error {
+	if b.Transport != nil {
+		return fmt.Errorf("can only check the firmware of a real MUX")
+	}
+	builds, err := FirmwareBuildsOpen(b.dir)
+	if err != nil {
+		return err
+	}
+	spi, err := IspSpiOpen(MUXI_SPI_DEVICE)
+	if err != nil {
+		return err
+	}
+	defer spi.Close()
+	reset, err := GpioResetOpen(GPIO_DEFAULT_CHIP, RESET_GPIO)
+	if err != nil {
+		return err
+	}
+	defer reset.Close()
+	build, err := CheckMuxFirmware(IspOpen(spi, reset), builds)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("MUX runs %s\n", build)
+	return nil
+}
+
+func (b *Bart2d) openChipi() (*Chipi, error) {
+	var transport SpiTransport = keptSpi{b.Transport}
+	if b.Transport == nil {
+		spidev, err := MuxiSpiOpen()
+		if err != nil {
+			return nil, err
+		}
+		transport = spidev
+	}
+	if b.Record {
+		recorder, err := RecorderOpen(b.dir)
+		if err != nil {
+			transport.Close()
+			return nil, WrapErr(err, "Could not start recording")
+		}
+		fmt.Printf("Recording SPI messages to %s\n", recorder.Path)
+		transport = &RecordingSpi{Transport: transport, Recorder: recorder}
+	}
+	muxiConfig := ourMuxiConfig()
+	muxiConfig.Chips = b.config.Chips
+	muxi, err := MuxiOpenTransport(transport, muxiConfig)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	return ChipiOpenMuxi(muxi, b.config.Models()) // closes muxi on error
+}
+
+// keptSpi is an SpiTransport which stays open when the Muxi on top of it
+// is closed, so that the Muxi can be opened anew.
+type keptSpi struct {
+	SpiTransport
+}
+
+func (s keptSpi) Transfer(segments []SpiSegment) error {
+	return SpiTransfer(s.SpiTransport, segments)
+}
+
+func (s keptSpi) Close() error {
+	return nil
+}
+
+// Status returns the health of the chips, see Supervisor.
+func (b *Bart2d) Status() SupervisorStatus {
+	return b.supervisor.Status()
+}
+
 func (b *Bart2d) Close() error {
-	err1 := b.chipi.Close()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	var err1, err3 error
+	if !b.chipiClosed {
+		err1 = b.chipi.Close()
+	}
 	err2 := b.dumper.Close()
-	return WrapErrs([]error{err1, err2}, "Closing failed")
+	if b.Transport != nil {
+		err3 = b.Transport.Close()
+	}
+	return WrapErrs([]error{err1, err2, err3}, "Closing failed")
+}
+
+// recover attempts the recovery r asked for by the supervisor.
+func (b *Bart2d) recover(r Recovery) error {
+	switch r.Step {
+	case RECOVERY_RESET_COMMANDS:
+		return b.chipi.ResetCommands(r.Chip)
+	case RECOVERY_REOPEN_MUXI:
+		return b.reopenChipi(false)
+	case RECOVERY_RESET_MUX:
+		return b.reopenChipi(true)
+	}
+	return fmt.Errorf("unknown recovery step %v", r.Step)
 }
 
+// reopenChipi closes the Chipi and its Muxi, resets the MUX if resetMux,
+// and opens them anew.  If that fails, chipi is left closed until the
+// next attempt.
+func (b *Bart2d) reopenChipi(resetMux bool) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil
+	}
+	if !b.chipiClosed {
+		b.chipi.Close()
+		b.chipiClosed = true
+	}
+	if resetMux {
+		if err := b.resetMux(); err != nil {
+			return WrapErr(err, "Could not reset the MUX")
+		}
+	}
+	chipi, err := b.openChipi()
+	if err != nil {
+		return WrapErr(err, "Could not reopen Chipi")
+	}
+	b.chipi, b.chipiClosed = chipi, false
+	return nil
+}
+
+// resetMux pulses the RESET line of the MUX, and so of the controllers.
+func (b *Bart2d) resetMux() error {
+	if b.Reset != nil {
+		return ResetPulse(b.Reset)
+	}
+	if b.Transport != nil {
+		return fmt.Errorf("can only reset a real MUX")
+	}
+	reset, err := GpioResetOpen(GPIO_DEFAULT_CHIP, RESET_GPIO)
+	if err != nil {
+		return err
+	}
+	defer reset.Close()
+	return ResetPulse(reset)
+}
+
+// STATS_INTERVAL is the time between two printouts of the statistics of
+// the link with the chips.
+const STATS_INTERVAL = 5 * time.Minute
+
+// SUPERVISOR_INTERVAL is the time between two checks of the health of the
+// chips.
+const SUPERVISOR_INTERVAL = time.Second
+
 func (b *Bart2d) pump() {
+	ticker := time.NewTicker(STATS_INTERVAL)
+	defer ticker.Stop()
+	supervise := time.NewTicker(SUPERVISOR_INTERVAL)
+	defer supervise.Stop()
+	health := func(changes []ChipHealthChange) {
+		for _, change := range changes {
+			fmt.Printf("** health: %v\n", change)
+		}
+	}
 	for {
 		select {
+		case _ = <-ticker.C:
+			fmt.Printf("-- statistics\n%v\n", b.chipi.Stats())
+			if b.monitor != nil {
+				fmt.Printf("consistency: %v\n", b.monitor.Stats())
+			}
+			fmt.Printf("supervisor:\n%v\n", b.supervisor.Status())
+		case now := <-supervise.C:
+			health(b.supervisor.Stats(b.chipi.Stats(), now))
+			for _, r := range b.supervisor.Due(now) {
+				fmt.Printf("** recovery: %v\n", r)
+				if err := b.recover(r); err != nil {
+					fmt.Printf("!! recovery failed: %v\n", err)
+					health(b.supervisor.Failed(r, err, time.Now()))
+				}
+			}
 		case err := <-b.chipi.Err:
-			fmt.Printf("!! chipi error: %v\n", err)
+			health(b.supervisor.Error(err, time.Now()))
+			if !b.supervisor.Quiet(err) {
+				fmt.Printf("!! chipi error: %v\n", err)
+			}
+		case event := <-b.chipi.Events:
+			fmt.Printf("** %v\n", event)
+			health(b.supervisor.Event(event))
 		case report := <-b.chipi.Reports:
+			health(b.supervisor.Report(report))
 			fmt.Printf("%s -- %s\n", report, report.Msg)
 			b.dumper.Dump(report)
+			if b.monitor != nil {
+				for _, alert := range b.monitor.Add(report) {
+					fmt.Printf("!! consistency: %v\n", alert)
+				}
+			}
 		}
 	}
 }
 
+// cmdRun implements `bart2d run'.
+func cmdRun(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	record := flags.Bool("record", false,
+		"record all SPI messages exchanged with the MUX")
+	checkFirmware := flags.Bool("check-firmware", false,
+		"refuse to start unless the MUX runs a known build of mux.c")
+	flags.Parse(args)
+	return (&Bart2d{Record: *record, CheckFirmware: *checkFirmware}).Run()
+}
+
+const USAGE = `usage: bart2d [command] [arguments]
+
+Commands:
+  run        run the daemon (default)
+  simulate   run the daemon against a simulated coffee machine
+  replay     replay a recording of the SPI messages
+  flash      program a microcontroller
+  reset      reset the microcontrollers
+  calibrate  fit the thermistors to reference temperatures
+  setpoint   show or set the thresholds of the chips
+`
+
 func main() {
-	if err := (&Bart2d{}).Run(); err != nil {
+	var err error
+	command := "run"
+	args := []string{}
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+		args = os.Args[2:]
+	}
+	switch command {
+	case "run":
+		err = cmdRun(args)
+	case "simulate":
+		err = cmdSimulate(args)
+	case "replay":
+		err = cmdReplay(args)
+	case "flash":
+		err = cmdFlash(args)
+	case "reset":
+		err = cmdReset(args)
+	case "calibrate":
+		err = cmdCalibrate(args)
+	case "setpoint":
+		err = cmdSetpoint(args)
+	default:
+		fmt.Print(USAGE)
+		os.Exit(2)
+	}
+	if err != nil {
 		fmt.Println("FATAL ERROR: ", err)
 	}
 }
@@ -0,0 +1,301 @@
+package main
+
+// Emulator of the firmware of the MUX, see avr/attiny85/mux.c.
+//
+// The emulator follows the C code statement by statement, including its
+// quirks: arithmetic on bytes is promoted to avr-gcc's 16-bit int before it
+// is widened to a long, see avrIntShl.  The only liberty taken is the
+// interleaving of the USI interrupt with the main loop: the interrupt
+// handler runs exactly once per byte transferred and never in the middle of
+// an iteration of the main loop.  How many iterations of the main loop run
+// per byte is set by LoopsPerByte; further iterations can be run with Run to
+// model the time between two SPI messages.
+
+import (
+	"sync"
+	"time"
+)
+
+// DraadDevice is a microcontroller on the other end of a draad.
+type DraadDevice interface {
+	// DraadWrite is called when the MUX writes a bit to the device.
+	DraadWrite(bit bool)
+
+	// DraadRead is called when the MUX reads a bit from the device.
+	// ok is false if the device does not reply.
+	DraadRead() (bit, ok bool)
+}
+
+// Constants from mux.c
+const (
+	MUXEMU_SPI_RX_BUFFER_MAX = 8
+	MUXEMU_DRAAD_BUFFER_BITS = 32
+	MUXEMU_MAX_FRAME_BITS    = 24
+	MUXEMU_MAX_DRAADS        = 4 // N_DRAAD is at most 4
+	MUXEMU_STATUS_HEADER     = 128 | 31<<2
+)
+
+// MUXEMU_LOOP_PERIOD is about the time an iteration of the main loop of the
+// MUX takes: writing or reading a bit over draad takes four DRAAD_DELAYs.
+const MUXEMU_LOOP_PERIOD = 4 * 200 * time.Microsecond
+
+// MuxEmulator is a byte-exact model of the MUX firmware.  It implements
+// SpiTransport, so it can be put behind a Muxi.
+type MuxEmulator struct {
+	// Draad holds the devices connected to the draads.  A nil device
+	// never replies.
+	Draad [MUXEMU_MAX_DRAADS]DraadDevice
+
+	// NDraad is the number of draads the firmware is built for: N_DRAAD.
+	// The ATTINY85 has pins for two, but the emulator allows as many as
+	// the header of a frame can address.
+	NDraad int
+
+	// LoopsPerByte is the number of iterations of the main loop that run
+	// during the transfer of a single byte over SPI.  At ~10kHz a byte takes
+	// about as long as writing or reading a single bit over draad, hence
+	// the default of 1.
+	LoopsPerByte int
+
+	// Protocol is the version of the protocol the firmware is built for:
+	// PROTOCOL.
+	Protocol byte
+
+	mutex sync.Mutex
+
+	// The registers of the USI unit.
+	usidr byte
+
+	// Global variables of mux.c
+	spiTxBuffer       uint32
+	spiTxBufferSize   byte
+	draadTxBuffer     [MUXEMU_MAX_DRAADS]uint32
+	draadTxBufferSize [MUXEMU_MAX_DRAADS]byte
+	draadRxBuffer     [MUXEMU_MAX_DRAADS]uint32
+	draadRxBufferSize [MUXEMU_MAX_DRAADS]byte
+	draadTxOverflow   bool
+	spiRxOverflow     bool
+	statusRequested   bool
+	spiRxBuffer       [MUXEMU_SPI_RX_BUFFER_MAX]byte
+	spiRxBufferSize   byte
+	spiRxBufferOffset byte
+
+	// Local variables of main() in mux.c
+	spiFrameBodyBitsToRead byte
+	spiFrameBodySize       byte
+	spiFrameBody           int32
+	spiFrameWho            byte
+	who                    byte
+}
+
+// NewMuxEmulator returns a freshly reset MUX with the given devices on its
+// draads.  It is built for as many draads as there are devices, which
+// should be between 1 and MUXEMU_MAX_DRAADS.
+func NewMuxEmulator(devices ...DraadDevice) *MuxEmulator {
+	if len(devices) < 1 || len(devices) > MUXEMU_MAX_DRAADS {
+		panic("muxemu: unsupported number of draads")
+	}
+	e := &MuxEmulator{
+		NDraad:       len(devices),
+		LoopsPerByte: 1,
+		Protocol:     MUX_PROTOCOL_VERSION,
+	}
+	copy(e.Draad[:], devices)
+	return e
+}
+
+// Message shifts tbuf into the MUX while shifting rbuf out of it.
+func (e *MuxEmulator) Message(rbuf, tbuf []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.message(rbuf, tbuf)
+	return nil
+}
+
+// Transfer shifts the segments through the MUX.  During the delay after
+// a segment, the main loop runs an iteration per MUXEMU_LOOP_PERIOD.
+func (e *MuxEmulator) Transfer(segments []SpiSegment) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, seg := range segments {
+		e.message(seg.RBuf, seg.TBuf)
+		delay := time.Duration(seg.DelayUsecs) * time.Microsecond
+		for i := time.Duration(0); i < delay/MUXEMU_LOOP_PERIOD; i++ {
+			e.loop()
+		}
+	}
+	return nil
+}
+
+func (e *MuxEmulator) message(rbuf, tbuf []byte) {
+	for i := range tbuf {
+		rbuf[i] = e.usidr
+		e.usiOverflow(tbuf[i])
+		for j := 0; j < e.LoopsPerByte; j++ {
+			e.loop()
+		}
+	}
+}
+
+func (e *MuxEmulator) Close() error {
+	return nil
+}
+
+// Run runs n iterations of the main loop of the MUX.
+func (e *MuxEmulator) Run(n int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		e.loop()
+	}
+}
+
+// Overflows returns the overflow flags the firmware keeps in its status.
+func (e *MuxEmulator) Overflows() (draadTx, spiRx bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.draadTxOverflow, e.spiRxOverflow
+}
+
+// avrIntShl computes (long)(b << n) the way avr-gcc does: b is promoted
+// to a 16-bit int, which is shifted (to 0 if n >= 16) and then sign
+// extended to 32 bits.
+func avrIntShl(b byte, n byte) int32 {
+	return int32(int16(uint16(b) << n))
+}
+
+// loop runs a single iteration of the for(;;) loop in main().
+func (e *MuxEmulator) loop() {
+	e.who = byte((int(e.who) + 1) % e.NDraad)
+	who := e.who
+
+	// Interpret SPI rx buffer if it's not empty
+	for e.spiRxBufferSize > 0 {
+		received := e.spiRxBuffer[e.spiRxBufferOffset]
+		e.spiRxBufferSize--
+		e.spiRxBufferOffset = (e.spiRxBufferOffset + 1) %
+			MUXEMU_SPI_RX_BUFFER_MAX
+
+		if e.spiFrameBodyBitsToRead > 0 {
+			if e.spiFrameBodyBitsToRead < 8 {
+				e.spiFrameBodyBitsToRead = 0
+			} else {
+				e.spiFrameBodyBitsToRead -= 8
+			}
+			e.spiFrameBody |= avrIntShl(received, e.spiFrameBodyBitsToRead)
+
+			if e.spiFrameBodyBitsToRead > 0 {
+				continue
+			}
+			if int(e.spiFrameWho) >= e.NDraad {
+				continue
+			}
+			fwho := e.spiFrameWho
+			if int(e.draadTxBufferSize[fwho])+int(e.spiFrameBodySize) >
+				MUXEMU_DRAAD_BUFFER_BITS {
+				e.draadTxOverflow = true
+				continue
+			}
+			e.draadTxBuffer[fwho] |= uint32(e.spiFrameBody) <<
+				e.draadTxBufferSize[fwho]
+			e.draadTxBufferSize[fwho] += e.spiFrameBodySize
+			continue
+		}
+
+		if received&128 == 0 {
+			continue // there is no frame
+		}
+
+		e.spiFrameBodySize = (received >> 2) & 31
+		e.spiFrameBodyBitsToRead = e.spiFrameBodySize
+		e.spiFrameWho = received & 3
+		e.spiFrameBody = 0
+
+		if e.spiFrameBodySize == 0 {
+			e.statusRequested = true
+		}
+	}
+
+	// Fill SPI tx buffer if it's empty.  The status goes first.
+	if e.spiTxBufferSize == 0 && e.statusRequested {
+		var flags uint32
+		if e.draadTxOverflow {
+			flags |= MUXI_STATUS_DRAAD_TX_OVERFLOW
+		}
+		if e.spiRxOverflow {
+			flags |= MUXI_STATUS_SPI_RX_OVERFLOW
+		}
+		e.spiTxBuffer = MUXEMU_STATUS_HEADER | flags<<8 |
+			uint32(e.Protocol)<<16
+		e.spiTxBufferSize = 24
+		e.draadTxOverflow = false
+		e.spiRxOverflow = false
+		e.statusRequested = false
+	} else if e.spiTxBufferSize == 0 && e.draadRxBufferSize[who] > 0 {
+		nBitsToSend := e.draadRxBufferSize[who]
+		if nBitsToSend > MUXEMU_MAX_FRAME_BITS {
+			nBitsToSend = MUXEMU_MAX_FRAME_BITS
+		}
+		e.spiTxBuffer = uint32(128|(nBitsToSend<<2)|who) |
+			(e.draadRxBuffer[who] << 8)
+		e.spiTxBufferSize = 8 + nBitsToSend
+		e.draadRxBufferSize[who] -= nBitsToSend
+		e.draadRxBuffer[who] >>= nBitsToSend
+	}
+
+	if e.draadTxBufferSize[who] > 0 {
+		toSend := e.draadTxBuffer[who]&1 == 1
+		e.draadTxBuffer[who] >>= 1
+		e.draadTxBufferSize[who]--
+		if e.Draad[who] != nil {
+			e.Draad[who].DraadWrite(toSend)
+		}
+		return
+	}
+
+	// Is our buffer empty enough to receive something from the uC?
+	if e.draadRxBufferSize[who] == MUXEMU_DRAAD_BUFFER_BITS {
+		return
+	}
+
+	if e.Draad[who] == nil {
+		return
+	}
+	bit, ok := e.Draad[who].DraadRead()
+	if !ok {
+		return // No reply
+	}
+	var received byte
+	if bit {
+		received = 1
+	}
+	e.draadRxBuffer[who] |= uint32(received) << e.draadRxBufferSize[who]
+	e.draadRxBufferSize[who]++
+}
+
+// usiOverflow is ISR(USI_OVF_vect): called when the USI unit received
+// a byte.
+func (e *MuxEmulator) usiOverflow(usibr byte) {
+	if e.spiRxBufferSize == MUXEMU_SPI_RX_BUFFER_MAX {
+		e.spiRxOverflow = true
+	} else {
+		i := (e.spiRxBufferOffset + e.spiRxBufferSize) %
+			MUXEMU_SPI_RX_BUFFER_MAX
+		e.spiRxBuffer[i] = usibr
+		e.spiRxBufferSize++
+	}
+
+	if e.spiTxBufferSize == 0 {
+		e.usidr = 0
+		return
+	}
+
+	e.usidr = byte(e.spiTxBuffer & 255)
+	e.spiTxBuffer >>= 8
+
+	if e.spiTxBufferSize < 8 {
+		e.spiTxBufferSize = 0
+	} else {
+		e.spiTxBufferSize -= 8
+	}
+}
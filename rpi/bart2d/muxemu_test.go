@@ -0,0 +1,194 @@
+package main
+
+import (
+	"testing"
+)
+
+// testDraadDevice records the bits written to it and replies with the bits
+// in toSend.
+type testDraadDevice struct {
+	written []bool
+	toSend  []bool
+}
+
+func (d *testDraadDevice) DraadWrite(bit bool) {
+	d.written = append(d.written, bit)
+}
+
+func (d *testDraadDevice) DraadRead() (bit, ok bool) {
+	if len(d.toSend) == 0 {
+		return false, false
+	}
+	bit = d.toSend[0]
+	d.toSend = d.toSend[1:]
+	return bit, true
+}
+
+// decodeFrames splits the bytes received from the MUX into messages.
+func decodeFrames(t *testing.T, stream []byte) (msgs []MuxiMsg) {
+	for len(stream) > 0 {
+		if stream[0] == 0 {
+			stream = stream[1:]
+			continue
+		}
+		length := int((stream[0] >> 2) & 31)
+		size := 1 + (length+7)/8
+		if size > len(stream) {
+			t.Fatalf("truncated frame %v", stream)
+		}
+		var msg MuxiMsg
+		if err := msg.readFrom(stream[:size]); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+		stream = stream[size:]
+	}
+	return
+}
+
+func TestMuxEmulatorForwardsRequest(t *testing.T) {
+	dev := &testDraadDevice{}
+	emu := NewMuxEmulator(nil, dev)
+	rbuf := make([]byte, 5)
+	msg := MuxiMsg{Chip: 1, Bits: MustParseMuxiBits("1")}
+	tbuf := make([]byte, 5)
+	msg.writeTo(tbuf)
+	emu.Message(rbuf, tbuf)
+	emu.Run(2)
+	if len(dev.written) != 1 || !dev.written[0] {
+		t.Fatalf("device received %v", dev.written)
+	}
+}
+
+func TestMuxEmulatorForwardsReply(t *testing.T) {
+	bits := "1011001110001111"
+	dev := &testDraadDevice{}
+	for i := 0; i < len(bits); i++ {
+		dev.toSend = append(dev.toSend, bits[i] == '1')
+	}
+	emu := NewMuxEmulator(dev, nil)
+	emu.Run(64)
+
+	var stream []byte
+	rbuf := make([]byte, 5)
+	tbuf := make([]byte, 5)
+	for i := 0; i < 4; i++ {
+		emu.Message(rbuf, tbuf)
+		stream = append(stream, rbuf...)
+	}
+	received := MuxiMsg{}
+	for _, msg := range decodeFrames(t, stream) {
+		if msg.Chip != 0 {
+			t.Fatalf("received frame for chip %v", msg.Chip)
+		}
+		if msg.Length() > MUXEMU_MAX_FRAME_BITS {
+			t.Fatalf("frame %v is too long", msg)
+		}
+		received = MuxiMsgJoin(received, msg)
+	}
+	if received.Bits.String() != bits {
+		t.Fatalf("received %v instead of %v", received.Bits, bits)
+	}
+}
+
+func TestMuxEmulatorOverflows(t *testing.T) {
+	emu := NewMuxEmulator(nil, nil)
+	emu.LoopsPerByte = 0
+	rbuf := make([]byte, MUXEMU_SPI_RX_BUFFER_MAX+1)
+	emu.Message(rbuf, make([]byte, len(rbuf)))
+	if _, spiRx := emu.Overflows(); !spiRx {
+		t.Fatal("spi_rx_overflow not set")
+	}
+
+	emu = NewMuxEmulator(nil, nil)
+	msg := MuxiMsg{Chip: 1, Bits: MustParseMuxiBits("11111111")}
+	tbuf := make([]byte, 2)
+	msg.writeTo(tbuf)
+	for i := 0; i < 5; i++ {
+		emu.Message(rbuf[:2], tbuf)
+	}
+	if draadTx, spiRx := emu.Overflows(); !draadTx || spiRx {
+		t.Fatalf("overflows are %v, %v instead of true, false",
+			draadTx, spiRx)
+	}
+}
+
+func TestAvrIntShl(t *testing.T) {
+	for _, c := range []struct {
+		b, n     byte
+		expected int32
+	}{
+		{1, 0, 1},
+		{0x7f, 8, 0x7f00},
+		{0x80, 8, -0x8000}, // sign extended
+		{1, 15, -0x8000},
+		{1, 16, 0}, // shifted out of the 16-bit int
+	} {
+		if got := avrIntShl(c.b, c.n); got != c.expected {
+			t.Errorf("avrIntShl(%v, %v) = %v instead of %v",
+				c.b, c.n, got, c.expected)
+		}
+	}
+}
+
+func TestMuxEmulatorByteGap(t *testing.T) {
+	// Without gaps, the MUX has no time to empty its rx buffer.
+	emu := NewMuxEmulator(nil, nil)
+	emu.LoopsPerByte = 0
+	segments := make([]SpiSegment, 2*MUXEMU_SPI_RX_BUFFER_MAX)
+	for i := range segments {
+		segments[i].RBuf = make([]byte, 1)
+		segments[i].TBuf = make([]byte, 1)
+	}
+	SpiTransfer(emu, segments)
+	if _, spiRx := emu.Overflows(); !spiRx {
+		t.Fatal("spi_rx_overflow not set")
+	}
+
+	emu = NewMuxEmulator(nil, nil)
+	emu.LoopsPerByte = 0
+	for i := range segments {
+		segments[i].DelayUsecs = 1000
+	}
+	SpiTransfer(emu, segments)
+	if _, spiRx := emu.Overflows(); spiRx {
+		t.Fatal("spi_rx_overflow set even though the bytes were spaced")
+	}
+}
+
+func TestMuxEmulatorFourDraads(t *testing.T) {
+	var devs [4]*testDraadDevice
+	for i := range devs {
+		devs[i] = &testDraadDevice{}
+	}
+	devs[2].toSend = []bool{true, false, true}
+	emu := NewMuxEmulator(devs[0], devs[1], devs[2], devs[3])
+
+	msg := MuxiMsg{Chip: 3, Bits: MustParseMuxiBits("1")}
+	tbuf := make([]byte, 5)
+	msg.writeTo(tbuf)
+	rbuf := make([]byte, 5)
+	emu.Message(rbuf, tbuf)
+	emu.Run(16)
+	for i, dev := range devs {
+		if expected := i == 3; (len(dev.written) == 1) != expected {
+			t.Fatalf("device %d received %v", i, dev.written)
+		}
+	}
+
+	var stream []byte
+	for i := 0; i < 2; i++ {
+		emu.Message(rbuf, make([]byte, 5))
+		stream = append(stream, rbuf...)
+	}
+	received := MuxiMsg{Chip: 2}
+	for _, msg := range decodeFrames(t, stream) {
+		if msg.Chip != 2 {
+			t.Fatalf("received frame for chip %v", msg.Chip)
+		}
+		received = MuxiMsgJoin(received, msg)
+	}
+	if received.Bits.String() != "101" {
+		t.Fatalf("received %v", received)
+	}
+}
@@ -1,44 +1,28 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"io"
-	"strings"
+	"sync"
 	"time"
 )
 
+// MuxiMsg is a frame to or from a chip behind the MUX.  A MuxiMsg without
+// bits sent to the MUX asks it for its status, see muxstatus.go.
 type MuxiMsg struct {
-	Bits string
+	Bits MuxiBits
 	Chip byte
 }
 
 func (msg *MuxiMsg) Bool(idx int) bool {
-	return msg.Bits[idx] == "1"[0]
+	return msg.Bits.Bool(idx)
 }
 
 func (msg *MuxiMsg) Length() int {
-	return len(msg.Bits)
+	return msg.Bits.Len
 }
 
 func (msg *MuxiMsg) UintX(idx, length int, lsbFirst bool) uint {
-	return parseBinary(msg.Bits[idx:idx+length], lsbFirst)
-}
-
-func parseBinary(text string, lsbFirst bool) (res uint) {
-	var idx int
-	for i := 0; i < len(text); i++ {
-		if lsbFirst {
-			idx = len(text) - i - 1
-		} else {
-			idx = i
-		}
-		res = res << 1
-		if text[idx] == "1"[0] {
-			res++
-		}
-	}
-	return
+	return msg.Bits.UintX(idx, length, lsbFirst)
 }
 
 func (msg MuxiMsg) String() string {
@@ -46,19 +30,13 @@ func (msg MuxiMsg) String() string {
 }
 
 func (msg *MuxiMsg) Vet() error {
-	if msg.Chip > 1 {
-		return fmt.Errorf("muxi: invalid MuxiMsg: Chip should be 0 or 1.")
+	if msg.Chip >= MUXI_MAX_CHIPS {
+		return fmt.Errorf("muxi: invalid MuxiMsg: Chip should be below 4.")
 	}
-	if len(msg.Bits) > 31 { // 11111
+	if msg.Bits.Len > 31 { // 11111
 		return fmt.Errorf("muxi: invalid MuxiMsg: " +
 			"length of Bits should be below 31")
 	}
-	for i := 0; i < len(msg.Bits); i++ {
-		if msg.Bits[i] != "0"[0] && msg.Bits[i] != "1"[0] {
-			return fmt.Errorf("muxi: invalid MuxiMsg: Bits should consist" +
-				" of only '0' and '1'.")
-		}
-	}
 	return nil
 }
 
@@ -66,17 +44,15 @@ func (msg *MuxiMsg) writeTo(buf []byte) {
 	// assume len(buf) >= 5
 	// write header
 	buf[0] = 1<<7 | byte(msg.Length())<<2 | msg.Chip
-	// write body
+	// write body: the first bit of every byte ends up in its most
+	// significant used bit.
 	var byteIdx, bitsLeft int // 0, 0
-	for i := 0; i < len(msg.Bits); i++ {
+	for i := 0; i < msg.Bits.Len; i++ {
 		if bitsLeft == 0 {
 			byteIdx++
 			bitsLeft = 8
 		}
-		buf[byteIdx] = buf[byteIdx] << 1
-		if msg.Bits[i] == "1"[0] {
-			buf[byteIdx]++
-		}
+		buf[byteIdx] = buf[byteIdx]<<1 | byte(msg.Bits.Word>>uint(i)&1)
 		bitsLeft--
 	}
 }
@@ -90,114 +66,248 @@ func (msg *MuxiMsg) readFrom(buf []byte) error {
 	if header>>7 != 1 {
 		return fmt.Errorf("invalid frame: first bit of the header should be 1")
 	}
-	msg.Chip = header & 3        // pick out 000000xx
-	length := (header >> 2) & 31 // pick out 0xxxxx00
-
-	// read body
-	var byteIdx, bitsLeft int // 0, 0
-	var curByte byte
-
-	s := make([]string, 0, length)
-
-	for length > 0 {
-		if bitsLeft == 0 {
-			byteIdx++
-			curByte = buf[byteIdx]
-			bitsLeft = 8
-		}
-
-		var bit string
-		switch curByte % 2 {
-		case 1:
-			bit = "1"
-		case 0:
-			bit = "0"
-		}
-		s = append(s, bit)
+	msg.Chip = header & 3         // pick out 000000xx
+	length := int(header>>2) & 31 // pick out 0xxxxx00
+	if len(buf) < 1+(length+7)/8 {
+		return fmt.Errorf("invalid frame: truncated body")
+	}
 
-		length--
-		bitsLeft--
-		curByte = curByte >> 1
+	// read body: the bytes are little endian, least significant bit first
+	var word uint64
+	for i := 0; 8*i < length; i++ {
+		word |= uint64(buf[1+i]) << uint(8*i)
 	}
-	msg.Bits = strings.Join(s, "")
+	msg.Bits = MuxiBitsUint(word, length)
 	return nil
 }
 
 func MuxiMsgJoin(msg1, msg2 MuxiMsg) (res MuxiMsg) {
 	// assume msg1.Chip = msg2.Chip
-	// assume msg1.Length + msg2.Length <= 31
 	res.Chip = msg1.Chip
-	res.Bits = msg1.Bits + msg2.Bits
+	res.Bits = msg1.Bits.Append(msg2.Bits)
 	return
 }
 
+// ourMuxiConfig returns how we talk to the MUX in our Bar T2.
+func ourMuxiConfig() MuxiConfig {
+	return MuxiConfig{
+		Chips:           2,
+		PollBytes:       12,
+		ByteGap:         time.Millisecond,
+		PollInterval:    500 * time.Millisecond,
+		MinPollInterval: 20 * time.Millisecond,
+		StatusInterval:  10 * time.Second,
+	}
+}
+
+// MuxiConfig determines how the Muxi polls the MUX.
+type MuxiConfig struct {
+	// Chips is the number of chips behind the MUX, from 1 up to
+	// MUXI_MAX_CHIPS.  Frames for other chips are discarded.
+	Chips int
+
+	// PollBytes is the number of bytes exchanged in every SPI message.
+	// The MUX sends frames of at most 4 bytes, so a poll of n bytes drains
+	// up to n/4 frames.  It should be at least 5 to fit any frame we send.
+	PollBytes int
+
+	// ByteGap is the pause between two bytes of a message, which gives the
+	// MUX the time to process the received byte and to prepare its next
+	// frame.  If zero, the bytes of a message are sent back-to-back.  It
+	// is at most MUXI_MAX_BYTE_GAP.
+	ByteGap time.Duration
+
+	// PollInterval is the time between two polls when the MUX is idle.
+	PollInterval time.Duration
+
+	// MinPollInterval is the time between two polls right after a request
+	// or a poll which returned data.  After every poll which returned
+	// nothing, the interval doubles, up to PollInterval.  If zero, the
+	// MUX is polled every PollInterval.
+	MinPollInterval time.Duration
+
+	// StatusInterval is the time between two requests for the status of
+	// the MUX.  If zero, the Muxi does not ask for it.
+	StatusInterval time.Duration
+}
+
+// MuxiLatency summarises the time between sending a request to a chip and
+// receiving the first frame from that chip.
+type MuxiLatency struct {
+	Count    int
+	Last     time.Duration
+	Min, Max time.Duration
+	Total    time.Duration
+}
+
+func (l MuxiLatency) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+func (l MuxiLatency) String() string {
+	return fmt.Sprintf("%d replies; last %v; mean %v; min %v; max %v",
+		l.Count, l.Last, l.Mean(), l.Min, l.Max)
+}
+
+func (l *MuxiLatency) add(d time.Duration) {
+	if l.Count == 0 || d < l.Min {
+		l.Min = d
+	}
+	if d > l.Max {
+		l.Max = d
+	}
+	l.Count++
+	l.Last = d
+	l.Total += d
+}
+
+// MUXI_MAX_CHIPS is the number of chips the header of a frame can address.
+const MUXI_MAX_CHIPS = 4
+
+// MUXI_MAX_BYTE_GAP is the longest ByteGap: spidev takes the delay after a
+// transfer in microseconds as a 16-bit number.
+const MUXI_MAX_BYTE_GAP = 65535 * time.Microsecond
+
 type Muxi struct {
 	Out <-chan MuxiMsg
 	In  chan<- MuxiMsg
 	Err <-chan error
 
-	spiDevice      *SpiConfiguredDevice
-	receivedWriter *io.PipeWriter
-	messageScanner *bufio.Scanner
-	out, in        chan MuxiMsg
-	closer         chan bool // closer is closed if the muxi is closed
-	err            chan error
-	rbuf, tbuf     [5]byte
-	ticker         *time.Ticker
+	spi        SpiTransport
+	received   chan []byte // the bytes received in every transfer
+	scanner    *MuxiScanner
+	out, in    chan MuxiMsg
+	closer     chan bool // closer is closed if the muxi is closed
+	err        chan error
+	config     MuxiConfig
+	rbuf, tbuf []byte
+	segments   []SpiSegment // rbuf and tbuf split per byte
+	timer      *time.Timer
+	interval   time.Duration // until the next poll
+
+	mutex     sync.Mutex                // protects the following
+	requested [MUXI_MAX_CHIPS]time.Time // of unanswered requests
+	stats     MuxiStats
+}
+
+// MuxiTransferError is sent on Err if a transfer over SPI failed.  It is
+// fatal: the Muxi stops talking to the MUX.
+type MuxiTransferError struct {
+	Err error
 }
 
-func MuxiOpen() (muxi *Muxi, err error) {
-	spidev, err := SpiOpen("/dev/spidev0.0", 1, false, 8, 8192)
+func (e MuxiTransferError) Error() string {
+	return fmt.Sprintf("muxi: transfer failed: %v", e.Err)
+}
+
+// MUXI_SPI_DEVICE is the SPI device of the rPi connected to the MUX.
+const MUXI_SPI_DEVICE = "/dev/spidev0.0"
+
+// MuxiSpiOpen opens the rPi's first SPI device, configured to talk to
+// the MUX.
+func MuxiSpiOpen() (*SpiConfiguredDevice, error) {
+	return SpiOpen(MUXI_SPI_DEVICE, 1, false, 8, 8192)
+}
+
+// MuxiOpen opens the MUX connected to the rPi's first SPI device.
+func MuxiOpen(config MuxiConfig) (muxi *Muxi, err error) {
+	spidev, err := MuxiSpiOpen()
 	if err != nil {
 		return
 	}
+	return MuxiOpenTransport(spidev, config)
+}
 
+// MuxiOpenTransport opens a Muxi that talks to the MUX over the given
+// transport.  The Muxi takes ownership of spi and closes it on Close.
+func MuxiOpenTransport(spi SpiTransport, config MuxiConfig) (muxi *Muxi,
+	err error) {
+	if config.Chips < 1 || config.Chips > MUXI_MAX_CHIPS {
+		return nil, fmt.Errorf("muxi: Chips should be between 1 and %d",
+			MUXI_MAX_CHIPS)
+	}
+	if config.PollBytes < 5 {
+		return nil, fmt.Errorf("muxi: PollBytes should be at least 5")
+	}
+	if config.PollInterval <= 0 {
+		return nil, fmt.Errorf("muxi: PollInterval should be positive")
+	}
+	if config.MinPollInterval < 0 ||
+		config.MinPollInterval > config.PollInterval {
+		return nil, fmt.Errorf("muxi: MinPollInterval should be between " +
+			"0 and PollInterval")
+	}
+	if config.StatusInterval < 0 {
+		return nil, fmt.Errorf("muxi: StatusInterval should not be negative")
+	}
+	if config.ByteGap < 0 || config.ByteGap > MUXI_MAX_BYTE_GAP {
+		return nil, fmt.Errorf("muxi: ByteGap should be between 0 and %v",
+			MUXI_MAX_BYTE_GAP)
+	}
+	if config.MinPollInterval == 0 {
+		config.MinPollInterval = config.PollInterval
+	}
 	muxi = &Muxi{
-		spiDevice: spidev,
-		out:       make(chan MuxiMsg),
-		in:        make(chan MuxiMsg),
-		closer:    make(chan bool),
-		err:       make(chan error),
-		ticker:    time.NewTicker(500 * time.Millisecond),
+		spi:      spi,
+		received: make(chan []byte),
+		scanner:  NewMuxiScanner(config.Chips),
+		out:      make(chan MuxiMsg),
+		in:       make(chan MuxiMsg),
+		closer:   make(chan bool),
+		err:      make(chan error),
+		config:   config,
+		rbuf:     make([]byte, config.PollBytes),
+		tbuf:     make([]byte, config.PollBytes),
+		timer:    time.NewTimer(config.PollInterval),
+		interval: config.PollInterval,
+	}
+	if config.ByteGap > 0 {
+		muxi.segments = make([]SpiSegment, config.PollBytes)
+		for i := range muxi.segments {
+			muxi.segments[i] = SpiSegment{
+				RBuf: muxi.rbuf[i : i+1],
+				TBuf: muxi.tbuf[i : i+1],
+				SpiMessageArgs: SpiMessageArgs{
+					DelayUsecs: uint16(config.ByteGap / time.Microsecond),
+				},
+			}
+		}
 	}
 
 	muxi.Err = muxi.err
 	muxi.In = muxi.in
 	muxi.Out = muxi.out
 
-	reader, writer := io.Pipe()
-	muxi.receivedWriter = writer
-	muxi.messageScanner = bufio.NewScanner(reader)
-	muxi.messageScanner.Split(func(data []byte, atEOF bool) (advance int,
-		token []byte, err error) {
-		if len(data) == 0 {
-			return // 0, nil, nil
-		}
-		if data[0] == 0 {
-			for ; advance < len(data) && data[advance] == 0; advance++ {
-			}
-			return // advance, nil, nil
-		}
-
-		numofbits := (data[0] >> 2) & 31 // pick out 01111100
+	go muxi.doTransfer()
+	go muxi.doProcess()
+	return
+}
 
-		advance += int(numofbits)/8 + 1 // +1 is for the header
-		if numofbits%8 > 0 {
-			advance++
-		}
+// Chips returns the number of chips behind the MUX.
+func (m *Muxi) Chips() int {
+	return m.config.Chips
+}
 
-		if advance > len(data) {
-			advance = 0
-			return // 0, nil, nil
-		}
+// Latency returns how fast the chips replied to requests so far.
+func (m *Muxi) Latency() MuxiLatency {
+	return m.Stats().Latency
+}
 
-		token = data[:advance]
-		return // advance, <frame>, nil
-	})
+// Status returns the last status received from the MUX.  ok is false if
+// the MUX has not sent its status yet.
+func (m *Muxi) Status() (status MuxStatus, ok bool) {
+	stats := m.Stats()
+	return stats.Status, stats.StatusFrames > 0
+}
 
-	go muxi.doTransfer()
-	go muxi.doProcess()
-	return
+// Stats returns a snapshot of the statistics of the link.
+func (m *Muxi) Stats() MuxiStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.stats
 }
 
 func (m *Muxi) Close() error {
@@ -205,64 +315,238 @@ func (m *Muxi) Close() error {
 	return nil
 }
 
+// Discarded returns the number of received bytes that were discarded
+// because they did not form a plausible frame.
+func (m *Muxi) Discarded() uint64 {
+	return m.Stats().Discarded
+}
+
 func (m *Muxi) doProcess() {
-	var msg MuxiMsg
 	for {
-		msg = MuxiMsg{}
-		m.messageScanner.Scan()
-		if len(m.messageScanner.Bytes()) == 0 {
-			return
-		}
-		if err := msg.readFrom(m.messageScanner.Bytes()); err != nil {
-			m.err <- err
-			return
-		}
+		var data []byte
 		select {
-		case m.out <- msg:
+		case data = <-m.received:
 		case _ = <-m.closer:
 			return
 		}
+		m.scanner.Feed(data)
+		for {
+			frame, ok := m.scanner.Next()
+			if !ok {
+				break
+			}
+			if frame[0] == MUXI_STATUS_HEADER {
+				for _, err := range m.processStatus(frame) {
+					select {
+					case m.err <- err:
+					case _ = <-m.closer:
+						return
+					}
+				}
+				continue
+			}
+			var msg MuxiMsg
+			if err := msg.readFrom(frame); err != nil {
+				// can't happen: the scanner only returns valid frames
+				panic(err)
+			}
+			m.replied(msg.Chip)
+			select {
+			case m.out <- msg:
+			case _ = <-m.closer:
+				return
+			}
+		}
+		m.mutex.Lock()
+		m.stats.Discarded = m.scanner.Discarded()
+		m.stats.Rejected = m.scanner.Rejected()
+		m.mutex.Unlock()
+		if n, ok := m.scanner.Resynced(); ok {
+			select {
+			case m.err <- MuxiResyncError{Discarded: n}:
+			case _ = <-m.closer:
+				return
+			}
+		}
+	}
+}
+
+// processStatus accounts for a status frame.  It returns a
+// MuxProtocolError if the MUX speaks another protocol, and a
+// MuxOverflowError if the MUX dropped data.
+func (m *Muxi) processStatus(frame []byte) (errs []error) {
+	status := MuxStatus{Time: time.Now()}
+	if err := status.readFrom(frame); err != nil {
+		// can't happen: the scanner only returns valid frames
+		panic(err)
+	}
+	m.mutex.Lock()
+	m.stats.StatusFrames++
+	m.stats.Status = status
+	if status.DraadTxOverflow {
+		m.stats.DraadTxOverflows++
+	}
+	if status.SpiRxOverflow {
+		m.stats.SpiRxOverflows++
+	}
+	if status.Protocol != MUX_PROTOCOL_VERSION {
+		m.stats.OtherProtocols++
 	}
+	m.mutex.Unlock()
+	if status.Protocol != MUX_PROTOCOL_VERSION {
+		errs = append(errs, MuxProtocolError{Status: status})
+	}
+	if status.Overflowed() {
+		errs = append(errs, MuxOverflowError{Status: status})
+	}
+	return
 }
 
 func (m *Muxi) doTransfer() {
+	var statusTick <-chan time.Time // nil if we do not ask for the status
+	if m.config.StatusInterval > 0 {
+		ticker := time.NewTicker(m.config.StatusInterval)
+		defer ticker.Stop()
+		statusTick = ticker.C
+	}
 	for {
 		select {
+		case _ = <-statusTick:
+			if err := m.transmit(MuxiMsg{}); err != nil {
+				m.fail(err)
+				return
+			}
+			m.schedulePoll(true)
 		case msg := <-m.in:
+			if err := m.vet(msg); err != nil {
+				m.mutex.Lock()
+				m.stats.Invalid++
+				m.mutex.Unlock()
+				select {
+				case m.err <- err:
+				case _ = <-m.closer:
+					m.timer.Stop()
+					m.spi.Close()
+					return
+				}
+				continue
+			}
 			if err := m.transmit(msg); err != nil {
-				m.err <- err
+				m.fail(err)
 				return
 			}
-		case _ = <-m.ticker.C:
-			m.tbuf = [5]byte{0, 0, 0, 0, 0}
+			m.schedulePoll(true)
+		case _ = <-m.timer.C:
+			m.clearTbuf()
 			if err := m.transfer(); err != nil {
-				m.err <- err
+				m.fail(err)
 				return
 			}
+			m.schedulePoll(!allZero(m.rbuf))
 		case _ = <-m.closer:
-			m.receivedWriter.Close()
-			m.ticker.Stop()
-			m.spiDevice.Close()
+			m.timer.Stop()
+			m.spi.Close()
 			return
 		}
 	}
 }
 
-func (m *Muxi) transmit(msg MuxiMsg) error {
+// fail gives up on the transport after err.  Nothing is sent to the MUX
+// anymore, so the Muxi should be closed and opened anew.
+func (m *Muxi) fail(err error) {
+	m.timer.Stop()
+	m.spi.Close()
+	select {
+	case m.err <- MuxiTransferError{Err: err}:
+	case _ = <-m.closer:
+	}
+}
+
+// schedulePoll sets the timer for the next poll.  If busy, we expect more
+// data soon.
+func (m *Muxi) schedulePoll(busy bool) {
+	if busy {
+		m.interval = m.config.MinPollInterval
+	} else if m.interval *= 2; m.interval > m.config.PollInterval {
+		m.interval = m.config.PollInterval
+	}
+	// The timer might have fired while we were transmitting.
+	if !m.timer.Stop() {
+		select {
+		case _ = <-m.timer.C:
+		default:
+		}
+	}
+	m.timer.Reset(m.interval)
+}
+
+func allZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// vet checks whether msg can be sent to the MUX.
+func (m *Muxi) vet(msg MuxiMsg) error {
 	if err := msg.Vet(); err != nil {
 		return err
 	}
-	msg.writeTo(m.tbuf[:])
+	if int(msg.Chip) >= m.config.Chips {
+		return fmt.Errorf("muxi: there is no chip %d", msg.Chip)
+	}
+	return nil
+}
+
+func (m *Muxi) transmit(msg MuxiMsg) error {
+	// writeTo shifts the body into place, so start from a clean buffer.
+	m.clearTbuf()
+	msg.writeTo(m.tbuf)
+	m.mutex.Lock()
+	if msg.Bits.Len > 0 && m.requested[msg.Chip].IsZero() {
+		m.requested[msg.Chip] = time.Now()
+	}
+	m.mutex.Unlock()
 	return m.transfer()
 }
 
+// replied records the latency of the request to chip, if any.
+func (m *Muxi) replied(chip byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.stats.Frames[chip]++
+	if m.requested[chip].IsZero() {
+		return
+	}
+	m.stats.Latency.add(time.Since(m.requested[chip]))
+	m.requested[chip] = time.Time{}
+}
+
+func (m *Muxi) clearTbuf() {
+	for i := range m.tbuf {
+		m.tbuf[i] = 0
+	}
+}
+
 func (m *Muxi) transfer() error {
-	if err := m.spiDevice.Message(m.rbuf[:], m.tbuf[:]); err != nil {
+	if m.segments != nil {
+		if err := SpiTransfer(m.spi, m.segments); err != nil {
+			return err
+		}
+	} else if err := m.spi.Message(m.rbuf, m.tbuf); err != nil {
 		return err
 	}
+	m.mutex.Lock()
+	m.stats.Transfers++
+	m.mutex.Unlock()
 	//fmt.Printf("muxi: received %v; transferred %v\n", m.rbuf, m.tbuf)
-	if _, err := m.receivedWriter.Write(m.rbuf[:]); err != nil {
-		return err
+	received := make([]byte, len(m.rbuf))
+	copy(received, m.rbuf)
+	select {
+	case m.received <- received:
+	case _ = <-m.closer:
 	}
 	return nil
 }
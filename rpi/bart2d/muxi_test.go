@@ -1,18 +1,240 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"testing"
+	"time"
 )
 
+// testMuxiConfig polls with single transfers of 5 bytes.
+func testMuxiConfig() MuxiConfig {
+	return MuxiConfig{Chips: 2, PollBytes: 5,
+		PollInterval: 500 * time.Millisecond}
+}
+
 func ExampleMuxiMsg_String() {
-	msg := MuxiMsg{Chip: 1, Bits: "101"}
+	msg := MuxiMsg{Chip: 1, Bits: MustParseMuxiBits("101")}
 	fmt.Printf("%s", msg)
 	// Output: 101@1
 }
 
-func ExampleMuxiMsg_ReadFromBuf() {
+func ExampleMuxiMsg_readFrom() {
 	msg := &MuxiMsg{}
 	msg.readFrom([]byte{188, 237, 6})
 	fmt.Printf("%s", msg)
 	// Output: 101101110110000@0
 }
+
+func TestMuxiTransmitAndReceive(t *testing.T) {
+	spi := NewFakeSpi()
+	spi.Receive(0, 0, 188, 237, 6)
+	muxi, err := MuxiOpenTransport(spi, testMuxiConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxi.Close()
+
+	muxi.In <- MuxiMsg{Chip: 1, Bits: MuxiBitsUint(1, 1)}
+	select {
+	case msg := <-muxi.Out:
+		if msg.String() != "101101110110000@0" {
+			t.Fatalf("received %v", msg)
+		}
+	case err := <-muxi.Err:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+
+	// Send another request back-to-back, which should not be garbled by
+	// the previous one.
+	muxi.In <- MuxiMsg{Chip: 0, Bits: MuxiBitsUint(1, 1)}
+	muxi.In <- MuxiMsg{Chip: 0, Bits: MuxiBits{}} // waits for the previous transfer
+
+	sent := spi.Sent()
+	expected := [][]byte{{0x85, 1, 0, 0, 0}, {0x84, 1, 0, 0, 0}}
+	for i, tbuf := range expected {
+		if !bytes.Equal(sent[i], tbuf) {
+			t.Fatalf("transfer %d: sent %v instead of %v", i, sent[i], tbuf)
+		}
+	}
+}
+
+func TestMuxiTransportError(t *testing.T) {
+	spi := NewFakeSpi()
+	spi.Fail(errors.New("bus on fire"))
+	muxi, err := MuxiOpenTransport(spi, testMuxiConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxi.Close()
+
+	muxi.In <- MuxiMsg{Chip: 0, Bits: MuxiBitsUint(1, 1)}
+	select {
+	case err := <-muxi.Err:
+		if err, ok := err.(MuxiTransferError); !ok ||
+			err.Err.Error() != "bus on fire" {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("error was not reported")
+	}
+	if !spi.Closed() {
+		t.Fatal("the failed transport was not closed")
+	}
+}
+
+func TestMuxiCloseWithUnreadError(t *testing.T) {
+	spi := NewFakeSpi()
+	muxi, err := MuxiOpenTransport(spi, testMuxiConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nobody reads the error about the message to a chip that is not there.
+	muxi.In <- MuxiMsg{Chip: 7, Bits: MuxiBitsUint(1, 1)}
+	muxi.Close()
+	for start := time.Now(); !spi.Closed(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the transport was not closed")
+		}
+	}
+}
+
+func TestMuxiConfigByteGap(t *testing.T) {
+	for _, gap := range []time.Duration{-time.Microsecond,
+		MUXI_MAX_BYTE_GAP + time.Microsecond} {
+		config := testMuxiConfig()
+		config.ByteGap = gap
+		if _, err := MuxiOpenTransport(NewFakeSpi(), config); err == nil {
+			t.Errorf("opened with ByteGap %v", gap)
+		}
+	}
+}
+
+func TestMuxiByteGap(t *testing.T) {
+	spi := NewFakeSpi()
+	config := testMuxiConfig()
+	config.ByteGap = time.Millisecond
+	muxi, err := MuxiOpenTransport(spi, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxi.Close()
+
+	muxi.In <- MuxiMsg{Chip: 1, Bits: MuxiBitsUint(1, 1)}
+	muxi.In <- MuxiMsg{Chip: 0, Bits: MuxiBits{}} // waits for the previous transfer
+
+	// FakeSpi does not support batches, so the bytes are sent one by one.
+	sent := spi.Sent()
+	if len(sent) < 5 {
+		t.Fatalf("sent %d messages instead of 5", len(sent))
+	}
+	for i, b := range []byte{0x85, 1, 0, 0, 0} {
+		if len(sent[i]) != 1 || sent[i][0] != b {
+			t.Fatalf("message %d: sent %v instead of [%v]", i, sent[i], b)
+		}
+	}
+}
+
+func TestMuxiAdaptivePolling(t *testing.T) {
+	spi := NewFakeSpi()
+	config := testMuxiConfig()
+	config.PollInterval = time.Hour
+	config.MinPollInterval = 20 * time.Millisecond
+	muxi, err := MuxiOpenTransport(spi, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxi.Close()
+
+	// The MUX replies after a while, and then sends nothing.
+	muxi.In <- MuxiMsg{Chip: 1, Bits: MuxiBitsUint(1, 1)}
+	spi.Receive(0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x85, 1)
+	select {
+	case msg := <-muxi.Out:
+		if msg.String() != "1@1" {
+			t.Fatalf("received %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not polled fast after a request")
+	}
+	start := len(spi.Sent())
+
+	// 20, 40, 80, 160, 320ms
+	time.Sleep(300 * time.Millisecond)
+	if polls := len(spi.Sent()) - start; polls < 3 || polls > 5 {
+		t.Fatalf("polled %d times while backing off", polls)
+	}
+	if latency := muxi.Latency(); latency.Count != 1 ||
+		latency.Last < 40*time.Millisecond {
+		t.Fatalf("latency %v", latency)
+	}
+}
+
+func TestMuxiStatus(t *testing.T) {
+	emu := NewMuxEmulator(nil, nil)
+	// Overflow the rx buffer of the MUX before the Muxi asks for the status.
+	emu.LoopsPerByte = 0
+	rbuf := make([]byte, MUXEMU_SPI_RX_BUFFER_MAX+1)
+	emu.Message(rbuf, make([]byte, len(rbuf)))
+	emu.LoopsPerByte = 1
+
+	config := testMuxiConfig()
+	config.PollInterval = 10 * time.Millisecond
+	config.StatusInterval = 20 * time.Millisecond
+	muxi, err := MuxiOpenTransport(emu, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxi.Close()
+
+	select {
+	case err := <-muxi.Err:
+		oerr, ok := err.(MuxOverflowError)
+		if !ok || !oerr.Status.SpiRxOverflow || oerr.Status.DraadTxOverflow {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("overflow was not reported")
+	}
+
+	// The MUX clears its flags once they are sent.
+	time.Sleep(100 * time.Millisecond)
+	status, ok := muxi.Status()
+	if !ok || status.Overflowed() || status.Protocol != MUX_PROTOCOL_VERSION {
+		t.Fatalf("status is %v", status)
+	}
+	stats := muxi.Stats()
+	if stats.StatusFrames < 2 || stats.SpiRxOverflows != 1 ||
+		stats.DraadTxOverflows != 0 {
+		t.Fatalf("stats: %v", stats)
+	}
+}
+
+func TestMuxiOtherProtocol(t *testing.T) {
+	emu := NewMuxEmulator(nil, nil)
+	emu.Protocol = MUX_PROTOCOL_VERSION - 1
+	config := testMuxiConfig()
+	config.PollInterval = 10 * time.Millisecond
+	config.StatusInterval = 20 * time.Millisecond
+	muxi, err := MuxiOpenTransport(emu, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxi.Close()
+
+	select {
+	case err := <-muxi.Err:
+		perr, ok := err.(MuxProtocolError)
+		if !ok || perr.Status.Protocol != MUX_PROTOCOL_VERSION-1 {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the other protocol was not reported")
+	}
+	if stats := muxi.Stats(); stats.OtherProtocols == 0 {
+		t.Fatalf("stats: %v", stats)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// MuxiBits is a packed sequence of at most MUXI_BITS_MAX bits.  Bit i of
+// the sequence is bit i of Word, so the first bit is the least significant
+// one; the bits of Word beyond Len are zero.
+//
+// MuxiBits is a value type and none of its methods allocate, except
+// String and Bytes.
+type MuxiBits struct {
+	Word uint64
+	Len  int
+}
+
+const MUXI_BITS_MAX = 64
+
+// MuxiBitsUint returns the length least significant bits of value, least
+// significant bit first.
+func MuxiBitsUint(value uint64, length int) MuxiBits {
+	return MuxiBits{Word: value & muxiBitsMask(length), Len: length}
+}
+
+// MuxiBitsBytes returns the bits of the bytes, least significant bit
+// first.  It panics if there are more than MUXI_BITS_MAX bits.
+func MuxiBitsBytes(bytes []byte) (b MuxiBits) {
+	for _, x := range bytes {
+		b = b.Append(MuxiBitsUint(uint64(x), 8))
+	}
+	return
+}
+
+// ParseMuxiBits parses a string of '0's and '1's, as returned by String.
+func ParseMuxiBits(text string) (b MuxiBits, err error) {
+	if len(text) > MUXI_BITS_MAX {
+		return b, fmt.Errorf("muxi: more than %d bits", MUXI_BITS_MAX)
+	}
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '1':
+			b.Word |= 1 << uint(i)
+		case '0':
+		default:
+			return MuxiBits{}, fmt.Errorf("muxi: bits should consist " +
+				"of only '0' and '1'")
+		}
+	}
+	b.Len = len(text)
+	return
+}
+
+// MustParseMuxiBits is like ParseMuxiBits, but panics on invalid input.
+func MustParseMuxiBits(text string) MuxiBits {
+	b, err := ParseMuxiBits(text)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func muxiBitsMask(length int) uint64 {
+	if length >= MUXI_BITS_MAX {
+		return ^uint64(0)
+	}
+	return 1<<uint(length) - 1
+}
+
+func (b MuxiBits) String() string {
+	buf := make([]byte, b.Len)
+	for i := range buf {
+		buf[i] = '0' + byte(b.Word>>uint(i)&1)
+	}
+	return string(buf)
+}
+
+func (b MuxiBits) Bool(idx int) bool {
+	if idx < 0 || idx >= b.Len {
+		panic("muxi: bit index out of range")
+	}
+	return b.Word>>uint(idx)&1 == 1
+}
+
+// Bytes is the inverse of MuxiBitsBytes.  The last byte is padded with
+// zeros.
+func (b MuxiBits) Bytes() []byte {
+	ret := make([]byte, (b.Len+7)/8)
+	for i := range ret {
+		ret[i] = byte(b.Word >> uint(8*i))
+	}
+	return ret
+}
+
+// Slice returns the bits from index from up to, but not including, to.
+func (b MuxiBits) Slice(from, to int) MuxiBits {
+	if from < 0 || to < from || to > b.Len {
+		panic("muxi: slice bounds out of range")
+	}
+	if from == MUXI_BITS_MAX {
+		return MuxiBits{}
+	}
+	return MuxiBitsUint(b.Word>>uint(from), to-from)
+}
+
+// Append returns b followed by other.  It panics if the result would be
+// longer than MUXI_BITS_MAX.
+func (b MuxiBits) Append(other MuxiBits) MuxiBits {
+	if b.Len+other.Len > MUXI_BITS_MAX {
+		panic("muxi: too many bits")
+	}
+	if b.Len == MUXI_BITS_MAX {
+		return b
+	}
+	return MuxiBits{
+		Word: b.Word | other.Word<<uint(b.Len),
+		Len:  b.Len + other.Len,
+	}
+}
+
+// AppendBit returns b followed by bit.
+func (b MuxiBits) AppendBit(bit bool) MuxiBits {
+	var word uint64
+	if bit {
+		word = 1
+	}
+	return b.Append(MuxiBits{Word: word, Len: 1})
+}
+
+// UintX interprets length bits starting at idx as an unsigned number.
+func (b MuxiBits) UintX(idx, length int, lsbFirst bool) uint {
+	value := b.Slice(idx, idx+length).Word
+	if !lsbFirst && length > 0 {
+		value = bits.Reverse64(value) >> uint(MUXI_BITS_MAX-length)
+	}
+	return uint(value)
+}
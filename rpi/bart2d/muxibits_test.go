@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ExampleMuxiBits() {
+	b := MustParseMuxiBits("1101").Append(MuxiBitsUint(2, 3))
+	fmt.Println(b, b.Len, b.UintX(0, 4, true), b.UintX(0, 4, false))
+	fmt.Println(b.Slice(3, 6), b.Bool(5))
+	// Output:
+	// 1101010 7 11 13
+	// 101 true
+}
+
+func TestParseMuxiBits(t *testing.T) {
+	for _, text := range []string{"", "0", "1", "0110100111",
+		"1111111111111111111111111111111111111111111111111111111111111111",
+	} {
+		b, err := ParseMuxiBits(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != text {
+			t.Errorf("%q became %q", text, b)
+		}
+	}
+	for _, text := range []string{"012",
+		"11111111111111111111111111111111111111111111111111111111111111111",
+	} {
+		if _, err := ParseMuxiBits(text); err == nil {
+			t.Errorf("no error for %q", text)
+		}
+	}
+}
+
+func TestMuxiBitsAllocations(t *testing.T) {
+	frame := []byte{188, 237, 6}
+	var report ChipiReport
+	allocs := testing.AllocsPerRun(100, func() {
+		var msg1, msg2 MuxiMsg
+		msg1.readFrom(frame)
+		msg2.readFrom(frame)
+		msg := MuxiMsgJoin(msg1, msg2)
+		report.VoltageNo = msg.UintX(0, 10, true)
+		report.Heating = msg.Bool(10)
+		report.BuddyDied = msg.Bool(14)
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations", allocs)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+// Declarative layouts of the bits of MuxiMsgs.
+//
+// The fields of a struct are laid out in the bits of a message with tags
+//
+//	`muxi:"offset,width[,msbfirst][,signed]"`
+//
+// which put the field in width bits from bit offset.  The least
+// significant bit comes first, as is the custom on draad, unless msbfirst
+// is given.  signed sign-extends the bits into an int field; without it an
+// int field holds the bits as an unsigned number.  A bool field is one bit
+// wide.  Fields without a tag are ignored; blank (_) fields reserve bits,
+// which are zero when encoded.  A message is as long as the end of the
+// field that ends last.  For instance
+//
+//	type example struct {
+//		VoltageNo uint `muxi:"0,10"`
+//		Heating   bool `muxi:"10,1"`
+//		_         bool `muxi:"11,5"`
+//	}
+//
+// lays out 16 bits.
+
+import (
+	"fmt"
+	"math/bits"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// muxiField is where a field of a struct is in a message.
+type muxiField struct {
+	index    int // of the field in the struct; -1 if blank
+	name     string
+	kind     reflect.Kind
+	offset   int
+	width    int
+	msbFirst bool
+	signed   bool
+}
+
+type muxiLayout struct {
+	fields []muxiField
+	length int
+}
+
+// muxiLayoutOf parses the tags of the struct type t.
+func muxiLayoutOf(t reflect.Type) (l muxiLayout, err error) {
+	if t.Kind() != reflect.Struct {
+		return l, fmt.Errorf("muxicodec: %v is not a struct", t)
+	}
+	var used uint64
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("muxi")
+		if !ok {
+			continue
+		}
+		f, err := parseMuxiTag(tag)
+		if err != nil {
+			return l, fmt.Errorf("muxicodec: field %s of %v: %v", sf.Name, t,
+				err)
+		}
+		f.name, f.kind, f.index = sf.Name, sf.Type.Kind(), i
+		if sf.Name == "_" {
+			f.index = -1
+		} else if sf.PkgPath != "" {
+			return l, fmt.Errorf("muxicodec: field %s of %v is unexported",
+				sf.Name, t)
+		} else if err := f.vet(sf.Type); err != nil {
+			return l, fmt.Errorf("muxicodec: field %s of %v: %v", sf.Name, t,
+				err)
+		}
+		mask := muxiBitsMask(f.width) << uint(f.offset)
+		if used&mask != 0 {
+			return l, fmt.Errorf("muxicodec: field %s of %v overlaps "+
+				"another field", sf.Name, t)
+		}
+		used |= mask
+		l.fields = append(l.fields, f)
+		if f.offset+f.width > l.length {
+			l.length = f.offset + f.width
+		}
+	}
+	return
+}
+
+func parseMuxiTag(tag string) (f muxiField, err error) {
+	parts := strings.Split(tag, ",")
+	if len(parts) < 2 {
+		return f, fmt.Errorf("tag should be \"offset,width[,options]\"")
+	}
+	if f.offset, err = strconv.Atoi(parts[0]); err != nil {
+		return
+	}
+	if f.width, err = strconv.Atoi(parts[1]); err != nil {
+		return
+	}
+	for _, option := range parts[2:] {
+		switch option {
+		case "msbfirst":
+			f.msbFirst = true
+		case "signed":
+			f.signed = true
+		default:
+			return f, fmt.Errorf("unknown option %q", option)
+		}
+	}
+	if f.offset < 0 || f.width <= 0 || f.offset+f.width > MUXI_BITS_MAX {
+		return f, fmt.Errorf("does not fit %d bits", MUXI_BITS_MAX)
+	}
+	return
+}
+
+// vet checks whether the field fits a field of type t.
+func (f *muxiField) vet(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Bool:
+		if f.width != 1 || f.signed {
+			return fmt.Errorf("bool should be one unsigned bit")
+		}
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		if f.signed {
+			return fmt.Errorf("%v cannot be signed", t)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+	default:
+		return fmt.Errorf("cannot lay out %v", t)
+	}
+	if f.width > t.Bits() {
+		return fmt.Errorf("%d bits do not fit %v", f.width, t)
+	}
+	return nil
+}
+
+// MuxiLayoutLen returns the number of bits of the layout of the struct v.
+func MuxiLayoutLen(v interface{}) (int, error) {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return 0, fmt.Errorf("muxicodec: nil has no layout")
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	l, err := muxiLayoutOf(t)
+	return l.length, err
+}
+
+// UnmarshalMuxiBits decodes b into the struct v points to.  b should be as
+// long as the layout of v.
+func UnmarshalMuxiBits(b MuxiBits, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("muxicodec: can only decode into a pointer")
+	}
+	rv = rv.Elem()
+	l, err := muxiLayoutOf(rv.Type())
+	if err != nil {
+		return err
+	}
+	if b.Len != l.length {
+		return fmt.Errorf("muxicodec: got %d bits instead of %d for %v",
+			b.Len, l.length, rv.Type())
+	}
+	for _, f := range l.fields {
+		if f.index < 0 {
+			continue
+		}
+		value := uint64(b.UintX(f.offset, f.width, !f.msbFirst))
+		field := rv.Field(f.index)
+		switch f.kind {
+		case reflect.Bool:
+			field.SetBool(value == 1)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64:
+			x := int64(value)
+			if f.signed && value>>uint(f.width-1) == 1 {
+				x = int64(value | ^muxiBitsMask(f.width))
+			}
+			field.SetInt(x)
+		default:
+			field.SetUint(value)
+		}
+	}
+	return nil
+}
+
+// MarshalMuxiBits encodes the struct v (or the struct v points to).  It
+// fails if a value does not fit its field.
+func MarshalMuxiBits(v interface{}) (b MuxiBits, err error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if !rv.IsValid() {
+		return b, fmt.Errorf("muxicodec: can not encode %v", v)
+	}
+	l, err := muxiLayoutOf(rv.Type())
+	if err != nil {
+		return
+	}
+	b.Len = l.length
+	for _, f := range l.fields {
+		if f.index < 0 {
+			continue
+		}
+		var value uint64
+		field := rv.Field(f.index)
+		switch f.kind {
+		case reflect.Bool:
+			if field.Bool() {
+				value = 1
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64:
+			x := field.Int()
+			fits := x >= 0 && uint64(x) <= muxiBitsMask(f.width)
+			if f.signed {
+				high := x >> uint(f.width-1)
+				fits = high == 0 || high == -1
+			}
+			if !fits {
+				return b, fmt.Errorf("muxicodec: %s of %d does not fit "+
+					"%d bits", f.name, x, f.width)
+			}
+			value = uint64(x) & muxiBitsMask(f.width)
+		default:
+			value = field.Uint()
+			if value > muxiBitsMask(f.width) {
+				return b, fmt.Errorf("muxicodec: %s of %d does not fit "+
+					"%d bits", f.name, value, f.width)
+			}
+		}
+		if f.msbFirst {
+			value = bits.Reverse64(value) >> uint(MUXI_BITS_MAX-f.width)
+		}
+		b.Word |= value << uint(f.offset)
+	}
+	return
+}
+
+// MuxiUnmarshal decodes the bits of msg into the struct v points to, see
+// UnmarshalMuxiBits.
+func MuxiUnmarshal(msg MuxiMsg, v interface{}) error {
+	return UnmarshalMuxiBits(msg.Bits, v)
+}
+
+// MuxiMarshal encodes the struct v into a message for chip, see
+// MarshalMuxiBits.
+func MuxiMarshal(chip byte, v interface{}) (msg MuxiMsg, err error) {
+	msg.Chip = chip
+	msg.Bits, err = MarshalMuxiBits(v)
+	return
+}
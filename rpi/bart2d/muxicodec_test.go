@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+)
+
+type testLayout struct {
+	A    uint  `muxi:"0,3"`
+	B    bool  `muxi:"3,1"`
+	C    uint8 `muxi:"4,4,msbfirst"`
+	D    int   `muxi:"8,5,signed"`
+	E    int16 `muxi:"13,3"`
+	_    bool  `muxi:"16,4"`
+	Note string
+}
+
+func TestMuxiCodec(t *testing.T) {
+	for _, tc := range []struct {
+		bits string
+		v    testLayout
+	}{
+		{"00000000000000000000", testLayout{}},
+		{"10110000000000000000", testLayout{A: 5, B: true}},
+		{"00001000000000000000", testLayout{C: 8}},
+		{"00000001000000000000", testLayout{C: 1}},
+		{"00000000111110000000", testLayout{D: -1}},
+		{"00000000000010000000", testLayout{D: -16}},
+		{"00000000111100000000", testLayout{D: 15}},
+		{"00000000000000110000", testLayout{E: 6}},
+	} {
+		msg, err := MuxiMarshal(3, tc.v)
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.v, err)
+		}
+		if msg.Chip != 3 || msg.Bits.String() != tc.bits {
+			t.Fatalf("%+v encoded as %v", tc.v, msg)
+		}
+		got := testLayout{Note: "untouched"}
+		if err := MuxiUnmarshal(msg, &got); err != nil {
+			t.Fatal(err)
+		}
+		tc.v.Note = "untouched"
+		if got != tc.v {
+			t.Fatalf("%s decoded as %+v instead of %+v", tc.bits, got, tc.v)
+		}
+	}
+
+	// Reserved bits are ignored.
+	var got testLayout
+	if err := UnmarshalMuxiBits(MustParseMuxiBits("00000000000000001111"),
+		&got); err != nil || got != (testLayout{}) {
+		t.Fatalf("%+v, %v", got, err)
+	}
+	if err := UnmarshalMuxiBits(MustParseMuxiBits("0000"), &got); err == nil {
+		t.Fatal("decoded too few bits")
+	}
+	if err := UnmarshalMuxiBits(MuxiBits{}, got); err == nil {
+		t.Fatal("decoded into a value")
+	}
+	for _, v := range []testLayout{{A: 8}, {D: 16}, {D: -17}, {E: -1}} {
+		if _, err := MarshalMuxiBits(v); err == nil {
+			t.Errorf("encoded %+v", v)
+		}
+	}
+	for _, v := range []interface{}{nil, (*testLayout)(nil)} {
+		if _, err := MarshalMuxiBits(v); err == nil {
+			t.Errorf("encoded %#v", v)
+		}
+	}
+	var unexported struct {
+		a bool `muxi:"0,1"`
+	}
+	if err := UnmarshalMuxiBits(MustParseMuxiBits("1"),
+		&unexported); err == nil {
+		t.Fatal("decoded into an unexported field")
+	}
+}
+
+func TestMuxiCodecLayouts(t *testing.T) {
+	for _, v := range []interface{}{
+		3,
+		struct {
+			A uint `muxi:"0"`
+		}{},
+		struct {
+			A uint `muxi:"0,x"`
+		}{},
+		struct {
+			A uint `muxi:"60,5"`
+		}{},
+		struct {
+			A uint `muxi:"0,3,lsbfirst"`
+		}{},
+		struct {
+			A uint `muxi:"0,3,signed"`
+		}{},
+		struct {
+			A bool `muxi:"0,2"`
+		}{},
+		struct {
+			A uint8 `muxi:"0,9"`
+		}{},
+		struct {
+			A string `muxi:"0,8"`
+		}{},
+		struct {
+			A uint `muxi:"0,4"`
+			B uint `muxi:"3,4"`
+		}{},
+		struct {
+			a uint `muxi:"0,4"`
+		}{},
+		nil,
+	} {
+		if _, err := MuxiLayoutLen(v); err == nil {
+			t.Errorf("%#v passed", v)
+		}
+	}
+	for _, v := range []interface{}{&testLayout{}, (*testLayout)(nil)} {
+		if n, err := MuxiLayoutLen(v); n != 20 || err != nil {
+			t.Fatalf("length %d, %v", n, err)
+		}
+	}
+}
+
+func TestNewChipCommand(t *testing.T) {
+	cmd, err := NewChipCommand(CMD_SET_THRESHOLD,
+		thresholdPayload{THRESHOLD_TARGET, 790})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.String() != "op 3 [1 22 3]" {
+		t.Fatalf("got %v", cmd)
+	}
+	var p thresholdPayload
+	if err := cmd.DecodePayload(&p); err != nil ||
+		p != (thresholdPayload{THRESHOLD_TARGET, 790}) {
+		t.Fatalf("decoded %+v, %v", p, err)
+	}
+	if _, err := NewChipCommand(CMD_STATUS, struct {
+		A uint `muxi:"0,4"`
+	}{}); err == nil {
+		t.Fatal("payload of 4 bits")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+)
+
+// MuxiScanner splits the stream of bytes received from the MUX into frames.
+//
+// Between frames the MUX sends zeroes.  A frame is a header byte
+// 1<<7 | length<<2 | chip followed by length bits, padded with zero bits to
+// a whole number of bytes.  The MUX never sends an empty frame, nor one
+// longer than MUXI_MAX_FRAME_BITS.  The exception is the status frame,
+// whose header is MUXI_STATUS_HEADER, see muxstatus.go.
+//
+// A corrupted byte may make garbage look like a header, or a header look
+// like garbage.  Whenever the scanner runs into an implausible frame, it
+// discards bytes up to and including the next zero, and resynchronises on
+// the first header after it.
+type MuxiScanner struct {
+	// Chips is the number of chips behind the MUX.  Frames for other chips
+	// are implausible.
+	Chips int
+
+	buf       []byte
+	resyncing bool
+	discarded uint64 // in total
+	rejected  uint64 // implausible frames, in total
+	pending   int    // discarded since the last call to Resynced
+}
+
+// MUXI_MAX_FRAME_BITS is the length of the longest frame the MUX sends,
+// see mux.c.
+const MUXI_MAX_FRAME_BITS = 24
+
+// MuxiResyncError reports that bytes were discarded to get back in sync
+// with the frames sent by the MUX.  It is not fatal.
+type MuxiResyncError struct {
+	Discarded int
+}
+
+func (e MuxiResyncError) Error() string {
+	return fmt.Sprintf("muxi: discarded %d bytes to resynchronise",
+		e.Discarded)
+}
+
+func NewMuxiScanner(chips int) *MuxiScanner {
+	return &MuxiScanner{Chips: chips}
+}
+
+// Feed appends received bytes to the stream.
+func (s *MuxiScanner) Feed(data []byte) {
+	s.buf = append(s.buf, data...)
+}
+
+// Next returns the next complete frame, if any.  The frame is only valid
+// until the next call to Feed.
+func (s *MuxiScanner) Next() (frame []byte, ok bool) {
+	for len(s.buf) > 0 {
+		if s.resyncing {
+			if s.buf[0] == 0 {
+				s.resyncing = false
+			}
+			s.discard(1)
+			continue
+		}
+		if s.buf[0] == 0 {
+			s.buf = s.buf[1:]
+			continue
+		}
+
+		header := s.buf[0]
+		if header == MUXI_STATUS_HEADER {
+			size := 1 + MUXI_STATUS_BYTES
+			if size > len(s.buf) {
+				return nil, false
+			}
+			frame = s.buf[:size]
+			s.buf = s.buf[size:]
+			return frame, true
+		}
+		length := int(header>>2) & 31
+		chip := int(header & 3)
+		if header&128 == 0 || length == 0 ||
+			length > MUXI_MAX_FRAME_BITS || chip >= s.Chips {
+			s.reject()
+			continue
+		}
+		size := 1 + (length+7)/8
+		if size > len(s.buf) {
+			return nil, false
+		}
+		frame = s.buf[:size]
+		// The padding of the last byte should be zero.
+		if padding := uint(8*(size-1) - length); padding > 0 &&
+			frame[size-1]>>(8-padding) != 0 {
+			s.reject()
+			continue
+		}
+		s.buf = s.buf[size:]
+		return frame, true
+	}
+	s.buf = s.buf[:0]
+	return nil, false
+}
+
+// reject discards the implausible frame at the start of the buffer.
+func (s *MuxiScanner) reject() {
+	s.rejected++
+	s.resyncing = true
+	s.discard(1)
+}
+
+func (s *MuxiScanner) discard(n int) {
+	s.buf = s.buf[n:]
+	s.discarded += uint64(n)
+	s.pending += n
+}
+
+// Discarded returns the number of bytes discarded so far.
+func (s *MuxiScanner) Discarded() uint64 {
+	return s.discarded
+}
+
+// Rejected returns the number of implausible frames so far.
+func (s *MuxiScanner) Rejected() uint64 {
+	return s.rejected
+}
+
+// Resynced returns the number of bytes discarded since the last call, if
+// the scanner is in sync again.
+func (s *MuxiScanner) Resynced() (discarded int, ok bool) {
+	if s.pending == 0 || s.resyncing {
+		return 0, false
+	}
+	discarded = s.pending
+	s.pending = 0
+	return discarded, true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMuxiScanner(t *testing.T) {
+	for _, c := range []struct {
+		stream    []byte
+		frames    string // as MuxiMsgs and MuxStatuses
+		discarded uint64
+	}{
+		{[]byte{0, 0, 188, 237, 6, 0}, "[101101110110000@0]", 0},
+		// back-to-back frames
+		{[]byte{0x85, 1, 0x84, 0}, "[1@1 0@0]", 0},
+		// chip 2 does not exist
+		{[]byte{0x86, 1, 0, 0x85, 1}, "[1@1]", 3},
+		// empty frame; the resync swallows the next frame
+		{[]byte{0x80, 0x85, 1, 0, 0x84, 0}, "[0@0]", 4},
+		// frame too long
+		{[]byte{0xf8, 1, 2, 3, 4, 0, 0x85, 1}, "[1@1]", 6},
+		// status frame, which may contain zeroes
+		{[]byte{0x85, 1, 0xfc, 0, 2, 0x84, 0}, "[1@1 protocol 2 0@0]", 0},
+		{[]byte{0xfc, 3, 2}, "[protocol 2 DraadTxOverflow SpiRxOverflow]",
+			0},
+		// non-zero padding
+		{[]byte{0x85, 3, 0, 0x85, 1}, "[1@1]", 3},
+		// truncated frame
+		{[]byte{0, 188, 237}, "[]", 0},
+	} {
+		s := NewMuxiScanner(2)
+		var msgs []fmt.Stringer
+		// Feed the bytes one by one, to check frames split over feeds.
+		for _, b := range c.stream {
+			s.Feed([]byte{b})
+			for {
+				frame, ok := s.Next()
+				if !ok {
+					break
+				}
+				if frame[0] == MUXI_STATUS_HEADER {
+					var status MuxStatus
+					if err := status.readFrom(frame); err != nil {
+						t.Fatal(err)
+					}
+					msgs = append(msgs, status)
+					continue
+				}
+				var msg MuxiMsg
+				if err := msg.readFrom(frame); err != nil {
+					t.Fatal(err)
+				}
+				msgs = append(msgs, msg)
+			}
+		}
+		if got := fmt.Sprint(msgs); got != c.frames {
+			t.Errorf("%v: got frames %v instead of %v", c.stream, got,
+				c.frames)
+		}
+		if s.Discarded() != c.discarded {
+			t.Errorf("%v: discarded %d bytes instead of %d", c.stream,
+				s.Discarded(), c.discarded)
+		}
+	}
+}
+
+func TestMuxiResync(t *testing.T) {
+	spi := NewFakeSpi()
+	spi.Receive(0xf8, 0xff, 0, 0x85, 1)
+	config := testMuxiConfig()
+	config.PollInterval = 10 * time.Millisecond
+	muxi, err := MuxiOpenTransport(spi, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxi.Close()
+
+	var gotErr, gotMsg bool
+	for !gotErr || !gotMsg {
+		select {
+		case msg := <-muxi.Out:
+			if msg.String() != "1@1" {
+				t.Fatalf("received %v", msg)
+			}
+			gotMsg = true
+		case err := <-muxi.Err:
+			if err != (MuxiResyncError{Discarded: 3}) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			gotErr = true
+		case <-time.After(time.Second):
+			t.Fatal("Muxi did not recover")
+		}
+	}
+	if muxi.Discarded() != 3 {
+		t.Fatalf("Discarded() = %d instead of 3", muxi.Discarded())
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+// The status of the MUX.
+//
+// A frame without body (header 1<<7 | 0<<2 | chip) asks the MUX for its
+// status.  The MUX replies with a status frame: the header
+// MUXI_STATUS_HEADER, which has the length 31 no ordinary frame has,
+// followed by MUXI_STATUS_BYTES bytes:
+//
+//	flags     bit 0: draad_tx_overflow, bit 1: spi_rx_overflow
+//	protocol  the version of the protocol spoken by the MUX
+//
+// The MUX clears its overflow flags once it has sent them, so every
+// status frame reports the overflows since the previous one.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	MUXI_STATUS_HEADER = 1<<7 | 31<<2 // chip 0
+	MUXI_STATUS_BYTES  = 2
+
+	MUXI_STATUS_DRAAD_TX_OVERFLOW = 1 << 0
+	MUXI_STATUS_SPI_RX_OVERFLOW   = 1 << 1
+)
+
+// MuxStatus is the status reported by the MUX.
+type MuxStatus struct {
+	Time time.Time // when it was received
+
+	// DraadTxOverflow is set if the MUX dropped a frame for a chip,
+	// because its buffer for that draad was full.
+	DraadTxOverflow bool
+
+	// SpiRxOverflow is set if the MUX dropped bytes received over SPI,
+	// because it did not process them fast enough; see ByteGap.
+	SpiRxOverflow bool
+
+	Protocol int
+}
+
+func (s MuxStatus) String() string {
+	flags := []string{fmt.Sprintf("protocol %d", s.Protocol)}
+	if s.DraadTxOverflow {
+		flags = append(flags, "DraadTxOverflow")
+	}
+	if s.SpiRxOverflow {
+		flags = append(flags, "SpiRxOverflow")
+	}
+	return strings.Join(flags, " ")
+}
+
+// Overflowed returns whether the MUX dropped any data.
+func (s MuxStatus) Overflowed() bool {
+	return s.DraadTxOverflow || s.SpiRxOverflow
+}
+
+// readFrom decodes a status frame, as returned by the MuxiScanner.
+func (s *MuxStatus) readFrom(frame []byte) error {
+	if len(frame) != 1+MUXI_STATUS_BYTES || frame[0] != MUXI_STATUS_HEADER {
+		return fmt.Errorf("invalid status frame")
+	}
+	s.DraadTxOverflow = frame[1]&MUXI_STATUS_DRAAD_TX_OVERFLOW != 0
+	s.SpiRxOverflow = frame[1]&MUXI_STATUS_SPI_RX_OVERFLOW != 0
+	s.Protocol = int(frame[2])
+	return nil
+}
+
+// MuxProtocolError reports that the MUX speaks another protocol than
+// MUX_PROTOCOL_VERSION: it runs other firmware than we expect.
+type MuxProtocolError struct {
+	Status MuxStatus
+}
+
+func (e MuxProtocolError) Error() string {
+	return fmt.Sprintf("muxi: the MUX speaks protocol %d instead of %d",
+		e.Status.Protocol, MUX_PROTOCOL_VERSION)
+}
+
+// MuxOverflowError reports that the MUX dropped data.  It is not fatal,
+// but the requests of the chips involved will time out.
+type MuxOverflowError struct {
+	Status MuxStatus
+}
+
+func (e MuxOverflowError) Error() string {
+	var what []string
+	if e.Status.DraadTxOverflow {
+		what = append(what, "a frame for a chip")
+	}
+	if e.Status.SpiRxOverflow {
+		what = append(what, "bytes received over SPI")
+	}
+	return fmt.Sprintf("muxi: the MUX dropped %s",
+		strings.Join(what, " and "))
+}
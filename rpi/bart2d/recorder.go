@@ -0,0 +1,269 @@
+package main
+
+// Recording and replaying of the raw bytes exchanged with the MUX.
+//
+// A recording is a text file with one SPI message per line:
+//
+//     <ns since the start of the recording> <rbuf in hex> <tbuf in hex>
+//
+// Lines starting with # are comments.  The offsets are measured with the
+// monotonic clock, so they are not affected by changes to the wall clock.
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RECORDING_TIME_LAYOUT = "2006-01-02T15-04-05"
+
+// SpiRecord is a single recorded SPI message.
+type SpiRecord struct {
+	Offset time.Duration // since the start of the recording
+	Rx, Tx []byte
+}
+
+func (r SpiRecord) String() string {
+	return fmt.Sprintf("%d %x %x", int64(r.Offset), r.Rx, r.Tx)
+}
+
+func parseSpiRecord(line string) (r SpiRecord, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		err = fmt.Errorf("expected 3 fields, got %d", len(fields))
+		return
+	}
+	offset, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return
+	}
+	r.Offset = time.Duration(offset)
+	if r.Rx, err = hex.DecodeString(fields[1]); err != nil {
+		return
+	}
+	r.Tx, err = hex.DecodeString(fields[2])
+	return
+}
+
+// Recorder writes SPI messages to a recording.
+type Recorder struct {
+	Path string
+
+	mutex sync.Mutex
+	file  *os.File
+	start time.Time
+}
+
+// RecorderOpen starts a new recording in the recordings directory.
+func RecorderOpen(dir Dir) (r *Recorder, err error) {
+	start := time.Now()
+	pth := path.Join(dir.Recordings(),
+		start.Format(RECORDING_TIME_LAYOUT)+".rec")
+	file, err := os.OpenFile(pth, os.O_CREATE|os.O_EXCL|os.O_WRONLY,
+		DIR_DEFAULT_FILEMODE)
+	if err != nil {
+		return
+	}
+	r = &Recorder{Path: pth, file: file, start: start}
+	_, err = fmt.Fprintf(file, "# bart2d recording started at %s\n",
+		start.Format(time.RFC3339Nano))
+	return
+}
+
+// Record appends a message to the recording.
+func (r *Recorder) Record(rbuf, tbuf []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	rec := SpiRecord{Offset: time.Since(r.start), Rx: rbuf, Tx: tbuf}
+	_, err := fmt.Fprintln(r.file, rec)
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Close()
+}
+
+// RecordingSpi is an SpiTransport which records all messages exchanged
+// over another SpiTransport.
+type RecordingSpi struct {
+	Transport SpiTransport
+	Recorder  *Recorder
+}
+
+func (s *RecordingSpi) Message(rbuf, tbuf []byte) error {
+	if err := s.Transport.Message(rbuf, tbuf); err != nil {
+		return err
+	}
+	if err := s.Recorder.Record(rbuf, tbuf); err != nil {
+		return WrapErr(err, "Could not record SPI message")
+	}
+	return nil
+}
+
+// Transfer submits the segments and records them as a single message.
+func (s *RecordingSpi) Transfer(segments []SpiSegment) error {
+	if err := SpiTransfer(s.Transport, segments); err != nil {
+		return err
+	}
+	var rbuf, tbuf []byte
+	for _, seg := range segments {
+		rbuf = append(rbuf, seg.RBuf...)
+		tbuf = append(tbuf, seg.TBuf...)
+	}
+	if err := s.Recorder.Record(rbuf, tbuf); err != nil {
+		return WrapErr(err, "Could not record SPI message")
+	}
+	return nil
+}
+
+// Close closes both the transport and the recording.
+func (s *RecordingSpi) Close() error {
+	err1 := s.Transport.Close()
+	err2 := s.Recorder.Close()
+	return WrapErrs([]error{err1, err2}, "Could not close RecordingSpi")
+}
+
+// ReplaySpi is an SpiTransport which plays back the bytes received in
+// a recording.  The received bytes are treated as a stream: they are
+// handed out in order regardless of the size of the messages, and what
+// is transmitted is ignored.  When the recording is exhausted, Message
+// returns io.EOF.
+type ReplaySpi struct {
+	Records []SpiRecord
+
+	// Realtime makes the replay keep to the timing of the recording: the
+	// bytes of a record are not handed out before its offset has passed
+	// since the first Message.  Until then, Message receives zeroes, as
+	// from an idle MUX.
+	Realtime bool
+
+	mutex sync.Mutex
+	next  int       // the record with the next bytes to hand out
+	pos   int       // of the next byte in Records[next].Rx
+	start time.Time // of the first Message
+}
+
+// ReplayOpen reads the named recording.
+func ReplayOpen(name string) (s *ReplaySpi, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	s = &ReplaySpi{}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rec, err := parseSpiRecord(line)
+		if err != nil {
+			return nil, WrapErr(err, "%s:%d", name, lineNo)
+		}
+		s.Records = append(s.Records, rec)
+	}
+	err = scanner.Err()
+	return
+}
+
+func (s *ReplaySpi) Message(rbuf, tbuf []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.next == len(s.Records) {
+		return io.EOF
+	}
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	n := 0
+	for n < len(rbuf) && s.next < len(s.Records) {
+		rec := s.Records[s.next]
+		if s.Realtime && time.Since(s.start) <
+			rec.Offset-s.Records[0].Offset {
+			break
+		}
+		m := copy(rbuf[n:], rec.Rx[s.pos:])
+		n += m
+		if s.pos += m; s.pos == len(rec.Rx) {
+			s.next, s.pos = s.next+1, 0
+		}
+	}
+	for i := n; i < len(rbuf); i++ {
+		rbuf[i] = 0
+	}
+	return nil
+}
+
+func (s *ReplaySpi) Close() error {
+	return nil
+}
+
+// cmdReplay implements `bart2d replay <file>'.
+func cmdReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	chips := flags.Int("chips", ourConfig().Chips,
+		"number of chips behind the MUX")
+	protocol := flags.Int("protocol", CTRL_PROTOCOL_VERSION,
+		"protocol of the firmware of the chips in the recording")
+	realtime := flags.Bool("realtime", false,
+		"replay at the pace of the recording")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: bart2d replay [-chips n] [-protocol n] " +
+			"[-realtime] <file>")
+	}
+	schema, ok := ourReportSchemas().ByProtocol(*protocol)
+	if !ok {
+		return fmt.Errorf("there is no protocol %d", *protocol)
+	}
+	replay, err := ReplayOpen(flags.Arg(0))
+	if err != nil {
+		return WrapErr(err, "Could not open recording")
+	}
+	replay.Realtime = *realtime
+	config := ourMuxiConfig()
+	config.Chips = *chips
+	muxi, err := MuxiOpenTransport(replay, config)
+	if err != nil {
+		return err
+	}
+	var chipi *Chipi
+	if schema.Raw {
+		chipi, err = ChipiOpenRaw(muxi, nil, schema)
+	} else {
+		chipi, err = ChipiOpenMuxi(muxi, nil)
+	}
+	if err != nil {
+		return WrapErr(err, "Could not open Chipi")
+	}
+	defer chipi.Close()
+	return replayReports(chipi, os.Stdout)
+}
+
+// replayReports writes the reports of chipi to w until the Muxi runs out
+// of recording.
+func replayReports(chipi *Chipi, w io.Writer) error {
+	for {
+		select {
+		case err := <-chipi.Err:
+			if te, ok := err.(MuxiTransferError); ok && te.Err == io.EOF {
+				return nil
+			}
+			fmt.Fprintf(w, "!! chipi error: %v\n", err)
+		case report := <-chipi.Reports:
+			fmt.Fprintf(w, "%s -- %s\n", report, report.Msg)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bart2d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir, err := DirOpenAt(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := RecorderOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeSpi()
+	fake.Receive(188, 237, 6, 0, 0, 0x84)
+	spi := &RecordingSpi{Transport: fake, Recorder: recorder}
+	rbuf := make([]byte, 5)
+	spi.Message(rbuf, []byte{0x85, 1, 0, 0, 0})
+	spi.Message(rbuf, []byte{0, 0, 0, 0, 0})
+	if err := spi.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := ReplayOpen(recorder.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replay.Records) != 2 {
+		t.Fatalf("recorded %d messages instead of 2", len(replay.Records))
+	}
+	if !bytes.Equal(replay.Records[0].Tx, []byte{0x85, 1, 0, 0, 0}) {
+		t.Fatalf("recorded tbuf %v", replay.Records[0].Tx)
+	}
+	if replay.Records[1].Offset < replay.Records[0].Offset {
+		t.Fatal("offsets are not monotonic")
+	}
+
+	// The replay hands out the received bytes as a stream.
+	rbuf = make([]byte, 7)
+	replay.Message(rbuf, make([]byte, 7))
+	if !bytes.Equal(rbuf, []byte{188, 237, 6, 0, 0, 0x84, 0}) {
+		t.Fatalf("replayed %v", rbuf)
+	}
+	replay.Message(rbuf, make([]byte, 7))
+	if err := replay.Message(rbuf, make([]byte, 7)); err != io.EOF {
+		t.Fatalf("replay returned %v instead of EOF", err)
+	}
+}
+
+func TestReplayRealtime(t *testing.T) {
+	replay := &ReplaySpi{
+		Records: []SpiRecord{
+			{Offset: time.Second, Rx: []byte{1, 2}},
+			{Offset: time.Second + 50*time.Millisecond, Rx: []byte{3}},
+		},
+		Realtime: true,
+	}
+	rbuf := make([]byte, 3)
+	start := time.Now()
+	if err := replay.Message(rbuf, make([]byte, 3)); err != nil ||
+		!bytes.Equal(rbuf, []byte{1, 2, 0}) {
+		t.Fatalf("replayed %v, %v", rbuf, err)
+	}
+	for rbuf[0] != 3 {
+		time.Sleep(time.Millisecond)
+		if err := replay.Message(rbuf, make([]byte, 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("the second record came too soon")
+	}
+	if err := replay.Message(rbuf, make([]byte, 3)); err != io.EOF {
+		t.Fatalf("replay returned %v instead of EOF", err)
+	}
+}
+
+// capturingSpi keeps the bytes received from Transport as records.
+type capturingSpi struct {
+	Transport SpiTransport
+
+	mutex   sync.Mutex
+	records []SpiRecord
+}
+
+func (s *capturingSpi) Message(rbuf, tbuf []byte) error {
+	if err := s.Transport.Message(rbuf, tbuf); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = append(s.records, SpiRecord{
+		Rx: append([]byte(nil), rbuf...),
+		Tx: append([]byte(nil), tbuf...),
+	})
+	return nil
+}
+
+func (s *capturingSpi) Close() error {
+	return nil
+}
+
+func TestReplayToTheEnd(t *testing.T) {
+	config := MuxiConfig{
+		Chips:        2,
+		PollBytes:    12,
+		PollInterval: time.Millisecond,
+	}
+	schema, _ := ourReportSchemas().ByProtocol(1)
+	spi := &capturingSpi{Transport: NewMuxEmulator(
+		&rawCtrl{status: 1<<11 | 500},
+		&rawCtrl{status: 1<<10 | 1<<11 | 300})}
+	muxi, err := MuxiOpenTransport(spi, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chipi, err := ChipiOpenRaw(muxi, nil, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 4; n++ {
+		select {
+		case <-chipi.Reports:
+		case err := <-chipi.Err:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no report")
+		}
+	}
+	chipi.Close()
+	spi.mutex.Lock()
+	replay := &ReplaySpi{Records: spi.records}
+	spi.mutex.Unlock()
+
+	muxi, err = MuxiOpenTransport(replay, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chipi, err = ChipiOpenRaw(muxi, nil, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chipi.Close()
+	var out bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- replayReports(chipi, &out)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay did not stop at the end of the recording")
+	}
+	if !strings.Contains(out.String(), " -- ") {
+		t.Fatalf("replayed no reports: %q", out.String())
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+// Layouts of the status reports of the revisions of ctrl.c.
+//
+// Every revision of the protocol of the controllers (PROTOCOL in the
+// Makefile of ctrl.c) registers the layout of its status report in
+// ourReportSchemas.  A Chipi asks a chip for its protocol with CMD_VERSION
+// and decodes its reports accordingly.  If the chip does not tell, or its
+// report does not fit, the Chipi picks a schema by the length of the
+// report.  A chip which does not reply to commands at all is asked for its
+// report in the raw way of protocol 1.  Thus chips with old and new
+// firmware can be mixed while upgrading.  Never change a registered
+// schema: recordings made with it should stay decodable.
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ReportSchema is the layout of the status report of a revision of the
+// protocol of the controllers.
+type ReportSchema struct {
+	Protocol int // PROTOCOL of ctrl.c
+
+	// Raw is set if the chips send the report by itself in reply to
+	// a single 1 bit, instead of in reply to CMD_STATUS.
+	Raw bool
+
+	// Layout is a struct laid out with muxi tags, see muxicodec.go.  Its
+	// fields are copied into the fields of ChipiReport of the same name.
+	Layout interface{}
+}
+
+// chipiReportOwnFields are the fields of ChipiReport filled by the Chipi,
+// rather than by the chips.
+var chipiReportOwnFields = []string{"Time", "Chip", "TempC", "Protocol",
+	"Msg"}
+
+func (s *ReportSchema) Vet() error {
+	if s.Protocol <= 0 {
+		return fmt.Errorf("reportschema: Protocol should be positive")
+	}
+	if s.Layout == nil {
+		return fmt.Errorf("reportschema: Layout should be set")
+	}
+	t := reflect.TypeOf(s.Layout)
+	l, err := muxiLayoutOf(t)
+	if err != nil {
+		return err
+	}
+	if !s.Raw && (l.length > 8*CMD_MAX_PAYLOAD || l.length%8 != 0) {
+		return fmt.Errorf("reportschema: a report of %d bits does not fit "+
+			"the reply to CMD_STATUS", l.length)
+	}
+	report := reflect.TypeOf(ChipiReport{})
+	for _, f := range l.fields {
+		if f.index < 0 {
+			continue
+		}
+		rf, ok := report.FieldByName(f.name)
+		if !ok {
+			return fmt.Errorf("reportschema: ChipiReport has no %s", f.name)
+		}
+		for _, own := range chipiReportOwnFields {
+			if f.name == own {
+				return fmt.Errorf("reportschema: %s is not sent by the "+
+					"chips", f.name)
+			}
+		}
+		if !t.Field(f.index).Type.ConvertibleTo(rf.Type) {
+			return fmt.Errorf("reportschema: %s should be %v", f.name,
+				rf.Type)
+		}
+	}
+	return nil
+}
+
+// Bits returns the length of a report.
+func (s *ReportSchema) Bits() int {
+	n, _ := MuxiLayoutLen(s.Layout)
+	return n
+}
+
+// Decode fills the fields of r from the report bits.
+func (s *ReportSchema) Decode(bits MuxiBits, r *ChipiReport) error {
+	t := reflect.TypeOf(s.Layout)
+	l, err := muxiLayoutOf(t)
+	if err != nil {
+		return err
+	}
+	layout := reflect.New(t)
+	if err := UnmarshalMuxiBits(bits, layout.Interface()); err != nil {
+		return err
+	}
+	report := reflect.ValueOf(r).Elem()
+	for _, f := range l.fields {
+		if f.index < 0 {
+			continue
+		}
+		field := report.FieldByName(f.name)
+		field.Set(layout.Elem().Field(f.index).Convert(field.Type()))
+	}
+	r.Protocol = s.Protocol
+	return nil
+}
+
+// ctrlStatus is struct status of ctrl.c.
+type ctrlStatus struct {
+	VoltageNo uint `muxi:"0,10"`
+	Heating   bool `muxi:"10,1"`
+	OK        bool `muxi:"11,1"`
+	TempLow   bool `muxi:"12,1"`
+	TempHigh  bool `muxi:"13,1"`
+	BuddyDied bool `muxi:"14,1"`
+	_         bool `muxi:"15,1"`
+}
+
+// ourReportSchemas returns the schemas of all revisions of ctrl.c.
+func ourReportSchemas() *ReportSchemas {
+	schemas := &ReportSchemas{}
+	for _, s := range []ReportSchema{
+		// The chips sent their status whenever the rPi wrote a 1.
+		{Protocol: 1, Raw: true, Layout: ctrlStatus{}},
+		// The command protocol, see cmdi.go.
+		{Protocol: 2, Layout: ctrlStatus{}},
+	} {
+		if err := schemas.Register(s); err != nil {
+			panic(err)
+		}
+	}
+	return schemas
+}
+
+// ReportSchemas is a registry of ReportSchemas.
+type ReportSchemas struct {
+	schemas []ReportSchema
+}
+
+// Register adds a schema to the registry.  There can only be one schema
+// per protocol.
+func (r *ReportSchemas) Register(s ReportSchema) error {
+	if err := s.Vet(); err != nil {
+		return err
+	}
+	if _, ok := r.ByProtocol(s.Protocol); ok {
+		return fmt.Errorf("reportschema: protocol %d is already registered",
+			s.Protocol)
+	}
+	r.schemas = append(r.schemas, s)
+	return nil
+}
+
+// ByProtocol returns the schema of the given protocol.
+func (r *ReportSchemas) ByProtocol(protocol int) (s ReportSchema, ok bool) {
+	for _, s := range r.schemas {
+		if s.Protocol == protocol {
+			return s, true
+		}
+	}
+	return
+}
+
+// Find returns the schema of a reply to CMD_STATUS of the given number of
+// bits from a chip with the given protocol, which is 0 if unknown.  If
+// the protocol is unknown or its reports have a different length, Find
+// returns the latest protocol whose reports are as long.
+func (r *ReportSchemas) Find(protocol, bits int) (s ReportSchema, ok bool) {
+	if s, ok = r.ByProtocol(protocol); ok && !s.Raw && s.Bits() == bits {
+		return
+	}
+	ok = false
+	for _, candidate := range r.schemas {
+		if candidate.Raw || candidate.Bits() != bits {
+			continue
+		}
+		if !ok || candidate.Protocol > s.Protocol {
+			s, ok = candidate, true
+		}
+	}
+	return
+}
+
+// LatestRaw returns the latest Raw schema: the one of chips which do not
+// take commands.
+func (r *ReportSchemas) LatestRaw() (s ReportSchema, ok bool) {
+	for _, candidate := range r.schemas {
+		if candidate.Raw && (!ok || candidate.Protocol > s.Protocol) {
+			s, ok = candidate, true
+		}
+	}
+	return
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportSchemaVet(t *testing.T) {
+	type short struct {
+		VoltageNo uint `muxi:"0,10"`
+		OK        bool `muxi:"10,1"`
+		_         bool `muxi:"11,1"`
+	}
+	type long struct {
+		VoltageNo uint `muxi:"0,32"`
+	}
+	type unknown struct {
+		Pressure uint `muxi:"0,8"`
+	}
+	type own struct {
+		Chip byte `muxi:"0,8"`
+	}
+	type wrongType struct {
+		Heating uint `muxi:"0,8"`
+	}
+	for _, s := range []ReportSchema{
+		{Protocol: 0, Layout: ctrlStatus{}},
+		{Protocol: 3},
+		{Protocol: 3, Layout: short{}},
+		{Protocol: 3, Layout: long{}},
+		{Protocol: 3, Layout: unknown{}},
+		{Protocol: 3, Layout: own{}},
+		{Protocol: 3, Layout: wrongType{}},
+	} {
+		if err := s.Vet(); err == nil {
+			t.Errorf("%v passed", s)
+		}
+	}
+	if err := (&ReportSchema{Protocol: 3, Raw: true,
+		Layout: short{}}).Vet(); err != nil {
+		t.Errorf("raw schema of 12 bits: %v", err)
+	}
+}
+
+func TestReportSchemas(t *testing.T) {
+	schemas := ourReportSchemas()
+	type status3 struct {
+		VoltageNo uint `muxi:"0,10"`
+		OK        bool `muxi:"10,1"`
+		_         bool `muxi:"23,1"`
+	}
+	if err := schemas.Register(ReportSchema{Protocol: 2,
+		Layout: status3{}}); err == nil {
+		t.Fatal("registered protocol 2 twice")
+	}
+	if err := schemas.Register(ReportSchema{Protocol: 3,
+		Layout: status3{}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		protocol, bits int
+		want           int // 0 if none
+	}{
+		{2, 16, 2},
+		{3, 24, 3},
+		{0, 16, 2},
+		{0, 24, 3},
+		{3, 16, 2}, // downgraded
+		{2, 24, 3}, // upgraded
+		{1, 16, 2}, // raw reports are not replies to CMD_STATUS
+		{2, 8, 0},
+	} {
+		s, ok := schemas.Find(tc.protocol, tc.bits)
+		if tc.want == 0 && ok || tc.want != 0 && s.Protocol != tc.want {
+			t.Errorf("Find(%d, %d) = %d, %v", tc.protocol, tc.bits,
+				s.Protocol, ok)
+		}
+	}
+}
+
+func TestReportSchemaDecode(t *testing.T) {
+	s, _ := ourReportSchemas().ByProtocol(2)
+	var r ChipiReport
+	if err := s.Decode(MustParseMuxiBits("1011000000"+"01001"+"0"),
+		&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.VoltageNo != 13 || r.Heating || !r.OK || r.TempLow ||
+		r.TempHigh || !r.BuddyDied || r.Protocol != 2 {
+		t.Fatalf("decoded %+v", r)
+	}
+}
+
+// rawCtrl is a controller with the firmware of protocol 1: it replies to
+// every 1 written with its status, unless it is still sending.
+type rawCtrl struct {
+	status uint16
+	tx     MuxiBits
+}
+
+func (c *rawCtrl) DraadWrite(bit bool) {
+	if bit && c.tx.Len == 0 {
+		c.tx = MuxiBitsUint(uint64(c.status), 16)
+	}
+}
+
+func (c *rawCtrl) DraadRead() (bit, ok bool) {
+	if c.tx.Len == 0 {
+		return false, false
+	}
+	bit = c.tx.Bool(0)
+	c.tx = c.tx.Slice(1, c.tx.Len)
+	return bit, true
+}
+
+func TestChipiRaw(t *testing.T) {
+	muxi := testChipiMuxi(t, &rawCtrl{status: 1<<11 | 500},
+		&rawCtrl{status: 1<<10 | 1<<11 | 300})
+	schema, _ := ourReportSchemas().ByProtocol(1)
+	chipi, err := ChipiOpenRaw(muxi, nil, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chipi.Close()
+
+	for n := 0; n < 6; n++ {
+		select {
+		case report := <-chipi.Reports:
+			if report.Chip == 0 && (report.VoltageNo != 500 ||
+				report.Heating) || report.Chip == 1 &&
+				(report.VoltageNo != 300 || !report.Heating) ||
+				!report.OK || report.Protocol != 1 {
+				t.Fatalf("report %v", report)
+			}
+		case err := <-chipi.Err:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no report")
+		}
+	}
+	if _, err := chipi.ReadThreshold(0, THRESHOLD_TARGET); err == nil {
+		t.Fatal("sent a command to a chip of protocol 1")
+	}
+}
+
+func TestChipiAsksProtocol(t *testing.T) {
+	ctrl := NewCtrlEmulator(func() uint { return 500 })
+	for j := 0; j < CTRL_ADC_SAMPLES; j++ {
+		ctrl.AdcConversion()
+	}
+	chipi := testChipi(t, nil, ctrl)
+	defer chipi.Close()
+
+	for n := 0; n < 3; n++ {
+		select {
+		case report := <-chipi.Reports:
+			if report.VoltageNo != 500 ||
+				report.Protocol != CTRL_PROTOCOL_VERSION {
+				t.Fatalf("report %v", report)
+			}
+		case err := <-chipi.Err:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no report")
+		}
+	}
+	if chipi.Stats().Chips[0].Mismatched != 0 {
+		t.Fatalf("stats %v", chipi.Stats().Chips[0])
+	}
+}
+
+func TestChipiMixedFirmware(t *testing.T) {
+	ctrl := NewCtrlEmulator(func() uint { return 300 })
+	for j := 0; j < CTRL_ADC_SAMPLES; j++ {
+		ctrl.AdcConversion()
+	}
+	chipi := testChipi(t, nil, &rawCtrl{status: 1<<11 | 500}, ctrl)
+	defer chipi.Close()
+
+	// Chip 0 is only asked the raw way after it did not reply to
+	// CMD_STATUS.
+	var reports [2]int
+	deadline := time.After(20 * time.Second)
+	for reports[0] < 3 || reports[1] < 3 {
+		select {
+		case report := <-chipi.Reports:
+			if report.Chip == 0 && (report.VoltageNo != 500 ||
+				report.Protocol != 1) || report.Chip == 1 &&
+				(report.VoltageNo != 300 || report.Protocol != 2) ||
+				!report.OK {
+				t.Fatalf("report %v", report)
+			}
+			reports[report.Chip]++
+		case err := <-chipi.Err:
+			if err, ok := err.(ChipTimeoutError); !ok || err.Chip != 0 ||
+				reports[0] > 0 {
+				t.Fatal(err)
+			}
+		case <-deadline:
+			t.Fatalf("only %v reports", reports)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+// Changing the thresholds of the controllers at runtime.
+//
+// The firmware of the controllers has three thresholds: below the lower
+// bound and above the upper bound it goes into error mode; in between it
+// heats until the temperature reaches the target.  They are VoltageNos:
+// a chip only knows the voltage over its thermistor.  The rPi reads and
+// sets them with CMD_GET_THRESHOLD and CMD_SET_THRESHOLD, whose payload is
+// the Threshold followed by the VoltageNo (16 bits, least significant byte
+// first).  The reply to both is as the payload of CMD_SET_THRESHOLD, with
+// the threshold in effect.  A controller refuses to set thresholds which
+// are out of order and keeps them in its EEPROM.  See ctrl.c.
+//
+// The status reports do not carry the thresholds, so we confirm a new
+// threshold with CMD_GET_THRESHOLD rather than from the next report.
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Threshold identifies one of the thresholds of a controller.
+type Threshold byte
+
+const (
+	THRESHOLD_LOWER_BOUND Threshold = 0
+	THRESHOLD_TARGET      Threshold = 1
+	THRESHOLD_UPPER_BOUND Threshold = 2
+)
+
+func (t Threshold) String() string {
+	switch t {
+	case THRESHOLD_LOWER_BOUND:
+		return "lower bound"
+	case THRESHOLD_TARGET:
+		return "target"
+	case THRESHOLD_UPPER_BOUND:
+		return "upper bound"
+	}
+	return fmt.Sprintf("threshold %d", byte(t))
+}
+
+// Safe ranges (in Celsius) of the thresholds.
+const (
+	SETPOINT_LOWER_BOUND_MIN = -10.0
+	SETPOINT_LOWER_BOUND_MAX = 50.0
+	SETPOINT_TARGET_MIN      = 20.0
+	SETPOINT_TARGET_MAX      = 130.0
+	SETPOINT_UPPER_BOUND_MIN = 100.0
+	SETPOINT_UPPER_BOUND_MAX = 200.0
+
+	// SETPOINT_MARGIN is the minimal distance (in Celsius) between two
+	// thresholds.
+	SETPOINT_MARGIN = 5.0
+)
+
+// safeRange returns the range (in Celsius) in which we allow t to be set.
+func (t Threshold) safeRange() (min, max float64) {
+	switch t {
+	case THRESHOLD_LOWER_BOUND:
+		return SETPOINT_LOWER_BOUND_MIN, SETPOINT_LOWER_BOUND_MAX
+	case THRESHOLD_TARGET:
+		return SETPOINT_TARGET_MIN, SETPOINT_TARGET_MAX
+	}
+	return SETPOINT_UPPER_BOUND_MIN, SETPOINT_UPPER_BOUND_MAX
+}
+
+// CHIPI_ALL_CHIPS addresses every chip in SetThreshold and friends.
+const CHIPI_ALL_CHIPS = 255
+
+// ChipThresholds are the thresholds of a chip as VoltageNos, indexed by
+// Threshold.
+type ChipThresholds [3]uint
+
+// ThresholdRefusedError is returned if a chip did not set a threshold to
+// the value we asked for.
+type ThresholdRefusedError struct {
+	Chip      byte
+	Which     Threshold
+	VoltageNo uint // the value we asked for
+	InEffect  uint // the value the chip reported
+}
+
+func (e ThresholdRefusedError) Error() string {
+	return fmt.Sprintf("chipi: chip %v did not set its %v to %d; it is %d",
+		e.Chip, e.Which, e.VoltageNo, e.InEffect)
+}
+
+// thresholdPayload is the payload of CMD_SET_THRESHOLD, and of the
+// replies to CMD_*_THRESHOLD.
+type thresholdPayload struct {
+	Which     Threshold `muxi:"0,8"`
+	VoltageNo uint      `muxi:"8,16"`
+}
+
+// getThresholdPayload is the payload of CMD_GET_THRESHOLD.
+type getThresholdPayload struct {
+	Which Threshold `muxi:"0,8"`
+}
+
+// thresholdFrom decodes the reply of chip to CMD_*_THRESHOLD.
+func thresholdFrom(chip byte, which Threshold, reply ChipCommand) (
+	voltageNo uint, err error) {
+	var p thresholdPayload
+	if reply.DecodePayload(&p) != nil || p.Which != which {
+		return 0, fmt.Errorf("chipi: chip %v sent a malformed %v: %v",
+			chip, which, reply)
+	}
+	return p.VoltageNo, nil
+}
+
+// ReadThreshold returns the threshold in effect on chip.
+func (c *Chipi) ReadThreshold(chip byte, which Threshold) (voltageNo uint,
+	err error) {
+	cmd, err := NewChipCommand(CMD_GET_THRESHOLD,
+		getThresholdPayload{which})
+	if err != nil {
+		return
+	}
+	reply, err := c.do(chip, cmd)
+	if err != nil {
+		return
+	}
+	return thresholdFrom(chip, which, reply)
+}
+
+// ReadThresholds returns all thresholds in effect on chip.
+func (c *Chipi) ReadThresholds(chip byte) (t ChipThresholds, err error) {
+	for which := range t {
+		t[which], err = c.ReadThreshold(chip, Threshold(which))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Thresholds describes the thresholds in effect on chip in Celsius.
+func (c *Chipi) Thresholds(chip byte) (string, error) {
+	t, err := c.ReadThresholds(chip)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for which, voltageNo := range t {
+		parts = append(parts, fmt.Sprintf("%s %d = %.1fC (+-%.2fC)",
+			Threshold(which), voltageNo, c.TempC(chip, float64(voltageNo)),
+			c.Resolution(chip, voltageNo)/2))
+	}
+	return strings.Join(parts, "; "), nil
+}
+
+// writeThreshold sets a threshold of chip and confirms it twice: by the
+// reply to CMD_SET_THRESHOLD, and by reading it back with
+// CMD_GET_THRESHOLD.  Both tell the threshold in effect, in the RAM of the
+// controller.  The status reports do not carry the thresholds, so they
+// cannot confirm it, and whether it reached the EEPROM only shows after
+// the controller is reset.
+func (c *Chipi) writeThreshold(chip byte, which Threshold,
+	voltageNo uint) error {
+	cmd, err := NewChipCommand(CMD_SET_THRESHOLD,
+		thresholdPayload{which, voltageNo})
+	if err != nil {
+		return err
+	}
+	reply, err := c.do(chip, cmd)
+	if err != nil {
+		return err
+	}
+	inEffect, err := thresholdFrom(chip, which, reply)
+	if err == nil && inEffect == voltageNo {
+		inEffect, err = c.ReadThreshold(chip, which)
+	}
+	if err != nil {
+		return err
+	}
+	if inEffect != voltageNo {
+		return ThresholdRefusedError{chip, which, voltageNo, inEffect}
+	}
+	return nil
+}
+
+// SetThreshold sets a threshold of chip, or of every chip if chip is
+// CHIPI_ALL_CHIPS, to tempC.  tempC should be in the safe range of the
+// threshold and at least SETPOINT_MARGIN away from the other thresholds.
+// Every chip is checked before any is changed.  If a chip fails to set
+// the threshold, the chips changed before are restored, lest the chips
+// disagree.
+func (c *Chipi) SetThreshold(chip byte, which Threshold, tempC float64) error {
+	return c.SetThresholds(chip, map[Threshold]float64{which: tempC})
+}
+
+// SetThresholds is as SetThreshold, but sets several thresholds (in
+// Celsius) at once.  On every chip, it raises thresholds from the top
+// down and lowers them from the bottom up, so that they stay in order.
+func (c *Chipi) SetThresholds(chip byte,
+	tempCs map[Threshold]float64) error {
+	for which, tempC := range tempCs {
+		if which > THRESHOLD_UPPER_BOUND {
+			return fmt.Errorf("chipi: there is no %v", which)
+		}
+		if min, max := which.safeRange(); !(tempC >= min && tempC <= max) {
+			return fmt.Errorf("chipi: %v of %.1fC is outside of the safe "+
+				"range %.0fC to %.0fC", which, tempC, min, max)
+		}
+	}
+	var chips []byte
+	if chip == CHIPI_ALL_CHIPS {
+		for chip := range c.models {
+			chips = append(chips, byte(chip))
+		}
+	} else if int(chip) < len(c.models) {
+		chips = []byte{chip}
+	} else {
+		return fmt.Errorf("chipi: there is no chip %d", chip)
+	}
+
+	// The writes to make, in order, and the values to restore.
+	type write struct {
+		chip           byte
+		which          Threshold
+		voltageNo, old uint
+	}
+	var writes []write
+	for _, chip := range chips {
+		t, err := c.ReadThresholds(chip)
+		if err != nil {
+			return err
+		}
+		var final [3]float64 // in Celsius
+		for which, voltageNo := range t {
+			final[which] = c.TempC(chip, float64(voltageNo))
+		}
+		raised := make(map[Threshold]bool)
+		for which, tempC := range tempCs {
+			raised[which] = tempC > final[which]
+			final[which] = tempC
+		}
+		for which, tempC := range tempCs {
+			for other, otherC := range final {
+				other := Threshold(other)
+				if other < which && tempC < otherC+SETPOINT_MARGIN ||
+					other > which && tempC > otherC-SETPOINT_MARGIN {
+					return fmt.Errorf("chipi: %v of %.1fC is within %.0fC "+
+						"of the %v of chip %v, which would be %.1fC", which,
+						tempC, SETPOINT_MARGIN, other, chip, otherC)
+				}
+			}
+		}
+		for _, pass := range []struct {
+			raise bool
+			order []Threshold
+		}{
+			{true, []Threshold{THRESHOLD_UPPER_BOUND, THRESHOLD_TARGET,
+				THRESHOLD_LOWER_BOUND}},
+			{false, []Threshold{THRESHOLD_LOWER_BOUND, THRESHOLD_TARGET,
+				THRESHOLD_UPPER_BOUND}},
+		} {
+			for _, which := range pass.order {
+				if tempC, ok := tempCs[which]; ok &&
+					raised[which] == pass.raise {
+					voltageNo, _, err := c.VoltageNo(chip, tempC)
+					if err != nil {
+						return err
+					}
+					writes = append(writes, write{chip, which, voltageNo,
+						t[which]})
+				}
+			}
+		}
+	}
+
+	for i, w := range writes {
+		err := c.writeThreshold(w.chip, w.which, w.voltageNo)
+		if err == nil {
+			continue
+		}
+		// Undo in reverse, so that the thresholds stay in order.
+		errs := []error{err}
+		for j := i; j >= 0; j-- {
+			errs = append(errs, c.writeThreshold(writes[j].chip,
+				writes[j].which, writes[j].old))
+		}
+		return WrapErrs(errs, "Could not set the %v of chip %v", w.which,
+			w.chip)
+	}
+	return nil
+}
+
+// SetTarget sets the temperature (in Celsius) to which chip, or every chip
+// if chip is CHIPI_ALL_CHIPS, heats.  See SetThreshold.
+func (c *Chipi) SetTarget(chip byte, tempC float64) error {
+	return c.SetThreshold(chip, THRESHOLD_TARGET, tempC)
+}
+
+// SetLowerBound sets the temperature (in Celsius) below which chip, or
+// every chip if chip is CHIPI_ALL_CHIPS, goes into error mode.  See
+// SetThreshold.
+func (c *Chipi) SetLowerBound(chip byte, tempC float64) error {
+	return c.SetThreshold(chip, THRESHOLD_LOWER_BOUND, tempC)
+}
+
+// SetUpperBound sets the temperature (in Celsius) above which chip, or
+// every chip if chip is CHIPI_ALL_CHIPS, goes into error mode.  See
+// SetThreshold.
+func (c *Chipi) SetUpperBound(chip byte, tempC float64) error {
+	return c.SetThreshold(chip, THRESHOLD_UPPER_BOUND, tempC)
+}
+
+// cmdSetpoint implements `bart2d setpoint'.
+func cmdSetpoint(args []string) error {
+	flags := flag.NewFlagSet("setpoint", flag.ExitOnError)
+	dirPath := flags.String("dir", "", "data directory; ~/.bart2d if empty")
+	var tempCs [3]*float64
+	for which, name := range []string{"lower", "target", "upper"} {
+		min, max := Threshold(which).safeRange()
+		tempCs[which] = flags.Float64(name, 0, fmt.Sprintf(
+			"set the %v (%.0fC to %.0fC)", Threshold(which), min, max))
+	}
+	flags.Usage = func() {
+		fmt.Print("usage: bart2d setpoint [flags]\n\n" +
+			"Shows or sets the thresholds of all chips.  Stop the daemon " +
+			"first.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	set := make(map[Threshold]float64) // the thresholds to set
+	flags.Visit(func(f *flag.Flag) {
+		for which, name := range []string{"lower", "target", "upper"} {
+			if f.Name == name {
+				set[Threshold(which)] = *tempCs[which]
+			}
+		}
+	})
+
+	b := &Bart2d{DirPath: *dirPath}
+	dir, err := openDir(b.DirPath)
+	if err != nil {
+		return err
+	}
+	b.dir = dir
+	if b.config, err = ConfigOpen(b.dir); err != nil {
+		return err
+	}
+	chipi, err := b.openChipi()
+	if err != nil {
+		return WrapErr(err, "Could not open Chipi")
+	}
+	defer chipi.Close()
+
+	// The Muxi stalls when nobody reads the reports and errors, and
+	// then the replies to our commands never arrive.
+	go func() {
+		for {
+			select {
+			case _ = <-chipi.Reports:
+			case err := <-chipi.Err:
+				fmt.Printf("!! chipi error: %v\n", err)
+			case _ = <-chipi.closer:
+				return
+			}
+		}
+	}()
+
+	if len(set) > 0 {
+		if err := chipi.SetThresholds(CHIPI_ALL_CHIPS, set); err != nil {
+			return err
+		}
+		for which := range tempCs {
+			if tempC, ok := set[Threshold(which)]; ok {
+				fmt.Printf("Set the %v to %.1fC\n", Threshold(which), tempC)
+			}
+		}
+	}
+
+	for chip := 0; chip < b.config.Chips; chip++ {
+		thresholds, err := chipi.Thresholds(byte(chip))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("chip %d: %s\n", chip, thresholds)
+	}
+	return nil
+}
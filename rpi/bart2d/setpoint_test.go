@@ -0,0 +1,173 @@
+package main
+
+import "testing"
+
+// meddlingDraadDevice calls Meddle when the controller receives the
+// header of the first command with opcode Op, before it receives the
+// payload.
+type meddlingDraadDevice struct {
+	*CtrlEmulator
+	Op     byte
+	Meddle func()
+
+	last    byte // the last eight bits written
+	meddled bool
+}
+
+func (d *meddlingDraadDevice) DraadWrite(bit bool) {
+	d.CtrlEmulator.DraadWrite(bit)
+	d.last >>= 1
+	if bit {
+		d.last |= 128
+	}
+	if !d.meddled && d.last == byte(ctrlHeader(d.Op, 3)) {
+		d.meddled = true
+		d.Meddle()
+	}
+}
+
+// testSetpointChipi opens a Chipi to two controllers.  devices, if given,
+// replace the controllers on the draads.
+func testSetpointChipi(t *testing.T, devices ...DraadDevice) (*Chipi,
+	[]*CtrlEmulator) {
+	ctrls := []*CtrlEmulator{
+		NewCtrlEmulator(func() uint { return 500 }),
+		NewCtrlEmulator(func() uint { return 500 }),
+	}
+	if devices == nil {
+		devices = []DraadDevice{ctrls[0], ctrls[1]}
+	}
+	for i, device := range devices {
+		switch d := device.(type) {
+		case *CtrlEmulator:
+			ctrls[i] = d
+		case *meddlingDraadDevice:
+			ctrls[i] = d.CtrlEmulator
+		}
+	}
+	// The second chip has a different thermistor.
+	chipi := testChipi(t, []TemperatureModel{nil,
+		BetaThermistor{Beta: 3950, R0: 100000, T0C: 25}}, devices...)
+	go func() {
+		for {
+			select {
+			case _ = <-chipi.Reports:
+			case _ = <-chipi.Err:
+			case _ = <-chipi.closer:
+				return
+			}
+		}
+	}()
+	return chipi, ctrls
+}
+
+// thresholdsOf returns the thresholds of the controller.
+func thresholdsOf(ctrl *CtrlEmulator) [3]uint {
+	ctrl.mutex.Lock()
+	defer ctrl.mutex.Unlock()
+	return ctrl.thresholds
+}
+
+func TestSetpoint(t *testing.T) {
+	chipi, ctrls := testSetpointChipi(t)
+	defer chipi.Close()
+
+	if err := chipi.SetTarget(CHIPI_ALL_CHIPS, 93); err != nil {
+		t.Fatal(err)
+	}
+	for chip, ctrl := range ctrls {
+		want, _, _ := chipi.VoltageNo(byte(chip), 93)
+		got := thresholdsOf(ctrl)[THRESHOLD_TARGET]
+		if got != want {
+			t.Errorf("chip %d: target is %d instead of %d", chip, got, want)
+		}
+	}
+	if thresholdsOf(ctrls[0]) == thresholdsOf(ctrls[1]) {
+		t.Errorf("chips with different thermistors have the same " +
+			"thresholds")
+	}
+
+	if err := chipi.SetUpperBound(1, 130); err != nil {
+		t.Fatal(err)
+	}
+	thresholds, err := chipi.ReadThresholds(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper := thresholds[THRESHOLD_UPPER_BOUND]
+	if tempC := chipi.TempC(1, float64(upper)); tempC < 129 || tempC > 131 {
+		t.Errorf("upper bound is %.1fC instead of 130C", tempC)
+	}
+	if upper := thresholdsOf(ctrls[0])[THRESHOLD_UPPER_BOUND]; upper !=
+		CTRL_TEMP_UPPER_BOUND {
+		t.Errorf("upper bound of chip 0 changed to %d", upper)
+	}
+
+	// Outside of the safe range, and too close to the upper bound.
+	for _, tempC := range []float64{10, 140, 128} {
+		before := thresholdsOf(ctrls[1])
+		if err := chipi.SetTarget(1, tempC); err == nil {
+			t.Errorf("set target to %.0fC", tempC)
+		}
+		if after := thresholdsOf(ctrls[1]); after != before {
+			t.Errorf("thresholds changed from %v to %v", before, after)
+		}
+	}
+}
+
+func TestSetpointRestore(t *testing.T) {
+	// Someone lowers the thresholds of the second chip far below the new
+	// target, after we checked them, but before we set the target.
+	meddler := &meddlingDraadDevice{
+		CtrlEmulator: NewCtrlEmulator(func() uint { return 500 }),
+		Op:           CMD_SET_THRESHOLD,
+	}
+	meddler.Meddle = func() {
+		meddler.mutex.Lock()
+		defer meddler.mutex.Unlock()
+		meddler.thresholds = [3]uint{26, 27, 28}
+	}
+	ctrl := NewCtrlEmulator(func() uint { return 500 })
+	chipi, ctrls := testSetpointChipi(t, ctrl, meddler)
+	defer chipi.Close()
+
+	before := thresholdsOf(ctrls[0])
+	err := chipi.SetTarget(CHIPI_ALL_CHIPS, 125)
+	if _, ok := err.(wrappederr); !ok {
+		t.Fatalf("chip 1 should have refused, got %v", err)
+	}
+	if after := thresholdsOf(ctrls[0]); after != before {
+		t.Errorf("thresholds of chip 0 not restored: %v instead of %v",
+			after, before)
+	}
+}
+
+func TestSetpointOrderPerChip(t *testing.T) {
+	chipi, ctrls := testSetpointChipi(t)
+	defer chipi.Close()
+
+	// Lowering the target and upper bound of chip 0 means raising them on
+	// chip 1.  A controller refuses a target above its upper bound.
+	for chip, tempCs := range [][2]float64{{120, 130}, {100, 106}} {
+		target, _, _ := chipi.VoltageNo(byte(chip), tempCs[0])
+		upper, _, _ := chipi.VoltageNo(byte(chip), tempCs[1])
+		ctrls[chip].mutex.Lock()
+		ctrls[chip].thresholds[THRESHOLD_TARGET] = target
+		ctrls[chip].thresholds[THRESHOLD_UPPER_BOUND] = upper
+		ctrls[chip].mutex.Unlock()
+	}
+	if err := chipi.SetThresholds(CHIPI_ALL_CHIPS, map[Threshold]float64{
+		THRESHOLD_TARGET:      110,
+		THRESHOLD_UPPER_BOUND: 118,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for chip, ctrl := range ctrls {
+		target, _, _ := chipi.VoltageNo(byte(chip), 110)
+		upper, _, _ := chipi.VoltageNo(byte(chip), 118)
+		if got := thresholdsOf(ctrl); got[THRESHOLD_TARGET] != target ||
+			got[THRESHOLD_UPPER_BOUND] != upper {
+			t.Errorf("chip %d: thresholds are %v", chip, got)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ourBoiler returns a model of the boiler of our Bar T2, filled with cold
+// water.
+func ourBoiler() Boiler {
+	return Boiler{
+		TempC:        15,
+		AmbientC:     20,
+		InletC:       15,
+		HeaterW:      3000,
+		HeatCapacity: 11*4186 + 15*500, // 11l of water and 15kg of copper
+		LossWPerK:    6,
+	}
+}
+
+// Boiler is a lumped thermal model of a boiler: all its water and metal
+// has the same temperature.
+type Boiler struct {
+	TempC    float64 // temperature of the water
+	AmbientC float64 // temperature of the air around the boiler
+	InletC   float64 // temperature of fresh water
+
+	HeaterW      float64 // power of the heating element (in Watt)
+	HeatCapacity float64 // of the filled boiler (in J/K)
+	LossWPerK    float64 // heat lost to the ambient air (in W/K)
+
+	// Rate (in l/min) at which water is drawn from the boiler and replaced
+	// by water from the inlet.
+	DrawLPerMin float64
+}
+
+// Step advances the model by dt.
+func (b *Boiler) Step(dt time.Duration, heating bool) {
+	var powerW float64
+	if heating {
+		powerW += b.HeaterW
+	}
+	powerW -= b.LossWPerK * (b.TempC - b.AmbientC)
+	powerW -= b.DrawLPerMin / 60 * 4186 * (b.TempC - b.InletC)
+	b.TempC += powerW * dt.Seconds() / b.HeatCapacity
+}
+
+// Simulation runs a boiler with two controllers and a MUX.  It implements
+// SpiTransport, so that a Muxi can be put on top of it.
+//
+// The GO pins of the two controllers switch the heater in series: it is
+// only on if both controllers want to heat.
+type Simulation struct {
+	Boiler Boiler
+	Ctrl   [2]*CtrlEmulator
+	Mux    *MuxEmulator
+
+	// Standard deviation of the noise on the ADC (in ADC units).
+	AdcNoise float64
+
+	mutex      sync.Mutex
+	rand       *rand.Rand
+	thermistor Thermistor
+	rMeter     RMeter
+	vMeter     VRatioMeter
+
+	// Simulated time since power-on, and when the next interrupts fire.
+	now, nextAdc, nextTimer, nextMux time.Duration
+
+	closer chan bool
+}
+
+// NewSimulation returns a simulation of our Bar T2 which is just switched
+// on.  It does not run until Run or Step is called.
+func NewSimulation(seed int64) *Simulation {
+	s := &Simulation{
+		Boiler:     ourBoiler(),
+		AdcNoise:   2,
+		rand:       rand.New(rand.NewSource(seed)),
+		thermistor: ourThermistor(),
+		rMeter:     ourRMeter(),
+		vMeter:     ourVRatioMeter(),
+		closer:     make(chan bool),
+		nextAdc:    SIM_ADC_PERIOD,
+		nextTimer:  SIM_TIMER_PERIOD,
+		nextMux:    SIM_MUX_PERIOD,
+	}
+	s.Ctrl[0] = NewCtrlEmulator(s.adc)
+	s.Ctrl[1] = NewCtrlEmulator(s.adc)
+	CtrlPair(s.Ctrl[0], s.Ctrl[1])
+	s.Mux = NewMuxEmulator(s.Ctrl[0], s.Ctrl[1])
+	return s
+}
+
+// adc returns a noisy ADC reading of the temperature of the boiler.
+// It is called with s.mutex held.
+func (s *Simulation) adc() uint {
+	ratio := s.rMeter.Ratio(s.thermistor.R(s.Boiler.TempC))
+	no := ratio*float64(s.vMeter.MaxNo) + s.rand.NormFloat64()*s.AdcNoise
+	no = math.Min(float64(s.vMeter.MaxNo), math.Floor(no))
+	return uint(math.Max(0, no))
+}
+
+// Heating returns whether the heater is on.
+func (s *Simulation) Heating() bool {
+	return s.Ctrl[0].Go() && s.Ctrl[1].Go()
+}
+
+// Periods of the events in the simulation.
+const (
+	SIM_ADC_PERIOD   = time.Second / CTRL_ADC_HZ
+	SIM_TIMER_PERIOD = time.Second / CTRL_TIMER_HZ
+	SIM_MUX_PERIOD   = MUXEMU_LOOP_PERIOD
+)
+
+// Step advances the simulation by dt.
+func (s *Simulation) Step(dt time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	end := s.now + dt
+	for {
+		next := s.nextAdc
+		if s.nextTimer < next {
+			next = s.nextTimer
+		}
+		if s.nextMux < next {
+			next = s.nextMux
+		}
+		if next > end {
+			break
+		}
+		s.Boiler.Step(next-s.now, s.Heating())
+		s.now = next
+
+		switch next {
+		case s.nextAdc:
+			s.Ctrl[0].AdcConversion()
+			s.Ctrl[1].AdcConversion()
+			s.nextAdc += SIM_ADC_PERIOD
+		case s.nextTimer:
+			s.Ctrl[0].TimerOverflow()
+			s.Ctrl[1].TimerOverflow()
+			s.nextTimer += SIM_TIMER_PERIOD
+		case s.nextMux:
+			s.Mux.Run(1)
+			s.nextMux += SIM_MUX_PERIOD
+		}
+	}
+	s.Boiler.Step(end-s.now, s.Heating())
+	s.now = end
+}
+
+// Run steps the simulation in a separate goroutine until it is closed.
+// The simulation runs speed times faster than real time.
+func (s *Simulation) Run(speed float64) {
+	const tick = 10 * time.Millisecond
+	ticker := time.NewTicker(tick)
+	go func() {
+		for {
+			select {
+			case _ = <-ticker.C:
+				s.Step(time.Duration(float64(tick) * speed))
+			case _ = <-s.closer:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Message talks to the MUX of the simulation.
+func (s *Simulation) Message(rbuf, tbuf []byte) error {
+	return s.Mux.Message(rbuf, tbuf)
+}
+
+func (s *Simulation) Transfer(segments []SpiSegment) error {
+	return s.Mux.Transfer(segments)
+}
+
+// Close stops the goroutine started by Run.
+func (s *Simulation) Close() error {
+	close(s.closer)
+	return nil
+}
+
+// cmdSimulate implements `bart2d simulate'.
+func cmdSimulate(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	speed := flags.Float64("speed", 1,
+		"how much faster than real time the simulation runs")
+	draw := flags.Float64("draw", 0,
+		"rate (in l/min) at which water is drawn from the boiler")
+	seed := flags.Int64("seed", 1, "seed for the noise on the ADCs")
+	dir := flags.String("dir", path.Join(os.TempDir(), "bart2d-simulation"),
+		"data directory")
+	record := flags.Bool("record", false,
+		"record all SPI messages exchanged with the MUX")
+	flags.Parse(args)
+
+	sim := NewSimulation(*seed)
+	sim.Boiler.DrawLPerMin = *draw
+	sim.Run(*speed)
+	return (&Bart2d{DirPath: *dir, Transport: sim, Record: *record}).Run()
+}
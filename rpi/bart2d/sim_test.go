@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulationRegulates(t *testing.T) {
+	sim := NewSimulation(1)
+	sim.Boiler.TempC = 115
+	sim.Step(4 * time.Minute)
+	if sim.Boiler.TempC < 118 || sim.Boiler.TempC > 122 {
+		t.Fatalf("boiler is at %.1fC", sim.Boiler.TempC)
+	}
+	for _, ctrl := range sim.Ctrl {
+		status := ctrl.Status()
+		if status&(1<<11) == 0 {
+			t.Fatalf("controller not OK: %016b", status)
+		}
+		if temp := status & 1023; temp < 780 || temp > 800 {
+			t.Fatalf("controller measures %v", temp)
+		}
+	}
+}
+
+func TestSimulationBuddyDied(t *testing.T) {
+	sim := NewSimulation(1)
+	sim.Step(time.Second)
+	if !sim.Heating() {
+		t.Fatal("cold boiler is not heated")
+	}
+	sim.Ctrl[1].Halt()
+	sim.Step(time.Second)
+	if sim.Heating() {
+		t.Fatal("boiler is heated while a controller is halted")
+	}
+	if status := sim.Ctrl[0].Status(); status&(1<<14) == 0 {
+		t.Fatalf("controller did not notice its buddy died: %016b", status)
+	}
+}
@@ -7,14 +7,15 @@ package main
 //  - https://www.kernel.org/doc/Documentation/spi/spidev
 //  - http://lxr.free-electrons.com/source/include/uapi/linux/spi/spidev.h
 //
-// TODO: Add funtions for reading settings from the device such as
-//       the max transfer speed via SPI_IOC_RD_MAX_SPEED_HZ.
-//       My ioctl calls return "bad address" for now.
+// Both the SPI_IOC_WR_* and SPI_IOC_RD_* ioctls take a pointer to the value
+// as their argument, even when reading.
 
 import (
 	"fmt"
 	"os"
+	"runtime"
 	s "syscall"
+	"time"
 	"unsafe"
 )
 
@@ -49,11 +50,86 @@ func (d *SpiDevice) WrBitsPerWord(bitsPerWord uint8) error {
 }
 
 func (d *SpiDevice) WrMaxSpeedHz(maxSpeedHz uint32) error {
-	_, _, ern := s.Syscall(s.SYS_IOCTL, d.fd(), SPI_IOC_WR_BITS_PER_WORD,
+	_, _, ern := s.Syscall(s.SYS_IOCTL, d.fd(), SPI_IOC_WR_MAX_SPEED_HZ,
 		uintptr(unsafe.Pointer(&maxSpeedHz)))
 	return fixNil(ern)
 }
 
+// WrMode32 sets the mode including the flags beyond the first eight bits,
+// such as SPI_TX_DUAL.
+func (d *SpiDevice) WrMode32(mode uint32) error {
+	_, _, ern := s.Syscall(s.SYS_IOCTL, d.fd(), SPI_IOC_WR_MODE32,
+		uintptr(unsafe.Pointer(&mode)))
+	return fixNil(ern)
+}
+
+// The following functions read the configuration of the given SPI device.
+
+func (d *SpiDevice) RdMode() (mode uint8, err error) {
+	_, _, ern := s.Syscall(s.SYS_IOCTL, d.fd(), SPI_IOC_RD_MODE,
+		uintptr(unsafe.Pointer(&mode)))
+	err = fixNil(ern)
+	return
+}
+
+func (d *SpiDevice) RdMode32() (mode uint32, err error) {
+	_, _, ern := s.Syscall(s.SYS_IOCTL, d.fd(), SPI_IOC_RD_MODE32,
+		uintptr(unsafe.Pointer(&mode)))
+	err = fixNil(ern)
+	return
+}
+
+func (d *SpiDevice) RdLsbFirst() (value bool, err error) {
+	var valueAsByte uint8
+	_, _, ern := s.Syscall(s.SYS_IOCTL, d.fd(), SPI_IOC_RD_LSB_FIRST,
+		uintptr(unsafe.Pointer(&valueAsByte)))
+	value = valueAsByte != 0
+	err = fixNil(ern)
+	return
+}
+
+func (d *SpiDevice) RdBitsPerWord() (bitsPerWord uint8, err error) {
+	_, _, ern := s.Syscall(s.SYS_IOCTL, d.fd(), SPI_IOC_RD_BITS_PER_WORD,
+		uintptr(unsafe.Pointer(&bitsPerWord)))
+	err = fixNil(ern)
+	return
+}
+
+func (d *SpiDevice) RdMaxSpeedHz() (maxSpeedHz uint32, err error) {
+	_, _, ern := s.Syscall(s.SYS_IOCTL, d.fd(), SPI_IOC_RD_MAX_SPEED_HZ,
+		uintptr(unsafe.Pointer(&maxSpeedHz)))
+	err = fixNil(ern)
+	return
+}
+
+// SpiSettings is the configuration of an SPI device.
+type SpiSettings struct {
+	Mode        uint32 // SPI_CPHA, SPI_CPOL, SPI_CS_HIGH, ...
+	LsbFirst    bool
+	BitsPerWord uint8
+	MaxSpeedHz  uint32
+}
+
+func (s SpiSettings) String() string {
+	return fmt.Sprintf("mode %#x, lsbFirst %v, %v bits/word, %vHz",
+		s.Mode, s.LsbFirst, s.BitsPerWord, s.MaxSpeedHz)
+}
+
+// Settings reads the full configuration of the device.
+func (d *SpiDevice) Settings() (settings SpiSettings, err error) {
+	if settings.Mode, err = d.RdMode32(); err != nil {
+		return
+	}
+	if settings.LsbFirst, err = d.RdLsbFirst(); err != nil {
+		return
+	}
+	if settings.BitsPerWord, err = d.RdBitsPerWord(); err != nil {
+		return
+	}
+	settings.MaxSpeedHz, err = d.RdMaxSpeedHz()
+	return
+}
+
 // Message transfers tbuf to the other end, while receiving in rbuf.
 func (d *SpiDevice) Message(rbuf, tbuf []byte, args SpiMessageArgs) error {
 	if len(rbuf) != len(tbuf) {
@@ -69,6 +145,55 @@ func (d *SpiDevice) Message(rbuf, tbuf []byte, args SpiMessageArgs) error {
 	return fixNil(ern)
 }
 
+// SpiSegment is a single transfer of a message consisting of several
+// transfers.  DelayUsecs is the pause after the transfer and a non-zero
+// CSChange deselects the device between this transfer and the next.
+type SpiSegment struct {
+	RBuf, TBuf []byte
+	SpiMessageArgs
+}
+
+// SPI_MAX_SEGMENTS is the maximum number of transfers in a single message:
+// the size of the argument of SPI_IOC_MESSAGE(N) has to fit in 14 bits.
+const SPI_MAX_SEGMENTS = (1<<14 - 1) / 32
+
+// SPI_IOC_MESSAGE returns the ioctl request number to submit a message
+// of n transfers.
+func SPI_IOC_MESSAGE(n int) uintptr {
+	return SPI_IOC_MESSAGE_1&^(0x3fff<<16) | uintptr(n*32)<<16
+}
+
+// Transfer submits the segments as a single message: they are transferred
+// in order without other messages to the device in between.
+func (d *SpiDevice) Transfer(segments []SpiSegment) error {
+	if len(segments) == 0 {
+		return nil
+	}
+	if len(segments) > SPI_MAX_SEGMENTS {
+		return fmt.Errorf("A message can have at most %d segments",
+			SPI_MAX_SEGMENTS)
+	}
+	transfers := make([]spiTransfer, len(segments))
+	for i, seg := range segments {
+		if len(seg.RBuf) != len(seg.TBuf) || len(seg.RBuf) == 0 {
+			return fmt.Errorf("Slices RBuf and TBuf of segment %d should "+
+				"have the same non-zero length", i)
+		}
+		transfers[i] = spiTransfer{
+			TxBuf:          uint64(uintptr(unsafe.Pointer(&seg.TBuf[0]))),
+			RxBuf:          uint64(uintptr(unsafe.Pointer(&seg.RBuf[0]))),
+			Len:            uint32(len(seg.RBuf)),
+			SpiMessageArgs: seg.SpiMessageArgs,
+		}
+	}
+	_, _, ern := s.Syscall(s.SYS_IOCTL, d.fd(),
+		SPI_IOC_MESSAGE(len(transfers)),
+		uintptr(unsafe.Pointer(&transfers[0])))
+	// The kernel only knows the buffers by address: keep them alive.
+	runtime.KeepAlive(segments)
+	return fixNil(ern)
+}
+
 func (d *SpiDevice) fd() uintptr {
 	return (*os.File)(d).Fd()
 }
@@ -105,8 +230,77 @@ const (
 	SPI_IOC_WR_LSB_FIRST     = 0x40016b02 //01 00000000000001 01101011 00000010
 	SPI_IOC_WR_BITS_PER_WORD = 0x40016b03 //01 00000000000001 01101011 00000011
 	SPI_IOC_WR_MAX_SPEED_HZ  = 0x40046b04 //01 00000000000100 01101011 00000100
+	SPI_IOC_WR_MODE32        = 0x40046b05 //01 00000000000100 01101011 00000101
+	SPI_IOC_RD_MODE          = 0x80016b01 //10 00000000000001 01101011 00000001
+	SPI_IOC_RD_LSB_FIRST     = 0x80016b02 //10 00000000000001 01101011 00000010
+	SPI_IOC_RD_BITS_PER_WORD = 0x80016b03 //10 00000000000001 01101011 00000011
+	SPI_IOC_RD_MAX_SPEED_HZ  = 0x80046b04 //10 00000000000100 01101011 00000100
+	SPI_IOC_RD_MODE32        = 0x80046b05 //10 00000000000100 01101011 00000101
 )
 
+// Flags of the mode, see linux/spi/spi.h
+const (
+	SPI_CPHA      = 0x01
+	SPI_CPOL      = 0x02
+	SPI_CS_HIGH   = 0x04
+	SPI_LSB_FIRST = 0x08
+	SPI_3WIRE     = 0x10
+	SPI_LOOP      = 0x20
+	SPI_NO_CS     = 0x40
+	SPI_READY     = 0x80
+	SPI_TX_DUAL   = 0x100
+	SPI_TX_QUAD   = 0x200
+	SPI_RX_DUAL   = 0x400
+	SPI_RX_QUAD   = 0x800
+)
+
+// SpiMismatchError is returned by SpiOpen when the kernel did not accept
+// a setting as requested.
+type SpiMismatchError struct {
+	Device    string
+	Setting   string
+	Requested interface{}
+	Actual    interface{}
+}
+
+func (e SpiMismatchError) Error() string {
+	return fmt.Sprintf("%s: requested %s %v, but the kernel set it to %v",
+		e.Device, e.Setting, e.Requested, e.Actual)
+}
+
+// SpiTransport is a full-duplex connection to an SPI slave.  It is
+// implemented by SpiConfiguredDevice and, for testing, by FakeSpi.
+type SpiTransport interface {
+	// Message transfers tbuf to the other end, while receiving in rbuf.
+	Message(rbuf, tbuf []byte) error
+	Close() error
+}
+
+// SpiBatchTransport is an SpiTransport which can submit a message of
+// several transfers at once.
+type SpiBatchTransport interface {
+	SpiTransport
+	Transfer(segments []SpiSegment) error
+}
+
+// SpiTransfer submits the segments over t.  If t does not support
+// messages with several transfers, the segments are sent one by one
+// with the requested delays in between.
+func SpiTransfer(t SpiTransport, segments []SpiSegment) error {
+	if bt, ok := t.(SpiBatchTransport); ok {
+		return bt.Transfer(segments)
+	}
+	for _, seg := range segments {
+		if err := t.Message(seg.RBuf, seg.TBuf); err != nil {
+			return err
+		}
+		if seg.DelayUsecs > 0 {
+			time.Sleep(time.Duration(seg.DelayUsecs) * time.Microsecond)
+		}
+	}
+	return nil
+}
+
 type SpiConfiguredDevice struct {
 	Device *SpiDevice
 	SpiMessageArgs
@@ -134,30 +328,86 @@ func SpiOpen(name string,
 		},
 	}
 
-	// configure device
+	// configure device, and check the kernel accepted each setting
+	check := func(setting string, requested, actual interface{},
+		err error) error {
+		if err != nil {
+			return WrapErr(err, "while reading back %v: ", setting)
+		}
+		if requested != actual {
+			return SpiMismatchError{
+				Device:    name,
+				Setting:   setting,
+				Requested: requested,
+				Actual:    actual,
+			}
+		}
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			d.Close()
+			d = nil
+		}
+	}()
+
 	err = d.Device.WrMode(mode)
 	if err != nil {
 		err = WrapErr(err, "while setting Mode to %v: ", mode)
 		return
 	}
+	actualMode, err := d.Device.RdMode()
+	if err = check("Mode", mode, actualMode, err); err != nil {
+		return
+	}
+
 	err = d.Device.WrLsbFirst(lsbFirst)
 	if err != nil {
 		err = WrapErr(err, "while setting LsbFirst to %v: ", lsbFirst)
 		return
 	}
+	actualLsbFirst, err := d.Device.RdLsbFirst()
+	if err = check("LsbFirst", lsbFirst, actualLsbFirst, err); err != nil {
+		return
+	}
+
 	err = d.Device.WrBitsPerWord(bitsPerWord)
 	if err != nil {
 		err = WrapErr(err, "while setting BitsPerWord to %v: ", bitsPerWord)
 		return
 	}
+	actualBitsPerWord, err := d.Device.RdBitsPerWord()
+	if err = check("BitsPerWord", bitsPerWord, actualBitsPerWord,
+		err); err != nil {
+		return
+	}
+
 	err = d.Device.WrMaxSpeedHz(speedHz)
 	if err != nil {
 		err = WrapErr(err, "while setting MaxSpeedHz to %v: ", speedHz)
 		return
 	}
+	actualSpeedHz, err := d.Device.RdMaxSpeedHz()
+	if err = check("MaxSpeedHz", speedHz, actualSpeedHz, err); err != nil {
+		return
+	}
 	return
 }
 
 func (d *SpiConfiguredDevice) Message(rbuf, tbuf []byte) error {
 	return d.Device.Message(rbuf, tbuf, d.SpiMessageArgs)
 }
+
+// Transfer submits the segments as a single message.  The speed and
+// bits per word of the device are used for segments that do not set them.
+func (d *SpiConfiguredDevice) Transfer(segments []SpiSegment) error {
+	for i := range segments {
+		if segments[i].SpeedHz == 0 {
+			segments[i].SpeedHz = d.SpeedHz
+		}
+		if segments[i].BitsPerWord == 0 {
+			segments[i].BitsPerWord = d.BitsPerWord
+		}
+	}
+	return d.Device.Transfer(segments)
+}
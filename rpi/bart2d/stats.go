@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MuxiStats counts what happened on the link between the rPi and the MUX.
+type MuxiStats struct {
+	Transfers uint64                 // SPI messages, both requests and polls
+	Frames    [MUXI_MAX_CHIPS]uint64 // frames received, per chip
+	Discarded uint64                 // bytes discarded by the MuxiScanner
+	Rejected  uint64                 // implausible frames received
+	Invalid   uint64                 // messages to send rejected by Vet
+	Latency   MuxiLatency
+
+	StatusFrames     uint64    // status frames received from the MUX
+	DraadTxOverflows uint64    // status frames with DraadTxOverflow set
+	SpiRxOverflows   uint64    // status frames with SpiRxOverflow set
+	OtherProtocols   uint64    // status frames with another Protocol
+	Status           MuxStatus // the last one received
+}
+
+func (s MuxiStats) String() string {
+	return fmt.Sprintf("%d transfers; frames %v; %d bytes discarded; "+
+		"%d frames rejected; %d invalid requests; latency: %v; "+
+		"%d status frames; overflows: %d draad tx, %d spi rx; "+
+		"%d of another protocol; status: %v", s.Transfers, s.Frames,
+		s.Discarded, s.Rejected, s.Invalid, s.Latency, s.StatusFrames,
+		s.DraadTxOverflows, s.SpiRxOverflows, s.OtherProtocols, s.Status)
+}
+
+// CHIPI_ERROR_WINDOW is the number of requests over which the rolling
+// error rate of a chip is computed.
+const CHIPI_ERROR_WINDOW = 20
+
+// ChipStats counts the requests to a single chip and how they ended.
+type ChipStats struct {
+	Requests    uint64
+	Reports     uint64 // well-formed responses
+	Timeouts    uint64 // no (complete) response in time
+	WrongLength uint64 // response of the wrong size
+	Rejected    uint64 // the chip did not know the command
+
+	// ErrorRate is the fraction of the last CHIPI_ERROR_WINDOW requests
+	// that failed.  A dead chip has an error rate of 1; a flaky draad
+	// somewhere in between.
+	ErrorRate float64
+
+	CmdiStats
+
+	window errorWindow
+}
+
+func (s ChipStats) String() string {
+	return fmt.Sprintf("%d requests; %d reports; %d timeouts; "+
+		"%d wrong length; %d rejected; error rate %.2f; %d retries; "+
+		"%d mismatched; %d malformed bits; %d unsolicited; %d resets",
+		s.Requests, s.Reports, s.Timeouts, s.WrongLength, s.Rejected,
+		s.ErrorRate, s.Retries, s.Mismatched, s.Malformed, s.Unsolicited,
+		s.Resets)
+}
+
+// ChipiStats is a snapshot of the statistics of a Chipi and its Muxi.
+type ChipiStats struct {
+	Muxi          MuxiStats
+	Chips         []ChipStats
+	DroppedEvents uint64 // as nobody read Events
+}
+
+func (s ChipiStats) String() string {
+	lines := []string{"muxi: " + s.Muxi.String()}
+	for chip, cs := range s.Chips {
+		lines = append(lines, fmt.Sprintf("chip %d: %v", chip, cs))
+	}
+	lines = append(lines, fmt.Sprintf("%d events dropped", s.DroppedEvents))
+	return strings.Join(lines, "\n")
+}
+
+// errorWindow remembers the outcomes of the last CHIPI_ERROR_WINDOW
+// requests.
+type errorWindow struct {
+	failed [CHIPI_ERROR_WINDOW]bool
+	next   int // index of the oldest outcome
+	n      int // number of outcomes
+	errors int // number of failures among them
+}
+
+func (w *errorWindow) add(failed bool) {
+	if w.n == CHIPI_ERROR_WINDOW {
+		if w.failed[w.next] {
+			w.errors--
+		}
+	} else {
+		w.n++
+	}
+	w.failed[w.next] = failed
+	if failed {
+		w.errors++
+	}
+	w.next = (w.next + 1) % CHIPI_ERROR_WINDOW
+}
+
+func (w *errorWindow) rate() float64 {
+	if w.n == 0 {
+		return 0
+	}
+	return float64(w.errors) / float64(w.n)
+}
+
+// record accounts for the outcome of a request.
+func (s *ChipStats) record(failed bool) {
+	s.window.add(failed)
+	s.ErrorRate = s.window.rate()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestErrorWindow(t *testing.T) {
+	var s ChipStats
+	for i := 0; i < CHIPI_ERROR_WINDOW; i++ {
+		s.record(i%4 == 0)
+	}
+	if s.ErrorRate != 0.25 {
+		t.Fatalf("error rate %v instead of 0.25", s.ErrorRate)
+	}
+	// The old outcomes are forgotten.
+	for i := 0; i < CHIPI_ERROR_WINDOW; i++ {
+		s.record(true)
+	}
+	if s.ErrorRate != 1 {
+		t.Fatalf("error rate %v instead of 1", s.ErrorRate)
+	}
+}
+
+func TestChipiStats(t *testing.T) {
+	ctrl := NewCtrlEmulator(func() uint { return 500 })
+	emu := NewMuxEmulator(ctrl, nil)
+	config := testMuxiConfig()
+	config.PollInterval = time.Millisecond
+	muxi, err := MuxiOpenTransport(emu, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chipi, err := ChipiOpenMuxi(muxi, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chipi.Close()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case report := <-chipi.Reports:
+			if report.Chip != 0 {
+				t.Fatalf("report from chip %d", report.Chip)
+			}
+		case err := <-chipi.Err:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no report")
+		}
+	}
+
+	// An invalid request is counted, but does not stop the Muxi.
+	muxi.In <- MuxiMsg{Chip: 3}
+	select {
+	case _ = <-chipi.Err:
+	case <-time.After(time.Second):
+		t.Fatal("invalid request was not reported")
+	}
+
+	stats := chipi.Stats()
+	if stats.Chips[0].Reports < 3 || stats.Chips[0].ErrorRate != 0 {
+		t.Fatalf("chip 0: %v", stats.Chips[0])
+	}
+	if stats.Chips[1].Reports != 0 || stats.Chips[1].Requests != 1 {
+		t.Fatalf("chip 1: %v", stats.Chips[1])
+	}
+	if stats.Muxi.Frames[0] < 3 || stats.Muxi.Frames[1] != 0 ||
+		stats.Muxi.Invalid != 1 || stats.Muxi.Transfers == 0 {
+		t.Fatalf("muxi: %v", stats.Muxi)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+// Keeping the link with the chips alive.
+//
+// A chip which stops responding stays silent until someone intervenes, and
+// a Muxi gives up for good when an SPI transfer fails.  The Supervisor
+// tracks the health of every chip and tells the daemon what to do about
+// it.  If that does not help, it escalates:
+//
+//  1. reset the command state of the chip, see Cmdi.Reset;
+//  2. close the Muxi and open it anew;
+//  3. pulse the RESET line of the MUX and open the Muxi anew.  The RESET
+//     pins of the controllers are connected to the same line, so this
+//     resets the controllers as well.  Only if SupervisorConfig.ResetMux.
+//
+// Between two attempts the Supervisor waits twice as long as before, up to
+// MaxBackoff.  The last step is repeated until the chip recovers.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ourSupervisorConfig returns how patient we are with the chips of our Bar
+// T2.
+func ourSupervisorConfig() SupervisorConfig {
+	return SupervisorConfig{
+		DegradedErrorRate: 0.2,
+		Backoff:           5,
+		MaxBackoff:        300,
+		Attempts:          2,
+	}
+}
+
+type SupervisorConfig struct {
+	// DegradedErrorRate is the ChipStats.ErrorRate above which a chip that
+	// still responds is degraded.
+	DegradedErrorRate float64
+
+	// Backoff is how long (in seconds) to wait before the first attempt to
+	// recover a chip.  It doubles after every attempt, up to MaxBackoff.
+	Backoff    float64
+	MaxBackoff float64
+
+	// Attempts is the number of attempts at a step before escalating to
+	// the next.
+	Attempts int
+
+	// ResetMux allows the last step: pulsing the RESET line of the MUX.
+	ResetMux bool
+}
+
+func (c *SupervisorConfig) Vet() error {
+	if !(c.DegradedErrorRate > 0 && c.DegradedErrorRate <= 1) {
+		return fmt.Errorf("supervisor: DegradedErrorRate should be " +
+			"between 0 and 1")
+	}
+	if !(c.Backoff > 0) {
+		return fmt.Errorf("supervisor: Backoff should be positive")
+	}
+	if c.MaxBackoff < c.Backoff {
+		return fmt.Errorf("supervisor: MaxBackoff should be at least " +
+			"Backoff")
+	}
+	if c.Attempts < 1 {
+		return fmt.Errorf("supervisor: Attempts should be positive")
+	}
+	return nil
+}
+
+// ChipHealth is how well a chip responds.
+type ChipHealth int
+
+const (
+	CHIP_HEALTHY  ChipHealth = iota
+	CHIP_DEGRADED            // responds, but its error rate is high
+	CHIP_DEAD                // stopped responding
+)
+
+func (h ChipHealth) String() string {
+	switch h {
+	case CHIP_HEALTHY:
+		return "healthy"
+	case CHIP_DEGRADED:
+		return "degraded"
+	case CHIP_DEAD:
+		return "dead"
+	}
+	return fmt.Sprintf("health %d", int(h))
+}
+
+// RecoveryStep is a way to get a dead chip to respond again.
+type RecoveryStep int
+
+const (
+	RECOVERY_RESET_COMMANDS RecoveryStep = iota // of the chip
+	RECOVERY_REOPEN_MUXI                        // for all chips
+	RECOVERY_RESET_MUX                          // and reopen the Muxi
+	RECOVERY_STEPS                              // the number of steps
+)
+
+func (s RecoveryStep) String() string {
+	switch s {
+	case RECOVERY_RESET_COMMANDS:
+		return "reset the command state"
+	case RECOVERY_REOPEN_MUXI:
+		return "reopen the Muxi"
+	case RECOVERY_RESET_MUX:
+		return "reset the MUX"
+	}
+	return fmt.Sprintf("step %d", int(s))
+}
+
+// Recovery is an attempt to recover which the Supervisor asks for.
+type Recovery struct {
+	Step    RecoveryStep
+	Chip    byte // whose commands to reset; unused by the other steps
+	Attempt int  // at Step, counting from 1
+}
+
+func (r Recovery) String() string {
+	if r.Step == RECOVERY_RESET_COMMANDS {
+		return fmt.Sprintf("%v of chip %d (attempt %d)", r.Step, r.Chip,
+			r.Attempt)
+	}
+	return fmt.Sprintf("%v (attempt %d)", r.Step, r.Attempt)
+}
+
+// ChipHealthChange is a change in the health of a chip.
+type ChipHealthChange struct {
+	Chip   byte
+	Time   time.Time
+	Before ChipHealth
+	After  ChipHealth
+}
+
+func (c ChipHealthChange) String() string {
+	return fmt.Sprintf("%s chip %d %v -> %v", c.Time.Format(TIME_LAYOUT),
+		c.Chip, c.Before, c.After)
+}
+
+// ChipSupervision is what the Supervisor knows about a chip.
+type ChipSupervision struct {
+	Health ChipHealth
+	Since  time.Time // the last change in Health; zero if none
+
+	// Of a dead chip, the step to try next, the attempts at that step so
+	// far, and when to try.  Next is zero if there is nothing to recover.
+	Step     RecoveryStep
+	Attempts int
+	Next     time.Time
+
+	backoff time.Duration // until Next
+}
+
+func (c ChipSupervision) String() string {
+	ret := c.Health.String()
+	if !c.Since.IsZero() {
+		ret += " since " + c.Since.Format(TIME_LAYOUT)
+	}
+	if !c.Next.IsZero() {
+		ret += fmt.Sprintf("; will %v (attempt %d) at %s", c.Step,
+			c.Attempts+1, c.Next.Format(TIME_LAYOUT))
+	}
+	return ret
+}
+
+// SupervisorStatus is a snapshot of the state of a Supervisor.
+type SupervisorStatus struct {
+	Chips []ChipSupervision
+
+	// MuxiDead is set if the Muxi failed and was not reopened since.
+	MuxiDead bool
+
+	// Recoveries counts the attempts asked for, per RecoveryStep.
+	Recoveries [RECOVERY_STEPS]uint64
+}
+
+func (s SupervisorStatus) String() string {
+	var lines []string
+	for chip, cs := range s.Chips {
+		lines = append(lines, fmt.Sprintf("chip %d: %v", chip, cs))
+	}
+	if s.MuxiDead {
+		lines = append(lines, "muxi: dead")
+	}
+	lines = append(lines, fmt.Sprintf("%d command resets; %d reopens; "+
+		"%d MUX resets", s.Recoveries[RECOVERY_RESET_COMMANDS],
+		s.Recoveries[RECOVERY_REOPEN_MUXI], s.Recoveries[RECOVERY_RESET_MUX]))
+	return strings.Join(lines, "\n")
+}
+
+// Supervisor tracks the health of the chips from what the Chipi tells and
+// decides when to recover them.  The daemon feeds it from a single
+// goroutine, but Status may be called from anywhere.
+type Supervisor struct {
+	config SupervisorConfig
+
+	mutex  sync.Mutex // protects status
+	status SupervisorStatus
+}
+
+func NewSupervisor(config SupervisorConfig, chips int) *Supervisor {
+	return &Supervisor{
+		config: config,
+		status: SupervisorStatus{Chips: make([]ChipSupervision, chips)},
+	}
+}
+
+// Status returns a snapshot of the health of the chips and the recoveries
+// in progress.
+func (s *Supervisor) Status() SupervisorStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ret := s.status
+	ret.Chips = make([]ChipSupervision, len(s.status.Chips))
+	copy(ret.Chips, s.status.Chips)
+	return ret
+}
+
+// Health returns the health of chip.
+func (s *Supervisor) Health(chip byte) ChipHealth {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status.Chips[chip].Health
+}
+
+// Report takes note that chip responded.  It returns the changes in
+// health.
+func (s *Supervisor) Report(r ChipiReport) []ChipHealthChange {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if int(r.Chip) >= len(s.status.Chips) ||
+		s.status.Chips[r.Chip].Health != CHIP_DEAD {
+		return nil
+	}
+	changes := s.setHealth(r.Chip, CHIP_HEALTHY, r.Time)
+	c := &s.status.Chips[r.Chip]
+	*c = ChipSupervision{Health: c.Health, Since: c.Since}
+	return changes
+}
+
+// Event takes note of a transition of a chip; only whether it stopped
+// responding matters.  It returns the changes in health.
+func (s *Supervisor) Event(e ChipiEvent) []ChipHealthChange {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e.Kind != CHIPI_EVENT_STOPPED_RESPONDING ||
+		int(e.Chip) >= len(s.status.Chips) ||
+		s.status.Chips[e.Chip].Health == CHIP_DEAD {
+		return nil
+	}
+	changes := s.setHealth(e.Chip, CHIP_DEAD, e.Time)
+	c := &s.status.Chips[e.Chip]
+	c.Step, c.Attempts, c.backoff = RECOVERY_RESET_COMMANDS, 0, s.backoff()
+	c.Next = e.Time.Add(c.backoff)
+	return changes
+}
+
+// Error takes note of an error on Chipi.Err.  If the Muxi failed, all
+// chips are dead and the Muxi is reopened straight away.  It returns the
+// changes in health.
+func (s *Supervisor) Error(err error, now time.Time) []ChipHealthChange {
+	if _, ok := err.(MuxiTransferError); !ok {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.muxiFailed(now, true)
+}
+
+// Failed takes note that the recovery r failed with err.  It returns the
+// changes in health.
+func (s *Supervisor) Failed(r Recovery, err error,
+	now time.Time) []ChipHealthChange {
+	if r.Step == RECOVERY_RESET_COMMANDS {
+		return nil // the next attempt will tell
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.muxiFailed(now, false)
+}
+
+// Quiet returns whether err on Chipi.Err is old news: a chip that is
+// known to be dead did not respond again.
+func (s *Supervisor) Quiet(err error) bool {
+	timeout, ok := err.(ChipTimeoutError)
+	if !ok {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return int(timeout.Chip) < len(s.status.Chips) &&
+		s.status.Chips[timeout.Chip].Health == CHIP_DEAD
+}
+
+// Stats updates the health of the chips which still respond from their
+// error rates.  It returns the changes in health.
+func (s *Supervisor) Stats(stats ChipiStats,
+	now time.Time) (changes []ChipHealthChange) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for chip, cs := range stats.Chips {
+		if chip >= len(s.status.Chips) ||
+			s.status.Chips[chip].Health == CHIP_DEAD {
+			continue
+		}
+		health := CHIP_HEALTHY
+		if cs.ErrorRate > s.config.DegradedErrorRate {
+			health = CHIP_DEGRADED
+		}
+		changes = append(changes, s.setHealth(byte(chip), health, now)...)
+	}
+	return
+}
+
+// Due returns the recoveries to attempt now.  A step which concerns the
+// Muxi is asked for once, on behalf of all chips waiting for it.
+func (s *Supervisor) Due(now time.Time) (recoveries []Recovery) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	muxi := Recovery{Step: -1}
+	due := false
+	for chip := range s.status.Chips {
+		c := &s.status.Chips[chip]
+		if c.Next.IsZero() {
+			continue
+		}
+		if c.Step == RECOVERY_RESET_COMMANDS {
+			if !now.Before(c.Next) {
+				recoveries = append(recoveries, Recovery{
+					Step:    c.Step,
+					Chip:    byte(chip),
+					Attempt: c.Attempts + 1,
+				})
+				s.status.Recoveries[c.Step]++
+				s.advance(c, now)
+			}
+			continue
+		}
+		if !now.Before(c.Next) {
+			due = true
+		}
+		if c.Step > muxi.Step || c.Step == muxi.Step &&
+			c.Attempts+1 > muxi.Attempt {
+			muxi.Step, muxi.Attempt = c.Step, c.Attempts+1
+		}
+	}
+	if !due {
+		return
+	}
+	recoveries = append(recoveries, muxi)
+	s.status.Recoveries[muxi.Step]++
+	s.status.MuxiDead = false
+	for chip := range s.status.Chips {
+		c := &s.status.Chips[chip]
+		if !c.Next.IsZero() && c.Step >= RECOVERY_REOPEN_MUXI {
+			s.advance(c, now)
+		}
+	}
+	return
+}
+
+// muxiFailed marks all chips dead as the Muxi failed.  If immediate, they
+// need not wait for their backoff, unless they were already waiting for
+// the Muxi to be reopened.
+func (s *Supervisor) muxiFailed(now time.Time,
+	immediate bool) (changes []ChipHealthChange) {
+	s.status.MuxiDead = true
+	for chip := range s.status.Chips {
+		changes = append(changes, s.setHealth(byte(chip), CHIP_DEAD, now)...)
+		c := &s.status.Chips[chip]
+		if !c.Next.IsZero() && c.Step >= RECOVERY_REOPEN_MUXI {
+			continue
+		}
+		c.Step, c.Attempts, c.backoff = RECOVERY_REOPEN_MUXI, 0, s.backoff()
+		c.Next = now.Add(c.backoff)
+		if immediate {
+			c.Next = now
+		}
+	}
+	return
+}
+
+// advance accounts for an attempt to recover c, escalating if there were
+// enough attempts at this step.
+func (s *Supervisor) advance(c *ChipSupervision, now time.Time) {
+	last := RECOVERY_REOPEN_MUXI
+	if s.config.ResetMux {
+		last = RECOVERY_RESET_MUX
+	}
+	if c.Attempts++; c.Attempts >= s.config.Attempts && c.Step < last {
+		c.Step, c.Attempts = c.Step+1, 0
+	}
+	max := time.Duration(s.config.MaxBackoff * float64(time.Second))
+	if c.backoff *= 2; c.backoff > max {
+		c.backoff = max
+	}
+	c.Next = now.Add(c.backoff)
+}
+
+func (s *Supervisor) backoff() time.Duration {
+	return time.Duration(s.config.Backoff * float64(time.Second))
+}
+
+func (s *Supervisor) setHealth(chip byte, health ChipHealth,
+	now time.Time) []ChipHealthChange {
+	c := &s.status.Chips[chip]
+	if c.Health == health {
+		return nil
+	}
+	change := ChipHealthChange{Chip: chip, Time: now, Before: c.Health,
+		After: health}
+	c.Health, c.Since = health, now
+	return []ChipHealthChange{change}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSupervisor(t *testing.T) {
+	s := NewSupervisor(SupervisorConfig{
+		DegradedErrorRate: 0.2,
+		Backoff:           5,
+		MaxBackoff:        20,
+		Attempts:          2,
+		ResetMux:          true,
+	}, 2)
+	start := time.Date(2020, 1, 1, 8, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	due := func(seconds int, expected ...Recovery) {
+		t.Helper()
+		if got := s.Due(at(seconds)); fmt.Sprint(got) !=
+			fmt.Sprint(expected) {
+			t.Fatalf("%ds: due %v instead of %v", seconds, got, expected)
+		}
+	}
+
+	changes := s.Event(ChipiEvent{Kind: CHIPI_EVENT_STOPPED_RESPONDING,
+		Chip: 1, Time: at(0)})
+	if len(changes) != 1 || changes[0].Before != CHIP_HEALTHY ||
+		changes[0].After != CHIP_DEAD || s.Health(1) != CHIP_DEAD {
+		t.Fatalf("changes %v", changes)
+	}
+	if !s.Quiet(ChipTimeoutError{Chip: 1}) || s.Quiet(ChipTimeoutError{
+		Chip: 0}) || s.Quiet(errors.New("chip 1 on fire")) {
+		t.Fatal("Quiet is wrong")
+	}
+
+	// First the command state is reset, then the Muxi reopened, every
+	// time waiting twice as long.
+	due(4)
+	due(5, Recovery{RECOVERY_RESET_COMMANDS, 1, 1})
+	due(14)
+	due(15, Recovery{RECOVERY_RESET_COMMANDS, 1, 2})
+	due(34)
+	due(35, Recovery{Step: RECOVERY_REOPEN_MUXI, Attempt: 1})
+
+	// The Muxi could not be reopened, so chip 0 is dead too.
+	changes = s.Failed(Recovery{Step: RECOVERY_REOPEN_MUXI, Attempt: 1},
+		errors.New("no spidev"), at(36))
+	if len(changes) != 1 || changes[0].Chip != 0 || !s.Status().MuxiDead {
+		t.Fatalf("changes %v", changes)
+	}
+	due(40)
+	due(41, Recovery{Step: RECOVERY_REOPEN_MUXI, Attempt: 2})
+	status := s.Status()
+	if status.MuxiDead || status.Recoveries != [RECOVERY_STEPS]uint64{
+		2, 2, 0} {
+		t.Fatalf("status %v", status)
+	}
+	if c := status.Chips[1]; c.Step != RECOVERY_RESET_MUX ||
+		c.Next != at(61) {
+		t.Fatalf("chip 1: %v", c)
+	}
+
+	// The backoff is at most MaxBackoff.
+	due(61, Recovery{Step: RECOVERY_RESET_MUX, Attempt: 1})
+	due(81, Recovery{Step: RECOVERY_RESET_MUX, Attempt: 2})
+	due(101, Recovery{Step: RECOVERY_RESET_MUX, Attempt: 3})
+
+	changes = s.Report(ChipiReport{Chip: 1, Time: at(102), OK: true})
+	if len(changes) != 1 || changes[0].After != CHIP_HEALTHY {
+		t.Fatalf("changes %v", changes)
+	}
+	if c := s.Status().Chips[1]; !c.Next.IsZero() || c.Since != at(102) {
+		t.Fatalf("chip 1: %v", c)
+	}
+	changes = s.Report(ChipiReport{Chip: 0, Time: at(103), OK: true})
+	if len(changes) != 1 {
+		t.Fatalf("changes %v", changes)
+	}
+	due(200)
+
+	// A failed transfer kills all chips at once; the Muxi is reopened
+	// straight away.
+	if changes := s.Error(MuxOverflowError{}, at(300)); len(changes) != 0 {
+		t.Fatalf("changes %v", changes)
+	}
+	if changes := s.Error(MuxiTransferError{errors.New("bus on fire")},
+		at(300)); len(changes) != 2 {
+		t.Fatalf("changes %v", changes)
+	}
+	due(300, Recovery{Step: RECOVERY_REOPEN_MUXI, Attempt: 1})
+	due(309)
+	due(310, Recovery{Step: RECOVERY_REOPEN_MUXI, Attempt: 2})
+	due(329)
+	due(330, Recovery{Step: RECOVERY_RESET_MUX, Attempt: 1})
+}
+
+func TestSupervisorStats(t *testing.T) {
+	s := NewSupervisor(ourSupervisorConfig(), 2)
+	now := time.Now()
+	stats := ChipiStats{Chips: []ChipStats{{ErrorRate: 0.5}, {}}}
+	changes := s.Stats(stats, now)
+	if len(changes) != 1 || changes[0].Chip != 0 ||
+		changes[0].After != CHIP_DEGRADED {
+		t.Fatalf("changes %v", changes)
+	}
+	if changes := s.Stats(stats, now); len(changes) != 0 {
+		t.Fatalf("changes %v", changes)
+	}
+
+	// The error rate of a dead chip does not tell whether it recovered.
+	s.Event(ChipiEvent{Kind: CHIPI_EVENT_STOPPED_RESPONDING, Chip: 0,
+		Time: now})
+	stats.Chips[0].ErrorRate = 0
+	if changes := s.Stats(stats, now); len(changes) != 0 ||
+		s.Health(0) != CHIP_DEAD {
+		t.Fatalf("changes %v", changes)
+	}
+}
+
+func TestSupervisorConfigVet(t *testing.T) {
+	for _, c := range []SupervisorConfig{
+		{DegradedErrorRate: 0, Backoff: 1, MaxBackoff: 1, Attempts: 1},
+		{DegradedErrorRate: 2, Backoff: 1, MaxBackoff: 1, Attempts: 1},
+		{DegradedErrorRate: 1, Backoff: 0, MaxBackoff: 1, Attempts: 1},
+		{DegradedErrorRate: 1, Backoff: 2, MaxBackoff: 1, Attempts: 1},
+		{DegradedErrorRate: 1, Backoff: 1, MaxBackoff: 1, Attempts: 0},
+	} {
+		if err := c.Vet(); err == nil {
+			t.Errorf("%+v passed", c)
+		}
+	}
+	c := ourSupervisorConfig()
+	if err := c.Vet(); err != nil {
+		t.Fatal(err)
+	}
+}
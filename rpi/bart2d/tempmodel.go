@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ourThermistor returns the type of thermistor we use in our Bar T2.
+func ourThermistor() Thermistor {
+	return Thermistor{A: 1.270e-3, B: 2.229e-4, C: 3.948e-8}
+}
+
+// KELVIN is 0 degrees Celsius in Kelvin.
+const KELVIN = 273.15
+
+// TemperatureModel models how the resistance of a thermistor depends on
+// its temperature.
+type TemperatureModel interface {
+	// TempC returns the temperature (in Celsius) at the given resistance
+	// (in Ohm).
+	TempC(R float64) float64
+
+	// R is the inverse of TempC: it returns the resistance (in Ohm) at the
+	// given temperature (in Celsius).
+	R(tempC float64) float64
+}
+
+// Thermistor models a thermistor by its Steinhart--Hart coefficients (A,B,C).
+type Thermistor struct {
+	A float64
+	B float64
+	C float64
+}
+
+// TempC returns the temperature (in Celsius) at the given resistance.
+func (t Thermistor) TempC(R float64) float64 {
+	logR := math.Log(R)
+	tempKrec := t.A + t.B*logR + t.C*math.Pow(logR, 3)
+	return (1 / tempKrec) - KELVIN
+}
+
+// Vet checks whether the coefficients give a sensible curve: over the
+// resistances the ADC can measure, the temperature should be above
+// absolute zero and fall as the resistance rises.
+func (t Thermistor) Vet() error {
+	for _, x := range []float64{t.A, t.B, t.C} {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return fmt.Errorf("the Steinhart--Hart coefficients of a " +
+				"thermistor should be finite")
+		}
+	}
+	rMeter, vMeter := ourRMeter(), ourVRatioMeter()
+	for no := uint(1); no < vMeter.MaxNo; no++ {
+		logR := math.Log(rMeter.R(vMeter.Ratio(no)))
+		// 1/T and its derivative to ln R should be positive.
+		if t.tempKrec(logR) <= 0 || t.B+3*t.C*logR*logR <= 0 {
+			return fmt.Errorf("the Steinhart--Hart curve of a thermistor "+
+				"should be monotonic over the range of the ADC; it is not "+
+				"at %.0f Ohm", math.Exp(logR))
+		}
+	}
+	return nil
+}
+
+// tempKrec returns 1/T (in 1/Kelvin) at the given ln R.
+func (t Thermistor) tempKrec(logR float64) float64 {
+	return t.A + t.B*logR + t.C*logR*logR*logR
+}
+
+// R returns the resistance at the given temperature by solving the
+// Steinhart--Hart equation for ln R.  If C is positive, there is a single
+// solution, given by Cardano's formula.  Otherwise the curve is only
+// monotonic where Vet checks it, so R searches there, and returns 0 or
+// +Inf for temperatures beyond the range of the ADC.
+func (t Thermistor) R(tempC float64) float64 {
+	tempKrec := 1 / (tempC + KELVIN)
+	if t.C == 0 {
+		return math.Exp((tempKrec - t.A) / t.B)
+	}
+	if t.C > 0 && t.B > 0 {
+		y := (t.A - tempKrec) / t.C
+		x := math.Sqrt(math.Pow(t.B/(3*t.C), 3) + y*y/4)
+		return math.Exp(math.Cbrt(x-y/2) - math.Cbrt(x+y/2))
+	}
+
+	// Bisect between the least and greatest resistance the ADC measures.
+	rMeter, vMeter := ourRMeter(), ourVRatioMeter()
+	lo := math.Log(rMeter.R(vMeter.Ratio(vMeter.MaxNo - 1)))
+	hi := math.Log(rMeter.R(vMeter.Ratio(1)))
+	switch {
+	case math.IsNaN(tempKrec):
+		return math.NaN()
+	case tempKrec < t.tempKrec(lo):
+		return 0
+	case tempKrec > t.tempKrec(hi):
+		return math.Inf(1)
+	}
+	for i := 0; i < THERMISTOR_BISECTIONS; i++ {
+		mid := (lo + hi) / 2
+		if t.tempKrec(mid) < tempKrec {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return math.Exp((lo + hi) / 2)
+}
+
+// THERMISTOR_BISECTIONS is the number of times Thermistor.R halves the
+// range of ln R, which is about 10 wide; 60 halvings leave far less than
+// the precision of a float64.
+const THERMISTOR_BISECTIONS = 60
+
+// BetaThermistor models a thermistor by its B (or beta) value, as found on
+// data sheets: 1/T = 1/T0 + ln(R/R0)/B.  The thermistor of the spitherm
+// test setup, see spitherm.py, has B=4220 and R0=10k at T0=25C.
+type BetaThermistor struct {
+	Beta float64 // in Kelvin
+	R0   float64 // resistance (in Ohm) at T0C
+	T0C  float64 // reference temperature (in Celsius)
+}
+
+// BETA_DEFAULT_T0C is the reference temperature of a BetaThermistor whose
+// configuration does not give one.  Data sheets give R0 at 25C.
+const BETA_DEFAULT_T0C = 25
+
+// UnmarshalJSON is as the default, except that T0C defaults to
+// BETA_DEFAULT_T0C.
+func (t *BetaThermistor) UnmarshalJSON(data []byte) error {
+	type plain BetaThermistor // without this method
+	p := plain{T0C: BETA_DEFAULT_T0C}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*t = BetaThermistor(p)
+	return nil
+}
+
+// Vet checks whether the parameters make sense.
+func (t BetaThermistor) Vet() error {
+	if !(t.Beta > 0) || !(t.R0 > 0) || math.IsInf(t.Beta, 0) ||
+		math.IsInf(t.R0, 0) {
+		return fmt.Errorf("Beta and R0 of a thermistor should be " +
+			"positive")
+	}
+	if !(t.T0C > -KELVIN) || math.IsInf(t.T0C, 0) {
+		return fmt.Errorf("T0C of a thermistor should be above absolute " +
+			"zero")
+	}
+	return nil
+}
+
+// TempC returns the temperature (in Celsius) at the given resistance.
+func (t BetaThermistor) TempC(R float64) float64 {
+	return 1/(math.Log(R/t.R0)/t.Beta+1/(t.T0C+KELVIN)) - KELVIN
+}
+
+// R returns the resistance at the given temperature.
+func (t BetaThermistor) R(tempC float64) float64 {
+	return t.R0 * math.Exp(t.Beta*(1/(tempC+KELVIN)-1/(t.T0C+KELVIN)))
+}
+
+// TablePoint is the temperature of a thermistor at a given resistance.
+type TablePoint struct {
+	R     float64 // in Ohm
+	TempC float64
+}
+
+// TableThermistor models a thermistor by a table of resistances and
+// temperatures, as found on data sheets or measured.  Between two points,
+// the temperature is interpolated linearly in ln R; beyond the table it is
+// extrapolated from the nearest two points.
+type TableThermistor struct {
+	// Points should be sorted by resistance.  The temperatures should be
+	// strictly monotonic too, so that the table can be inverted.
+	Points []TablePoint
+}
+
+// Vet checks whether the table can be interpolated.
+func (t TableThermistor) Vet() error {
+	if len(t.Points) < 2 {
+		return fmt.Errorf("thermistor table needs at least two points")
+	}
+	for i, p := range t.Points {
+		if p.R <= 0 {
+			return fmt.Errorf("thermistor table: resistances should be " +
+				"positive")
+		}
+		if i > 0 && p.R <= t.Points[i-1].R {
+			return fmt.Errorf("thermistor table should be sorted by " +
+				"resistance")
+		}
+	}
+	first, last := t.Points[0].TempC, t.Points[len(t.Points)-1].TempC
+	for i := 1; i < len(t.Points); i++ {
+		dT := t.Points[i].TempC - t.Points[i-1].TempC
+		if dT == 0 || (dT < 0) != (last < first) {
+			return fmt.Errorf("thermistor table: temperatures should be " +
+				"strictly monotonic")
+		}
+	}
+	return nil
+}
+
+// TempC returns the temperature (in Celsius) at the given resistance.
+func (t TableThermistor) TempC(R float64) float64 {
+	// index of the first point beyond R, within 1..len-1.
+	i := sort.Search(len(t.Points)-2, func(i int) bool {
+		return t.Points[i+1].R >= R
+	}) + 1
+	p, q := t.Points[i-1], t.Points[i]
+	f := math.Log(R/p.R) / math.Log(q.R/p.R)
+	return p.TempC + f*(q.TempC-p.TempC)
+}
+
+// R returns the resistance at the given temperature.
+func (t TableThermistor) R(tempC float64) float64 {
+	// As TempC, but searching the temperatures, which either rise or fall.
+	n := len(t.Points)
+	rising := t.Points[n-1].TempC > t.Points[0].TempC
+	i := sort.Search(n-2, func(i int) bool {
+		if rising {
+			return t.Points[i+1].TempC >= tempC
+		}
+		return t.Points[i+1].TempC <= tempC
+	}) + 1
+	p, q := t.Points[i-1], t.Points[i]
+	f := (tempC - p.TempC) / (q.TempC - p.TempC)
+	return p.R * math.Exp(f*math.Log(q.R/p.R))
+}
+
+// ThermistorConfig configures the TemperatureModel of a chip.  At most one
+// of the models should be set; if none is, the chip has ourThermistor.
+type ThermistorConfig struct {
+	SteinhartHart *Thermistor      `json:",omitempty"`
+	Beta          *BetaThermistor  `json:",omitempty"`
+	Table         *TableThermistor `json:",omitempty"`
+}
+
+// Vet checks whether the configuration makes sense.
+func (c ThermistorConfig) Vet() error {
+	n := 0
+	if c.SteinhartHart != nil {
+		n++
+		if err := c.SteinhartHart.Vet(); err != nil {
+			return err
+		}
+	}
+	if c.Beta != nil {
+		n++
+		if err := c.Beta.Vet(); err != nil {
+			return err
+		}
+	}
+	if c.Table != nil {
+		n++
+		if err := c.Table.Vet(); err != nil {
+			return err
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("a thermistor should have only one model")
+	}
+	return nil
+}
+
+// Model returns the configured TemperatureModel.
+func (c ThermistorConfig) Model() TemperatureModel {
+	switch {
+	case c.SteinhartHart != nil:
+		return *c.SteinhartHart
+	case c.Beta != nil:
+		return *c.Beta
+	case c.Table != nil:
+		return *c.Table
+	}
+	return ourThermistor()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestThermistorTempC(t *testing.T) {
+	for _, th := range []Thermistor{
+		ourThermistor(),
+		{A: 1.1e-3, B: 2.4e-4, C: 7e-8},
+	} {
+		for _, tempC := range []float64{20, 95, 120} {
+			R := th.R(tempC)
+			if got := th.TempC(R); math.Abs(got-tempC) > 1e-6 {
+				t.Errorf("%+v: %.0f Ohm is %.3fC instead of %.0fC", th, R,
+					got, tempC)
+			}
+		}
+	}
+}
+
+func TestBetaThermistorTempC(t *testing.T) {
+	th := BetaThermistor{Beta: 4220, R0: 10000, T0C: 25}
+	if got := th.TempC(10000); math.Abs(got-25) > 1e-9 {
+		t.Errorf("R0 is %.3fC instead of 25C", got)
+	}
+	// The formula of spitherm.py
+	R := 3000.0
+	expected := 1.0/(math.Log(R/10000)/4220+(1.0/298.15)) - 273.15
+	if got := th.TempC(R); math.Abs(got-expected) > 1e-9 {
+		t.Errorf("%.0f Ohm is %.3fC instead of %.3fC", R, got, expected)
+	}
+}
+
+func TestTableThermistorTempC(t *testing.T) {
+	th := TableThermistor{Points: []TablePoint{
+		{R: 100, TempC: 150},
+		{R: 1000, TempC: 100},
+		{R: 10000, TempC: 25},
+	}}
+	if err := th.Vet(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ R, tempC float64 }{
+		{100, 150},
+		{1000, 100},
+		{10000, 25},
+		{math.Sqrt(1000 * 10000), 62.5}, // halfway in ln R
+		{10, 200},                       // extrapolated
+		{100000, -50},
+	} {
+		if got := th.TempC(c.R); math.Abs(got-c.tempC) > 1e-9 {
+			t.Errorf("%.0f Ohm is %.3fC instead of %.3fC", c.R, got,
+				c.tempC)
+		}
+	}
+
+	for _, points := range [][]TablePoint{
+		{{R: 100, TempC: 150}},
+		{{R: 1000, TempC: 100}, {R: 100, TempC: 150}},
+		{{R: 0, TempC: 100}, {R: 100, TempC: 150}},
+		{{R: 10, TempC: 150}, {R: 100, TempC: 100}, {R: 1000, TempC: 120}},
+	} {
+		if (TableThermistor{Points: points}).Vet() == nil {
+			t.Errorf("%v passed Vet", points)
+		}
+	}
+}
+
+func TestTemperatureModelR(t *testing.T) {
+	for _, model := range []TemperatureModel{
+		ourThermistor(),
+		Thermistor{A: 1.2e-3, B: 2.3e-4},
+		Thermistor{A: 1.2e-3, B: 2.3e-4, C: -1e-8},
+		BetaThermistor{Beta: 4220, R0: 10000, T0C: 25},
+		TableThermistor{Points: []TablePoint{
+			{R: 100, TempC: 150},
+			{R: 1000, TempC: 100},
+			{R: 10000, TempC: 25},
+		}},
+		TableThermistor{Points: []TablePoint{ // a PTC
+			{R: 100, TempC: 0},
+			{R: 140, TempC: 100},
+		}},
+	} {
+		for _, tempC := range []float64{-10, 20, 62.5, 95, 200} {
+			R := model.R(tempC)
+			if got := model.TempC(R); math.Abs(got-tempC) > 1e-6 {
+				t.Errorf("%+v: %.0f Ohm is %.3fC instead of %.1fC", model,
+					R, got, tempC)
+			}
+		}
+	}
+}
+
+func TestThermistorRBeyondADC(t *testing.T) {
+	// With C < 0 there is no formula; R searches the range of the ADC.
+	th := Thermistor{A: 1.2e-3, B: 2.3e-4, C: -1e-8}
+	if err := th.Vet(); err != nil {
+		t.Fatal(err)
+	}
+	if R := th.R(-100); !math.IsInf(R, 1) {
+		t.Errorf("-100C is %v Ohm", R)
+	}
+	if R := th.R(1000); R != 0 {
+		t.Errorf("1000C is %v Ohm", R)
+	}
+	if R := th.R(math.NaN()); !math.IsNaN(R) {
+		t.Errorf("NaN is %v Ohm", R)
+	}
+}
+
+func TestThermistorConfigVet(t *testing.T) {
+	for _, c := range []struct {
+		json string
+		ok   bool
+	}{
+		{`{}`, true},
+		{`{"SteinhartHart": {"A": 1.270e-3, "B": 2.229e-4, "C": 3.948e-8}}`,
+			true},
+		{`{"SteinhartHart": {}}`, false},
+		{`{"SteinhartHart": {"A": 1e-3}}`, false},
+		{`{"SteinhartHart": {"A": 1.270e-3, "B": -2.229e-4}}`, false},
+		{`{"SteinhartHart": {"A": 1.270e-3, "B": 2.229e-4, "C": -1e-5}}`,
+			false},
+		{`{"SteinhartHart": {"A": -1, "B": 2.229e-4, "C": 3.948e-8}}`,
+			false},
+		{`{"Beta": {"Beta": 4220, "R0": 10000}}`, true},
+		{`{"Beta": {"Beta": 4220, "R0": 10000, "T0C": 0}}`, true},
+		{`{"Beta": {"Beta": 4220, "R0": 10000, "T0C": -273.15}}`, false},
+		{`{"Beta": {"Beta": 4220, "R0": 10000, "T0C": -300}}`, false},
+		{`{"Beta": {"Beta": 4220}}`, false},
+		{`{"Beta": {"Beta": 0, "R0": 10000}}`, false},
+	} {
+		var config ThermistorConfig
+		if err := json.Unmarshal([]byte(c.json), &config); err != nil {
+			t.Fatalf("%s: %v", c.json, err)
+		}
+		if err := config.Vet(); (err == nil) != c.ok {
+			t.Errorf("%s: unexpected result %v", c.json, err)
+		}
+	}
+
+	// The coefficients are not finite.
+	for _, x := range []float64{math.NaN(), math.Inf(1)} {
+		th := ourThermistor()
+		th.C = x
+		if (ThermistorConfig{SteinhartHart: &th}).Vet() == nil {
+			t.Errorf("%v passed Vet", th)
+		}
+	}
+
+	// Without T0C, R0 is at 25C.
+	var config ThermistorConfig
+	if err := json.Unmarshal([]byte(`{"Beta": {"Beta": 4220, "R0": 10000}}`),
+		&config); err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Model().TempC(10000); math.Abs(got-25) > 1e-9 {
+		t.Errorf("10k is %.3fC", got)
+	}
+}